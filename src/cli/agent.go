@@ -0,0 +1,331 @@
+/*
+	agent: one client of the relay, it keep the websocket tunnels to the server connected.
+*/
+
+package cli
+
+import (
+	"context"
+	"ctrl"
+	"fmt"
+	"libs/log"
+	"libs/websocket"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	Default_Min_Tunnels   = 1
+	Default_Max_Backoff   = 60 // seconds
+	Default_Drain_Timeout = 30 // seconds
+
+	min_backoff = time.Second
+	// a tunnel lived longer than this is stable, the backoff is reset.
+	stable_tunnel_time = 30 * time.Second
+	drain_check_time   = 100 * time.Millisecond
+)
+
+// Agent carries the config, the allowed targets and the tunnels of one client,
+// more than one can run in a process.
+type Agent struct {
+	conf *Config
+
+	// parsed from Config.AllowTargets and the policy file
+	allow allowList
+	// the policy file is configured, all the targets must be in allow,
+	// otherwise only the proxy targets are checked.
+	policyEnforced bool
+
+	hostRW        *sync.RWMutex
+	localHostServ string // changed by Msg_Set_Config
+
+	udp *udpSessionTable
+
+	live    int32 // atomic, count of the connected websocket
+	rw      *sync.Mutex
+	clients map[*Client]bool
+	reverse map[string]net.Listener // key is ReverseRoute.Name
+
+	stop     chan struct{}
+	stopOnce *sync.Once
+	wg       *sync.WaitGroup
+}
+
+// NewAgent check the config and load the policy file, nothing is connected.
+func NewAgent(conf *Config) (*Agent, error) {
+	if conf == nil {
+		panic("config is nil.")
+	}
+	allow := conf.AllowTargets
+	if conf.PolicyFile != "" {
+		policy, err := LoadPolicy(conf.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		allow = append(append([]string{}, allow...), policy.Allow...)
+	}
+	list, err := parseAllowList(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Agent{
+		conf:           conf,
+		allow:          list,
+		policyEnforced: conf.PolicyFile != "",
+		hostRW:         new(sync.RWMutex),
+		localHostServ:  conf.LocalHostServ,
+		udp:            newUDPSessionTable(),
+		rw:             new(sync.Mutex),
+		clients:        make(map[*Client]bool),
+		reverse:        make(map[string]net.Listener),
+		stop:           make(chan struct{}),
+		stopOnce:       new(sync.Once),
+		wg:             new(sync.WaitGroup),
+	}
+	if (conf.ClientName == "") != (conf.Token == "") {
+		return nil, fmt.Errorf("ClientName and Token of token auth must be set together.")
+	}
+	if _, err := a.checkTarget(conf.LocalHostServ, false); err != nil {
+		return nil, fmt.Errorf("local network server[%s] is not in the policy file[%s], err=%s", conf.LocalHostServ, conf.PolicyFile, err.Error())
+	}
+	return a, nil
+}
+
+// Config return the config of the agent, it must not be changed.
+func (a *Agent) Config() *Config {
+	return a.conf
+}
+
+// LocalHostServ the default target of the routes, Config.LocalHostServ or set by the server.
+func (a *Agent) LocalHostServ() string {
+	a.hostRW.RLock()
+	defer a.hostRW.RUnlock()
+	return a.localHostServ
+}
+
+func (a *Agent) setLocalHostServ(hostAndPort string) {
+	a.hostRW.Lock()
+	defer a.hostRW.Unlock()
+	a.localHostServ = hostAndPort
+}
+
+// Start listen the reverse routes and keep MinTunnels websocket connected in goroutines until Shutdown.
+func (a *Agent) Start() {
+	n := a.conf.MinTunnels
+	if n <= 0 {
+		n = Default_Min_Tunnels
+	}
+	log.Info("agent keep [%d] tunnels to[%s].", n, a.conf.ForwardServ)
+
+	for _, route := range a.conf.ReverseRoutes {
+		if err := a.listenReverse(route); err != nil {
+			log.Error("listen reverse route[%s] err=%s", route, err.Error())
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		a.wg.Add(1)
+		go a.keepTunnel(i)
+	}
+}
+
+// Wait until the tunnels and the reverse routes stopped after Shutdown.
+func (a *Agent) Wait() {
+	a.wg.Wait()
+}
+
+// Run is Start and Wait.
+func (a *Agent) Run() {
+	a.Start()
+	a.Wait()
+}
+
+// NumTunnels count of the connected websocket.
+func (a *Agent) NumTunnels() int {
+	return int(atomic.LoadInt32(&a.live))
+}
+
+func (a *Agent) stopped() bool {
+	select {
+	case <-a.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *Agent) maxBackoff() time.Duration {
+	if a.conf.MaxBackoff <= 0 {
+		return Default_Max_Backoff * time.Second
+	}
+	return time.Duration(a.conf.MaxBackoff) * time.Second
+}
+
+// jitter return a random duration in [d/2, d], so the clients do not reconnect at the same time.
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func nextBackoff(backoff, max time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+func (a *Agent) keepTunnel(slot int) {
+	defer a.wg.Done()
+
+	backoff := min_backoff
+	for !a.stopped() {
+		start := time.Now()
+		client, err := a.connect(a.conf.ForwardServ)
+		if err != nil {
+			log.Error("tunnel[%d] connect[%s] fail err=[%s]", slot, a.conf.ForwardServ, err.Error())
+		} else if a.stopped() {
+			client.session.Close()
+			return
+		} else {
+			a.add(client)
+			closeErr := client.serve()
+			a.remove(client)
+			if client.fatal != nil {
+				log.Error("tunnel[%d] err=%s, stop reconnecting.", slot, client.fatal.Error())
+				return
+			}
+			if time.Since(start) >= stable_tunnel_time {
+				backoff = min_backoff
+			}
+			if closeErr != nil {
+				switch closeErr.Code {
+				case ctrl.Close_Auth_Revoked:
+					log.Error("tunnel[%d] rejected by the server, reason[%s], stop reconnecting.", slot, closeErr.Text)
+					return
+				case ctrl.Close_Server_Shutdown:
+					// the server is restarting, the jitter spread the clients
+					log.Warn("tunnel[%d] server shutdown, reconnect later.", slot)
+					backoff = min_backoff
+				case ctrl.Close_Kicked:
+					log.Warn("tunnel[%d] kicked by the server admin, reconnect later.", slot)
+				default:
+					log.Warn("tunnel[%d] closed by the server, code[%d] reason[%s].", slot, closeErr.Code, closeErr.Text)
+				}
+			}
+		}
+
+		wait := jitter(backoff)
+		log.Info("tunnel[%d] reconnect after[%s], live tunnels[%d].", slot, wait, a.NumTunnels())
+		select {
+		case <-a.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		backoff = nextBackoff(backoff, a.maxBackoff())
+	}
+}
+
+func (a *Agent) add(client *Client) {
+	a.rw.Lock()
+	defer a.rw.Unlock()
+	a.clients[client] = true
+	atomic.AddInt32(&a.live, 1)
+}
+
+func (a *Agent) remove(client *Client) {
+	a.rw.Lock()
+	defer a.rw.Unlock()
+	if a.clients[client] {
+		delete(a.clients, client)
+		atomic.AddInt32(&a.live, -1)
+	}
+}
+
+func (a *Agent) snapshot() []*Client {
+	a.rw.Lock()
+	defer a.rw.Unlock()
+	clients := make([]*Client, 0, len(a.clients))
+	for c := range a.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (a *Agent) activeStreams() int {
+	n := 0
+	for _, c := range a.snapshot() {
+		n += c.session.NumStreams()
+	}
+	return n
+}
+
+// Shutdown stop reconnect, tell the server no new connection, wait the forwarding
+// connections finish in DrainTimeout or until ctx is done, then close all tunnels.
+func (a *Agent) Shutdown(ctx context.Context) error {
+	a.stopOnce.Do(func() { close(a.stop) })
+
+	a.rw.Lock()
+	for name, l := range a.reverse {
+		l.Close()
+		delete(a.reverse, name)
+	}
+	a.rw.Unlock()
+
+	for _, c := range a.snapshot() {
+		if err := c.drain(); err != nil {
+			log.Warn("tunnel[%s] drain err=%s", c, err.Error())
+		}
+	}
+
+	timeout := time.Duration(a.conf.DrainTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = Default_Drain_Timeout * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+drain:
+	for {
+		n := a.activeStreams()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Warn("shutdown: [%d] connections still forwarding after[%s], close them.", n, timeout)
+			break
+		}
+		select {
+		case <-ctx.Done():
+			log.Warn("shutdown: [%d] connections still forwarding, close them, err=%s", n, ctx.Err().Error())
+			break drain
+		case <-time.After(drain_check_time):
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range a.snapshot() {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.session.CloseWithCode(websocket.CloseGoingAway, "client shutdown")
+		}(c)
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	log.Info("agent shutdown.")
+	return ctx.Err()
+}
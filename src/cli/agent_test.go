@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	const max = 60 * time.Second
+	backoff := min_backoff
+	for i := 0; i < 20; i++ {
+		wait := jitter(backoff)
+		if wait < backoff/2 || wait > backoff {
+			t.Fatal("jitter out of range", backoff, wait)
+		}
+		backoff = nextBackoff(backoff, max)
+		if backoff > max {
+			t.Fatal("backoff over the cap", backoff)
+		}
+	}
+	if backoff != max {
+		t.Fatal("backoff should reach the cap", backoff)
+	}
+}
+
+func TestAgentShutdown(t *testing.T) {
+	// nothing listen at this port, the tunnels keep retrying until Shutdown.
+	agent, err := NewAgent(&Config{ForwardServ: "127.0.0.1:1", MinTunnels: 3, DrainTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		agent.Run()
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := agent.NumTunnels(); n != 0 {
+		t.Fatal("no tunnel should be live", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := agent.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run not return after Shutdown")
+	}
+}
+
+func TestAnswerChallengeNoToken(t *testing.T) {
+	agent, err := NewAgent(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{agent: agent}
+	if err := c.answerChallenge("nonce"); err != ErrNoToken {
+		t.Fatal("want ErrNoToken, got", err)
+	}
+}
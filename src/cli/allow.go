@@ -0,0 +1,126 @@
+/*
+	allowlist of the targets which the server can ask the client to connect.
+*/
+
+package cli
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// allowRule is "CIDR", "IP" or "hostname", with ":port", ":port-port" or not(any port).
+// IPv6 with port is "[::1]:22".
+type allowRule struct {
+	cidr    *net.IPNet
+	host    string // lower case hostname
+	minPort int    // 0 is any port
+	maxPort int
+}
+
+func parseAllowRule(s string) (*allowRule, error) {
+	s = strings.TrimSpace(s)
+	rule := &allowRule{}
+
+	host := s
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		min, max := p, p
+		if pos := strings.Index(p, "-"); pos > 0 {
+			min, max = p[:pos], p[pos+1:]
+		}
+		rule.minPort, err = strconv.Atoi(min)
+		if err == nil {
+			rule.maxPort, err = strconv.Atoi(max)
+		}
+		if err != nil || rule.minPort <= 0 || rule.maxPort > 65535 || rule.minPort > rule.maxPort {
+			return nil, fmt.Errorf("allow rule[%s] bad port", s)
+		}
+		host = h
+	}
+	if host == "" {
+		return nil, fmt.Errorf("allow rule[%s] empty host", s)
+	}
+
+	if _, cidr, err := net.ParseCIDR(host); err == nil {
+		rule.cidr = cidr
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		rule.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		rule.host = strings.ToLower(host)
+	}
+	return rule, nil
+}
+
+func (rule *allowRule) match(host string, ip net.IP, port int) bool {
+	if rule.minPort != 0 && (port < rule.minPort || port > rule.maxPort) {
+		return false
+	}
+	if rule.cidr != nil {
+		return ip != nil && rule.cidr.Contains(ip)
+	}
+	return host != "" && rule.host == strings.ToLower(host)
+}
+
+type allowList []*allowRule
+
+func parseAllowList(rules []string) (allowList, error) {
+	var list allowList
+	for _, s := range rules {
+		rule, err := parseAllowRule(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, rule)
+	}
+	return list, nil
+}
+
+// check return the address to dial if the target is allowed.
+// a hostname not in the list is resolved, all its IPs must be allowed,
+// and the first IP is dialed, so the DNS answer can not change after the check.
+func (list allowList) check(target string) (string, error) {
+	host, p, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", fmt.Errorf("target[%s] bad port", target)
+	}
+
+	ip := net.ParseIP(host)
+	for _, rule := range list {
+		if rule.match(host, ip, port) {
+			return target, nil
+		}
+	}
+	if ip != nil {
+		return "", fmt.Errorf("target[%s] is not allowed", target)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return "", fmt.Errorf("target[%s] is not allowed", target)
+	}
+	for _, ip := range ips {
+		if !list.matchIP(ip, port) {
+			return "", fmt.Errorf("target[%s] resolved to[%s] is not allowed", target, ip)
+		}
+	}
+	return net.JoinHostPort(ips[0].String(), p), nil
+}
+
+func (list allowList) matchIP(ip net.IP, port int) bool {
+	for _, rule := range list {
+		if rule.match("", ip, port) {
+			return true
+		}
+	}
+	return false
+}
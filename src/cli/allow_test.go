@@ -0,0 +1,36 @@
+package cli
+
+import "testing"
+
+func TestAllowList(t *testing.T) {
+	list, err := parseAllowList([]string{"192.168.1.0/24", "10.0.0.5:22", "localhost:8000", "[::1]:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := map[string]string{
+		"192.168.1.10:80":  "192.168.1.10:80",
+		"10.0.0.5:22":      "10.0.0.5:22",
+		"LOCALHOST:8000":   "LOCALHOST:8000",
+		"[::1]:80":         "[::1]:80",
+		"192.168.1.255:22": "192.168.1.255:22",
+	}
+	for target, want := range allowed {
+		got, err := list.check(target)
+		if err != nil || got != want {
+			t.Error("want allowed", target, got, err)
+		}
+	}
+
+	for _, target := range []string{"192.168.2.1:80", "10.0.0.5:23", "localhost:8001", "[::1]:22", "10.0.0.5"} {
+		if _, err := list.check(target); err == nil {
+			t.Error("want rejected", target)
+		}
+	}
+
+	for _, s := range []string{"", "10.0.0.1:0", "10.0.0.1:http", ":22"} {
+		if _, err := parseAllowRule(s); err == nil {
+			t.Error("want error for rule", s)
+		}
+	}
+}
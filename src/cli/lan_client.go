@@ -4,6 +4,7 @@ import (
 	"ctrl"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -12,179 +13,200 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"sync"
+	"sync/atomic"
+	"time"
+	"tunnel"
 )
 
 const (
-	Default_Buffer_Size = 4096
-	// chan using memory is Channel_Size * Default_Buffer_Size
-	Default_Channel_Size = 4
+	// max count of the forwarded connections carried by one websocket.
+	Default_Max_Stream = 256
 )
 
 var frameTypStr = websocket.MsgTypeS
 
+var ErrNoToken = errors.New("server need token auth, but no ClientName and Token configured")
+
 type Config struct {
+	ForwardServ   string `json:"ForwardServ"` // websocket server ip:port, wss://ip:port is TLS
 	LocalHostServ string `json:"LocalHostServ"`
-	WebsocketAuth string `json:"WebsocketAuth"`
-	MaxThread     int    `json:"MaxThread"`
-	currThread    int    `json:"CurrThread"`
-	orwardServ    string
-}
-
-var pConfig *Config
-
-var g_localForwardHostAndPort string
-
-func setLocalForardHostAndPort(hostAndPort string) {
-	g_localForwardHostAndPort = hostAndPort
+	WebsocketAuth string `json:"WebsocketAuth"` // username:password of Basic auth
+	ClientName    string `json:"ClientName"`    // credential name of token auth
+	Token         string `json:"Token"`         // credential token, only used to answer the challenge
+	MaxStream     int    `json:"MaxStream"`
+	SiteID        string `json:"SiteID"` // which site(home) the client belongs to, empty is ctrl.DEFAULT_SITE
+	LogLevel      string `json:"LogLevel"`
+	LogFile       string `json:"LogFile"` // empty is stdout
+
+	// for wss://, the system CA is used if none of them is set.
+	TLSCAFile      string `json:"TLSCAFile"`      // only trust the CA or self-signed cert in the file
+	TLSFingerprint string `json:"TLSFingerprint"` // pin the server cert by SHA-256 fingerprint
+	TLSInsecure    bool   `json:"TLSInsecure"`    // do not verify the server cert, only for testing
+
+	PingInterval   int `json:"PingInterval"`   // seconds between heartbeat pings, default 30
+	MaxMissedPongs int `json:"MaxMissedPongs"` // reconnect after these pings not answered, default 3
+
+	UDPIdleTimeout int `json:"UDPIdleTimeout"` // seconds, close the UDP session of a peer which is idle, default 60
+
+	ReverseRoutes []*ReverseRoute `json:"ReverseRoutes"` // listen in the local network, the server connect the targets
+
+	// targets the SOCKS5/HTTP CONNECT clients on the server can connect, empty is none.
+	// "CIDR", "IP" or "hostname", with ":port" or not(any port).
+	AllowTargets []string `json:"AllowTargets"`
+	// with the policy file, the route targets and Msg_Set_Config must be allowed too.
+	PolicyFile string `json:"PolicyFile"`
+
+	MinTunnels   int `json:"MinTunnels"`   // websocket kept connected even when idle, default 1
+	MaxBackoff   int `json:"MaxBackoff"`   // max seconds to wait before reconnect, default 60
+	DrainTimeout int `json:"DrainTimeout"` // seconds to wait the forwarding connections when shutdown, default 30
 }
 
+// Client is one websocket tunnel of the agent.
 type Client struct {
-	webSocket   *websocket.Conn
-	localConn   *net.Conn
-	forwardData chan []byte // 从websock中接收到Binary数据，转发到localConn中
-	rw          *sync.RWMutex
+	agent    *Agent
+	session  *tunnel.Session
+	draining int32 // atomic, 1 is shutting down, no new connection
+	fatal    error // the server can never accept the tunnel, do not reconnect
 }
 
-func NewClient(ws *websocket.Conn) *Client {
+func NewClient(agent *Agent, ws *websocket.Conn) *Client {
 	client := &Client{
-		webSocket: ws,
-		rw:        new(sync.RWMutex),
+		agent:   agent,
+		session: tunnel.NewSession(ws, false),
 	}
 	return client
 }
 
 func (client *Client) String() string {
-	return client.webSocket.String()
+	return client.session.String()
 }
 
-func (c *Client) Write(b []byte) (int, error) {
-	err := c.webSocket.WriteBinary(b)
-	return len(b), err
-}
-
-func (c *Client) tellServRequestFinish() error {
-	// tel the server this thread connect to the local-host was close or data tans finish.
-	return c.webSocket.WriteString(ctrl.RquestFinishFrame)
-}
-
-func (c *Client) tellServBusy() error {
-	// tell the server this thread was busy
-	return c.webSocket.WriteString(ctrl.ClientBusyFrame)
+func (c *Client) tellServBusy(index int64) error {
+	// tell the server this websocket was busy, can not open the stream.
+	frame := ctrl.WebSocketControlFrame{
+		Type:  ctrl.Msg_Client_Busy,
+		Index: index,
+	}
+	return c.session.WriteControl(&frame)
 }
 
 func (c *Client) telServConfig() error {
 	frame := ctrl.WebSocketControlFrame{
 		Type:    ctrl.Msg_Get_Config,
 		Index:   0,
-		Content: pConfig.LocalHostServ,
+		Content: c.agent.LocalHostServ(),
 	}
-	return c.webSocket.WriteString(frame.Bytes())
+	return c.session.WriteControl(&frame)
 }
 
-func (c *Client) tellServError(err error) error {
+func (c *Client) tellServError(index int64, err error) error {
 	frame := ctrl.WebSocketControlFrame{
 		Type:    ctrl.Msg_Sys_Err,
-		Index:   0,
+		Index:   index,
 		Content: err.Error(),
 	}
-	return c.webSocket.WriteString(frame.Bytes())
+	return c.session.WriteControl(&frame)
 }
 
-func (c *Client) newConnect2LoalNetwork() error {
-	if pConfig.currThread < pConfig.MaxThread {
-		go Connect2Serv(pConfig.orwardServ, pConfig)
+func (c *Client) answerChallenge(nonce string) error {
+	conf := c.agent.conf
+	if conf.ClientName == "" || conf.Token == "" {
+		return ErrNoToken
 	}
-
-	// 与本地局域网服务器g_localForwardHostAndPort 建立socket连接
-	c.rw.Lock()
-	defer c.rw.Unlock()
-
-	if c.localConn != nil {
-		log.Warn("[%s], thread is busy. can not create new connect.", c)
-		c.tellServBusy()
-		return fmt.Errorf("[%s] thread is busy. can not create new connect.", c)
+	resp := ctrl.AuthResponse{
+		Name: conf.ClientName,
+		MAC:  ctrl.AuthMAC(conf.Token, nonce),
 	}
-
-	conn, err := net.Dial("tcp", g_localForwardHostAndPort)
+	bytes, err := json.Marshal(&resp)
 	if err != nil {
-		log.Error("[%s] Connect to[%s] err=%s", c, g_localForwardHostAndPort, err.Error())
-		c.tellServError(err)
 		return err
 	}
-
-	go c.readForward(conn)
-
-	c.localConn = &conn
-	c.forwardData = make(chan []byte, Default_Channel_Size*4)
-
-	go c.writerForward(conn)
-
-	log.Info("new connection was create [%s]", conn.RemoteAddr())
-	return nil
-}
-
-func (c *Client) closeLoalNetworkConnection(isReader bool) {
-	c.rw.Lock()
-	defer c.rw.Unlock()
-	if c.localConn == nil {
-		return
-	}
-	if isReader {
-		// 如果readForward函数先结束，writerForward 中的buff = <- c.forwardData会一直阻塞
-		// 此处发一个字节作信号，使 writerForward 退出
-		c.forwardData <- []byte("")
+	frame := ctrl.WebSocketControlFrame{
+		Type:    ctrl.Msg_Auth_Response,
+		Content: string(bytes),
 	}
+	return c.session.WriteControl(&frame)
+}
 
-	(*c.localConn).Close()
-	c.tellServRequestFinish()
-	log.Info("connection was close[%s]", (*c.localConn).RemoteAddr())
-	c.localConn = nil
-	close(c.forwardData)
+// drain tell the server do not send new connection to this websocket.
+func (c *Client) drain() error {
+	atomic.StoreInt32(&c.draining, 1)
+	frame := ctrl.WebSocketControlFrame{Type: ctrl.Msg_Client_Drain}
+	return c.session.WriteControl(&frame)
 }
 
-func (c *Client) closeLocalConnect() {
-	c.closeLoalNetworkConnection(true)
+// setConfig the server change the local network server, it must be allowed by the policy.
+func (c *Client) setConfig(localServ string) error {
+	if _, err := c.agent.checkTarget(localServ, false); err != nil {
+		log.Warn("[%s] server set local network server[%s] rejected by policy, err=%s", c, localServ, err.Error())
+		return c.tellServError(0, err)
+	}
+	log.Info("[%s] server set local network server[%s]", c, localServ)
+	c.agent.setLocalHostServ(localServ)
+	return c.telServConfig()
 }
 
-func (c *Client) writerForward(writer io.Writer) {
-	buff := make([]byte, Default_Buffer_Size)
-	var err error
+func (c *Client) newConnect2LoalNetwork(index int64, content string) error {
+	info, err := ctrl.ParseConnectInfo(content)
+	if err != nil {
+		log.Error("[%s] stream[%d] bad connect info[%s] err=%s", c, index, content, err.Error())
+		return c.tellServError(index, err)
+	}
+	target := info.Target
+	if target == "" {
+		target = c.agent.LocalHostServ()
+	}
+	// 代理客户端指定的目标必须在白名单内, 配置了策略文件时所有目标都要检查
+	if target, err = c.agent.checkTarget(target, info.Proxy); err != nil {
+		log.Warn("[%s] stream[%d] route[%s] rejected by policy, err=%s", c, index, info.Route, err.Error())
+		return c.tellServError(index, err)
+	}
 
-	for {
-		buff = <-c.forwardData
-		_, err = writer.Write(buff)
-		if err != nil {
-			break
-		}
+	max := c.agent.conf.MaxStream
+	if max <= 0 {
+		max = Default_Max_Stream
+	}
+	if atomic.LoadInt32(&c.draining) == 1 || c.session.NumStreams() >= max {
+		log.Warn("[%s] carries [%d] streams, can not create new connect.", c, max)
+		c.tellServBusy(index)
+		return fmt.Errorf("[%s] is busy. can not create new connect.", c)
 	}
 
-	if err != nil && err != io.EOF {
-		log.Error("Write to Local-network err=%s", err.Error())
+	// 先登记 stream, 连接本地服务器期间收到的数据会缓存在 stream 中
+	stream, err := c.session.Accept(uint32(index), content)
+	if err != nil {
+		log.Error("[%s] accept stream[%d] err=%s", c, index, err.Error())
+		return err
 	}
 
-	c.closeLoalNetworkConnection(false)
-	log.Info("end writer forward.")
+	log.Debug("[%s] route[%s] connect to[%s] proto[%s]", stream, info.Route, target, info.Proto)
+	if info.Proto == ctrl.PROTO_UDP {
+		go c.forwardUDP(stream, info, target)
+	} else {
+		go c.forward(stream, target, info.Proxy)
+	}
+	return nil
 }
 
-func (c *Client) readForward(reader io.Reader) {
-	// 从本地局域网连接中读取到数据，通过websocket的Binary帧方式发给服务器
-	p := make([]byte, Default_Buffer_Size)
-	var err error
-	for {
-		n, err := reader.Read(p)
-		if err != nil {
-			break
-		}
-		c.Write(p[:n])
+// forward proxy is true if the server wait the result of the dial to reply its proxy client.
+func (c *Client) forward(stream *tunnel.Stream, hostAndPort string, proxy bool) {
+	// 与本地局域网服务器建立socket连接
+	conn, err := net.Dial("tcp", hostAndPort)
+	if err != nil {
+		log.Error("[%s] Connect to[%s] err=%s", stream, hostAndPort, err.Error())
+		stream.Reset(err)
+		return
 	}
-
-	if err != nil && err != io.EOF {
-		log.Error("Write to Local-network err=%s", err.Error())
+	log.Info("new connection was create [%s] for stream[%s]", conn.RemoteAddr(), stream)
+	if proxy {
+		if err := stream.SendConnected(); err != nil {
+			conn.Close()
+			stream.Reset(err)
+			return
+		}
 	}
 
-	c.closeLoalNetworkConnection(true)
-	log.Info("end reader forward.")
+	tunnel.Join(stream, conn)
 }
 
 func (c *Client) handlerControlFrame(bFrame []byte) (err error) {
@@ -194,18 +216,29 @@ func (c *Client) handlerControlFrame(bFrame []byte) (err error) {
 		log.Error("Recve a Text-Frame not JSON format. err=%v, frame=%v", err.Error(), string(bFrame))
 		return err
 	}
-	log.Info("TCP[%v] Get Frame T[%v], Content=%v, index=%v, ", c, msg.TypeStr(), msg.Content, msg.Index)
+	log.Debug("TCP[%v] Get Frame T[%v], Content=%v, index=%v, ", c, msg.TypeStr(), msg.Content, msg.Index)
 
 	switch msg.Type {
 	case ctrl.Msg_New_Connection:
-		c.newConnect2LoalNetwork()
+		err = c.newConnect2LoalNetwork(msg.Index, msg.Content)
+	case ctrl.Msg_Close_Write:
+		c.session.HandleCloseWrite(uint32(msg.Index))
 	case ctrl.Msg_Request_Finish:
-		c.closeLocalConnect()
+		c.session.HandleFinish(uint32(msg.Index))
+	case ctrl.Msg_Sys_Err:
+		if msg.Index == 0 {
+			log.Error("TCP[%v] server error: %s", c, msg.Content)
+			break
+		}
+		c.session.HandleError(uint32(msg.Index), msg.Content)
+	case ctrl.Msg_Window_Update:
+		err = c.session.HandleWindowUpdate(uint32(msg.Index), msg.Content)
+	case ctrl.Msg_Auth_Challenge:
+		err = c.answerChallenge(msg.Content)
 	case ctrl.Msg_Get_Config:
 		err = c.telServConfig()
 	case ctrl.Msg_Set_Config:
-		pConfig.LocalHostServ = msg.Content
-		err = c.telServConfig()
+		err = c.setConfig(msg.Content)
 	default:
 		log.Warn("no handler Msg T[%s]", msg.TypeStr())
 	}
@@ -213,86 +246,115 @@ func (c *Client) handlerControlFrame(bFrame []byte) (err error) {
 }
 
 func (client *Client) waitForCommand() {
+	defer client.session.CloseAll()
+
 	for {
-		frameType, bFrame, err := client.webSocket.Read()
+		frameType, bFrame, err := client.session.WebSocket().Read()
 		log.Debug("TCP[%s] recv WebSocket Frame typ=[%v] size=[%d], crc32=[%d]",
 			client, frameTypStr(frameType), len(bFrame), crc32.ChecksumIEEE(bFrame))
 
 		if err != nil {
-			if err != io.ErrUnexpectedEOF {
+			if code := websocket.CloseCodeOf(err); code != 0 {
+				log.Warn("TCP[%s] protocol error, close code[%d] err=%v", client, code, err.Error())
+				client.session.Fail(err)
+			} else if err != io.ErrUnexpectedEOF {
 				log.Error("TCP[%s] close Unexpected err=%v", client, err.Error())
 			} else {
 				log.Debug("TCP[%s] close the socket. EOF.", client)
 			}
-			client.closeLocalConnect()
 			return
 		}
 
 		switch frameType {
 		case websocket.CloseMessage:
-			log.Info("TCP[%s] close Frame revced. end wait Frame loop", client)
-			client.closeLocalConnect()
+			closeErr := websocket.ParseCloseMessage(bFrame)
+			log.Info("TCP[%s] close Frame revced code[%d] reason[%s]. end wait Frame loop", client, closeErr.Code, closeErr.Text)
+			client.session.CloseWithCode(closeErr.Code, closeErr.Text)
 			return
 		case websocket.TextMessage:
 			err := client.handlerControlFrame(bFrame)
+			if err == ErrNoToken {
+				// 重连也通不过认证
+				client.fatal = err
+				return
+			}
 			if err != nil {
 				log.Error("handlerControlFrame ret[%s]", err.Error())
 			}
 		case websocket.BinaryMessage:
-			log.Info("put Binary-Data to chan-len[%d]", len(client.forwardData))
-			select {
-			case client.forwardData <- bFrame:
-				log.Info("put frame to client.forwardData len[%d] end", len(client.forwardData))
-			default:
-				log.Warn("[%s] is busy", client)
-				client.tellServBusy()
+			if err := client.session.HandleBinary(bFrame); err != nil {
+				log.Warn("TCP[%s] handle binary frame err=%v", client, err)
 			}
-		case websocket.PingMessage, websocket.PongMessage: // IE-11 会无端端发一个pong上来
-			client.webSocket.Pong(bFrame)
+		case websocket.PingMessage:
+			client.session.Pong(bFrame)
+		case websocket.PongMessage:
+			client.session.HandlePong(bFrame)
 		default:
 			log.Warn("TODO: revce frame-type=%v. can not handler. content=%v", frameTypStr(frameType), string(bFrame))
 		}
 	}
 }
 
-func Connect2Serv(forwardServ string, conf *Config) {
-	if conf == nil {
-		panic("config is nil.")
-	}
-	// global pConfig
-	pConfig = conf
-	pConfig.orwardServ = forwardServ
-
-	var localServ, auth = conf.LocalHostServ, conf.WebsocketAuth
-
-	setLocalForardHostAndPort(localServ)
+// connect dial the server and finish the websocket handshake.
+func (a *Agent) connect(forwardServ string) (*Client, error) {
+	conf := a.conf
+	var auth = conf.WebsocketAuth
 
 	websockURI := ctrl.WEBSOCKET_CONNECT_URI
 
-	log.Info("start TCP connect to[%s]", forwardServ)
-	conn, err := net.Dial("tcp", forwardServ)
+	hostAndPort, useTLS := parseServAddr(forwardServ)
+	log.Info("start TCP connect to[%s] TLS[%v]", hostAndPort, useTLS)
+	conn, err := dialServ(hostAndPort, useTLS, conf)
 	if err != nil {
-		log.Error("connect[%s] fail err=[%s]", forwardServ, err.Error())
-		return
+		return nil, err
+	}
+	var headers = http.Header{}
+	if conf.SiteID != "" {
+		headers.Add(ctrl.WEBSOCKET_SITE_HEADER, conf.SiteID)
 	}
-	var headers http.Header
 	if auth != "" {
-		headers = http.Header{}
 		headers.Add("Authorization", fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(auth))))
 	}
 
 	log.Info("start websocket NewClient to[%s][%s]", forwardServ, websockURI)
-	ws, _, err := websocket.NewClient(conn, &url.URL{Host: forwardServ, Path: websockURI}, headers)
+	ws, _, err := websocket.NewClient(conn, &url.URL{Host: hostAndPort, Path: websockURI}, headers)
 	if err != nil {
-		log.Error("Connect to[%s] err=%s", forwardServ, err.Error())
-		return
+		conn.Close()
+		return nil, err
 	}
 
-	client := NewClient(ws)
+	client := NewClient(a, ws)
 	log.Info("Connect[%s] success at[%s], wait for server command.", forwardServ, client)
+	return client, nil
+}
 
-	pConfig.currThread++
+// serve the server command until the websocket closed,
+// return the server's close frame, nil if the connection was lost without it.
+func (client *Client) serve() *websocket.CloseError {
+	conf := client.agent.conf
+	client.session.StartHeartbeat(time.Duration(conf.PingInterval)*time.Second, conf.MaxMissedPongs)
 	client.waitForCommand()
-	pConfig.currThread--
-	log.Info("client thread exist.")
+	client.session.Close()
+	log.Info("client websocket exist.")
+
+	closeErr := client.session.WebSocket().CloseError()
+	if closeErr == nil || closeErr.Code == websocket.CloseAbnormalClosure {
+		return nil
+	}
+	return closeErr
+}
+
+// Connect2Serv serve one websocket tunnel until it closed, no reconnect.
+func Connect2Serv(forwardServ string, conf *Config) {
+	agent, err := NewAgent(conf)
+	if err != nil {
+		log.Error("config err=%s", err.Error())
+		return
+	}
+	client, err := agent.connect(forwardServ)
+	if err != nil {
+		log.Error("connect[%s] fail err=[%s]", forwardServ, err.Error())
+		return
+	}
+	client.serve()
 }
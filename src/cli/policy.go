@@ -0,0 +1,37 @@
+/*
+	local policy file of the client: which targets in the local network the server can use,
+	by the routes, the proxy routes and Msg_Set_Config.
+*/
+
+package cli
+
+import (
+	"libs/config"
+)
+
+// Policy file is .json or .toml, e.g.
+//
+//	Allow = ["192.168.1.0/24:80", "192.168.1.0/24:554", "nas.lan:445", "10.0.0.5:8000-8100"]
+type Policy struct {
+	Allow []string `json:"Allow"` // "CIDR", "IP" or "hostname", with ":port", ":port-port" or not(any port)
+}
+
+func LoadPolicy(file string) (*Policy, error) {
+	policy := &Policy{}
+	if err := config.Load(file, policy); err != nil {
+		return nil, err
+	}
+	// check the rules now, not when the first connection come.
+	if _, err := parseAllowList(policy.Allow); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// checkTarget return the address to dial, the proxy target must always be allowed.
+func (a *Agent) checkTarget(target string, proxy bool) (string, error) {
+	if !proxy && !a.policyEnforced {
+		return target, nil
+	}
+	return a.allow.check(target)
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"ctrl"
+	"encoding/json"
+	"io/ioutil"
+	"libs/websocket"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `
+# home LAN policy
+Allow = ["192.168.1.0/24:80", "192.168.1.10:8000-8100", "127.0.0.1:8000"]
+`
+
+func TestPolicySetConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy.toml")
+	if err := ioutil.WriteFile(file, []byte(testPolicy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewAgent(&Config{LocalHostServ: "127.0.0.1:22", PolicyFile: file}); err == nil {
+		t.Fatal("local network server not in the policy must fail")
+	}
+	agent, err := NewAgent(&Config{LocalHostServ: "127.0.0.1:8000", PolicyFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for target, allowed := range map[string]bool{
+		"192.168.1.20:80":   true,
+		"192.168.1.10:8050": true,
+		"192.168.1.10:8101": false,
+		"192.168.1.20:22":   false,
+		"10.0.0.1:80":       false,
+	} {
+		if _, err := agent.checkTarget(target, false); (err == nil) != allowed {
+			t.Error("target", target, "want allowed", allowed, "err", err)
+		}
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	client := NewClient(agent, websocket.NewConn(c1, false))
+	peer := websocket.NewConn(c2, true)
+
+	go client.setConfig("192.168.1.20:22")
+	_, frame, err := peer.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := ctrl.WebSocketControlFrame{}
+	if err := json.Unmarshal(frame, &msg); err != nil || msg.Type != ctrl.Msg_Sys_Err {
+		t.Fatal("want Msg_Sys_Err, got", string(frame), err)
+	}
+	if agent.LocalHostServ() != "127.0.0.1:8000" {
+		t.Fatal("rejected config was applied", agent.LocalHostServ())
+	}
+
+	go client.setConfig("192.168.1.20:80")
+	if _, frame, err = peer.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(frame, &msg); err != nil || msg.Type != ctrl.Msg_Get_Config || msg.Content != "192.168.1.20:80" {
+		t.Fatal("want Msg_Get_Config, got", string(frame), err)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+	reverse route: listen a port in the local network, the connections are
+	carried over the websocket and the server connect the target.
+*/
+
+package cli
+
+import (
+	"ctrl"
+	"fmt"
+	"libs/log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"tunnel"
+)
+
+type ReverseRoute struct {
+	Name   string `json:"Name"`
+	Listen string `json:"Listen"` // ip:port in the local network
+	Target string `json:"Target"` // host:port the server connect, must be in the server's ReverseTargets
+}
+
+// ParseReverseRoute parse "name,listen,target".
+func ParseReverseRoute(s string) (*ReverseRoute, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("reverse route[%s] format must be name,listen,target", s)
+	}
+	return &ReverseRoute{
+		Name:   strings.TrimSpace(fields[0]),
+		Listen: strings.TrimSpace(fields[1]),
+		Target: strings.TrimSpace(fields[2]),
+	}, nil
+}
+
+func (r *ReverseRoute) String() string {
+	return fmt.Sprintf("%s[%s=>%s]", r.Name, r.Listen, r.Target)
+}
+
+func (r *ReverseRoute) connectInfo() string {
+	info := ctrl.ConnectInfo{Route: r.Name, Target: r.Target, Reverse: true}
+	return info.String()
+}
+
+// freeClient return the connected websocket which carries the fewest streams.
+func (a *Agent) freeClient() (*Client, error) {
+	var client *Client
+	var min int
+	for _, c := range a.snapshot() {
+		if atomic.LoadInt32(&c.draining) == 1 {
+			continue
+		}
+		n := c.session.NumStreams()
+		if client == nil || n < min {
+			client, min = c, n
+		}
+	}
+	if client == nil {
+		return nil, fmt.Errorf("no websocket connected to[%s].", a.conf.ForwardServ)
+	}
+	return client, nil
+}
+
+func (a *Agent) listenReverse(route *ReverseRoute) error {
+	if route.Name == "" || route.Listen == "" || route.Target == "" {
+		return fmt.Errorf("reverse route name, listen and target can not be empty.")
+	}
+	l, err := net.Listen("tcp", route.Listen)
+	if err != nil {
+		return err
+	}
+
+	a.rw.Lock()
+	if _, find := a.reverse[route.Name]; find {
+		a.rw.Unlock()
+		l.Close()
+		return fmt.Errorf("reverse route[%s] already exists.", route.Name)
+	}
+	a.reverse[route.Name] = l
+	a.rw.Unlock()
+	log.Info("reverse route[%s] listen.", route)
+
+	a.wg.Add(1)
+	go a.serveReverse(route, l)
+	return nil
+}
+
+// ReverseAddr the address the reverse route listened, nil if the route is not listened,
+// the real port when Listen is ":0".
+func (a *Agent) ReverseAddr(name string) net.Addr {
+	a.rw.Lock()
+	defer a.rw.Unlock()
+	if l, find := a.reverse[name]; find {
+		return l.Addr()
+	}
+	return nil
+}
+
+func (a *Agent) serveReverse(route *ReverseRoute, l net.Listener) {
+	defer a.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if a.stopped() {
+				break
+			}
+			log.Error("reverse route[%s] Accept err=%s", route.Name, err.Error())
+			continue
+		}
+		go a.reverseForward(conn, route)
+	}
+	log.Info("reverse route[%s] stop listen.", route)
+}
+
+func (a *Agent) reverseForward(conn net.Conn, route *ReverseRoute) {
+	defer conn.Close()
+
+	client, err := a.freeClient()
+	if err != nil {
+		log.Error("reverse route[%s] conn[%s] err=%s", route.Name, conn.RemoteAddr(), err.Error())
+		return
+	}
+	stream, err := client.session.Open(route.connectInfo())
+	if err != nil {
+		log.Error("reverse route[%s] open stream err=%s", route.Name, err.Error())
+		return
+	}
+	log.Info("reverse conn[%s] route[%s] to stream[%s].", conn.RemoteAddr(), route.Name, stream)
+
+	tunnel.Join(stream, conn)
+}
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"context"
+	"ctrl"
+	"testing"
+)
+
+func TestParseReverseRoute(t *testing.T) {
+	route, err := ParseReverseRoute("backup, 0.0.0.0:873, 10.0.0.5:873")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Name != "backup" || route.Listen != "0.0.0.0:873" || route.Target != "10.0.0.5:873" {
+		t.Fatal("bad reverse route", route)
+	}
+	info, err := ctrl.ParseConnectInfo(route.connectInfo())
+	if err != nil || !info.Reverse || info.Target != route.Target {
+		t.Fatal("bad connect info", route.connectInfo(), err)
+	}
+
+	for _, s := range []string{"backup", "backup,0.0.0.0:873", "a,b,c,d"} {
+		if _, err := ParseReverseRoute(s); err == nil {
+			t.Error("want error for", s)
+		}
+	}
+}
+
+// TestReverseSharedConfig two agents of the same config listen their own ports.
+func TestReverseSharedConfig(t *testing.T) {
+	conf := &Config{
+		ForwardServ:   "127.0.0.1:1",
+		DrainTimeout:  1,
+		ReverseRoutes: []*ReverseRoute{{Name: "backup", Listen: "127.0.0.1:0", Target: "10.0.0.5:873"}},
+	}
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		agent, err := NewAgent(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agent.Start()
+		defer agent.Shutdown(context.Background())
+
+		addr := agent.ReverseAddr("backup")
+		if addr == nil {
+			t.Fatal("reverse route not listened")
+		}
+		addrs = append(addrs, addr.String())
+	}
+	if addrs[0] == addrs[1] {
+		t.Fatal("the agents share a listener", addrs)
+	}
+	if conf.ReverseRoutes[0].Listen != "127.0.0.1:0" {
+		t.Fatal("the config was changed", conf.ReverseRoutes[0])
+	}
+}
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"ctrl"
+	"fmt"
+	"io/ioutil"
+	"libs/log"
+	"net"
+	"strings"
+)
+
+// parseServAddr: "wss://ip:port" is TLS, "ws://ip:port" and "ip:port" are plain TCP.
+func parseServAddr(forwardServ string) (hostAndPort string, useTLS bool) {
+	switch {
+	case strings.HasPrefix(forwardServ, "wss://"):
+		return strings.TrimSuffix(forwardServ[len("wss://"):], "/"), true
+	case strings.HasPrefix(forwardServ, "ws://"):
+		return strings.TrimSuffix(forwardServ[len("ws://"):], "/"), false
+	}
+	return forwardServ, false
+}
+
+// dialServ connect to the websocket server, by TLS if the address is wss://
+func dialServ(hostAndPort string, useTLS bool, conf *Config) (net.Conn, error) {
+	if !useTLS {
+		return net.Dial("tcp", hostAndPort)
+	}
+	tlsConf, err := clientTLSConfig(hostAndPort, conf)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", hostAndPort, tlsConf)
+}
+
+func clientTLSConfig(hostAndPort string, conf *Config) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(hostAndPort)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch {
+	case conf.TLSFingerprint != "":
+		// pin the server cert, the CA chain and the host name are not checked.
+		want := normalizeFingerprint(conf.TLSFingerprint)
+		tlsConf.InsecureSkipVerify = true
+		tlsConf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server[%s] has no certificate", hostAndPort)
+			}
+			got := ctrl.CertFingerprint(rawCerts[0])
+			if normalizeFingerprint(got) != want {
+				return fmt.Errorf("server[%s] certificate fingerprint[%s] not match the pinned one", hostAndPort, got)
+			}
+			return nil
+		}
+	case conf.TLSCAFile != "":
+		// only trust the CA (or the self-signed cert) in the file.
+		pem, err := ioutil.ReadFile(conf.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in[%s]", conf.TLSCAFile)
+		}
+		tlsConf.RootCAs = pool
+	case conf.TLSInsecure:
+		log.Warn("TLS insecure mode, the server[%s] certificate is NOT verified, only for testing.", hostAndPort)
+		tlsConf.InsecureSkipVerify = true
+	}
+	return tlsConf, nil
+}
+
+func normalizeFingerprint(s string) string {
+	return strings.ToUpper(strings.Replace(strings.TrimSpace(s), ":", "", -1))
+}
@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"ctrl"
+	"encoding/pem"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseServAddr(t *testing.T) {
+	cases := []struct {
+		addr, hostAndPort string
+		tls               bool
+	}{
+		{"wss://1.2.3.4:8081/", "1.2.3.4:8081", true},
+		{"ws://1.2.3.4:8081", "1.2.3.4:8081", false},
+		{"1.2.3.4:8081", "1.2.3.4:8081", false},
+	}
+	for _, c := range cases {
+		if hostAndPort, useTLS := parseServAddr(c.addr); hostAndPort != c.hostAndPort || useTLS != c.tls {
+			t.Error(c.addr, "got", hostAndPort, useTLS)
+		}
+	}
+}
+
+func TestDialServTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0) // the failed handshakes are expected
+	srv.StartTLS()
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	dir, err := ioutil.TempDir("", "cli_tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644)
+	emptyFile := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(emptyFile, []byte("no cert"), 0644)
+
+	fingerprint := ctrl.CertFingerprint(srv.Certificate().Raw)
+	cases := []struct {
+		name string
+		conf Config
+		ok   bool
+	}{
+		{"system CA", Config{}, false},
+		{"fingerprint", Config{TLSFingerprint: fingerprint}, true},
+		{"fingerprint lower case", Config{TLSFingerprint: " " + strings.ToLower(fingerprint) + " "}, true},
+		{"bad fingerprint", Config{TLSFingerprint: "00:11:22"}, false},
+		{"CA file", Config{TLSCAFile: caFile}, true},
+		{"no cert in CA file", Config{TLSCAFile: emptyFile}, false},
+		{"insecure", Config{TLSInsecure: true}, true},
+	}
+	for _, c := range cases {
+		conn, err := dialServ(addr, true, &c.conf)
+		if (err == nil) != c.ok {
+			t.Error(c.name, "want ok", c.ok, "err", err)
+		}
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+	UDP session: the datagrams of one public peer are carried by one stream,
+	and sent to the target from a UDP socket of this session.
+*/
+
+package cli
+
+import (
+	"ctrl"
+	"libs/log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tunnel"
+)
+
+type udpSession struct {
+	key    string // route/peer
+	stream *tunnel.Stream
+	conn   net.Conn
+	active int64 // atomic, UnixNano of the last datagram
+}
+
+func (u *udpSession) touch() {
+	atomic.StoreInt64(&u.active, time.Now().UnixNano())
+}
+
+func (u *udpSession) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&u.active))
+}
+
+type udpSessionTable struct {
+	rw       *sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// all UDP sessions of the agent, key is route/peer.
+func newUDPSessionTable() *udpSessionTable {
+	return &udpSessionTable{
+		rw:       new(sync.Mutex),
+		sessions: make(map[string]*udpSession),
+	}
+}
+
+func (t *udpSessionTable) put(u *udpSession) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	if old, find := t.sessions[u.key]; find {
+		// the peer come again on a new stream, the old one is stale.
+		old.conn.Close()
+	}
+	t.sessions[u.key] = u
+}
+
+func (t *udpSessionTable) remove(u *udpSession) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	if t.sessions[u.key] == u {
+		delete(t.sessions, u.key)
+	}
+}
+
+// NumUDPSessions count of the UDP peers which are forwarding.
+func (a *Agent) NumUDPSessions() int {
+	a.udp.rw.Lock()
+	defer a.udp.rw.Unlock()
+	return len(a.udp.sessions)
+}
+
+func (a *Agent) udpIdleTimeout() time.Duration {
+	if a.conf.UDPIdleTimeout <= 0 {
+		return tunnel.Default_UDP_Idle_Timeout
+	}
+	return time.Duration(a.conf.UDPIdleTimeout) * time.Second
+}
+
+func (c *Client) forwardUDP(stream *tunnel.Stream, info *ctrl.ConnectInfo, hostAndPort string) {
+	conn, err := net.Dial("udp", hostAndPort)
+	if err != nil {
+		log.Error("[%s] UDP Connect to[%s] err=%s", stream, hostAndPort, err.Error())
+		stream.Reset(err)
+		return
+	}
+	u := &udpSession{key: info.Route + "/" + info.Peer, stream: stream, conn: conn}
+	u.touch()
+	c.agent.udp.put(u)
+	log.Info("new UDP session [%s] to[%s] for stream[%s]", u.key, hostAndPort, stream)
+
+	go u.send()
+	u.recv(c.agent.udpIdleTimeout())
+
+	c.agent.udp.remove(u)
+	conn.Close()
+	stream.Close()
+	log.Info("UDP session [%s] finish.", u.key)
+}
+
+// send the datagrams from the stream to the target.
+func (u *udpSession) send() {
+	defer u.conn.Close()
+
+	buf := make([]byte, tunnel.Max_Datagram_Size)
+	for {
+		n, err := tunnel.ReadDatagram(u.stream, buf)
+		if err != nil {
+			log.Debug("[%s] UDP session[%s] read stream end, err=%v", u.stream, u.key, err)
+			return
+		}
+		u.touch()
+		if _, err := u.conn.Write(buf[:n]); err != nil {
+			log.Warn("[%s] UDP session[%s] write err=%s", u.stream, u.key, err.Error())
+		}
+	}
+}
+
+// recv the datagrams from the target until idle timeout or the conn closed.
+func (u *udpSession) recv(timeout time.Duration) {
+	buf := make([]byte, tunnel.Max_Datagram_Size)
+	for {
+		u.conn.SetReadDeadline(time.Now().Add(timeout - u.idle()))
+		n, err := u.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if u.idle() < timeout {
+					continue
+				}
+				log.Info("UDP session[%s] idle, close it.", u.key)
+			}
+			return
+		}
+		u.touch()
+		if err := tunnel.WriteDatagram(u.stream, buf[:n]); err != nil {
+			log.Debug("[%s] UDP session[%s] write stream err=%v", u.stream, u.key, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"svr"
+	"testing"
+	"time"
+)
+
+func TestUDPSessionTable(t *testing.T) {
+	table := newUDPSessionTable()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	old := &udpSession{key: "dns/1.2.3.4:5353", conn: c1}
+	table.put(old)
+
+	// the same peer on a new stream, the old conn is closed
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	u := &udpSession{key: old.key, conn: c3}
+	table.put(u)
+	if _, err := c1.Write([]byte("x")); err == nil {
+		t.Fatal("the stale session's conn not closed")
+	}
+	// the old one finish later, the new one must be kept
+	table.remove(old)
+	if table.sessions[u.key] != u {
+		t.Fatal("the new session removed by the old one")
+	}
+	table.remove(u)
+	if len(table.sessions) != 0 {
+		t.Fatal("session not removed", table.sessions)
+	}
+}
+
+func listenUDPEcho(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+// TestUDPIdleTimeout the reply of the target go back to the peer, and the idle session expire.
+func TestUDPIdleTimeout(t *testing.T) {
+	target := listenUDPEcho(t)
+	defer target.Close()
+
+	relay, err := svr.NewServer(&svr.Config{WebsocketListen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Shutdown(context.Background())
+	if err := relay.AddRoute(&svr.Route{Name: "dns", Listen: "127.0.0.1:0", Target: target.LocalAddr().String(), Proto: "udp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := NewAgent(&Config{ForwardServ: relay.Addr().String(), UDPIdleTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.Start()
+	defer agent.Shutdown(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for relay.NumTunnels() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("agent not connected")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	peer, err := net.Dial("udp", relay.RouteAddr("dns").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	buf := make([]byte, 2048)
+	for _, msg := range []string{"query-1", "query-2"} {
+		peer.Write([]byte(msg))
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := peer.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatal("want reply", msg, "got", string(buf[:n]), err)
+		}
+	}
+	if n := agent.NumUDPSessions(); n != 1 {
+		t.Fatal("want one session of the peer, got", n)
+	}
+
+	// UDPIdleTimeout is 1 second
+	deadline = time.Now().Add(5 * time.Second)
+	for agent.NumUDPSessions() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle session not expired")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
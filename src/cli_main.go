@@ -2,72 +2,237 @@ package main
 
 import (
 	"cli"
+	"context"
 	"flag"
+	"fmt"
+	"libs/config"
 	"libs/log"
 	"os"
 	"os/signal"
-	"time"
+	"strings"
+	"syscall"
 )
 
 const (
-	MIN_THREAD = 8
+	log_file_max_bytes    = 10 << 20
+	log_file_backup_count = 5
 )
 
 var _ForwardServer string
 var _AuthUserPassword string
-var _ForwardTHread int
+var _MaxStream int
+var _ClientName string
+var _Token string
 
 // read from the host and port in the local-network
 var _LocalNetworkHost string
 
 var _LogLevel string
+var _LogFile string
+
+var _SiteID string
+
+var _TLSCAFile string
+var _TLSFingerprint string
+var _TLSInsecure bool
+
+var _PingInterval int
+var _MaxMissedPongs int
+
+var _MinTunnels int
+var _MaxBackoff int
+var _DrainTimeout int
+
+var _ReverseRoutes reverseFlags
+var _AllowTargets string
+var _PolicyFile string
+
+var _ConfigFile string
+var _Dump bool
+
+// -reverse can be given many times
+type reverseFlags []*cli.ReverseRoute
+
+func (f *reverseFlags) String() string {
+	var s []string
+	for _, r := range *f {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func (f *reverseFlags) Set(value string) error {
+	route, err := cli.ParseReverseRoute(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, route)
+	return nil
+}
 
 func init() {
-	flag.StringVar(&_ForwardServer, "f", "114.114.114.114:8081", "websocket connect to [14.114.114.114:8081] for TCP-data forward.")
+	flag.StringVar(&_ForwardServer, "f", "114.114.114.114:8081", "websocket connect to [14.114.114.114:8081] for TCP-data forward, wss://114.114.114.114:8081 is TLS.")
+	flag.StringVar(&_TLSCAFile, "ca", "", "wss:// only trust the CA or the server's self-signed cert in this pem file.")
+	flag.StringVar(&_TLSFingerprint, "fingerprint", "", "wss:// pin the server cert by SHA-256 fingerprint[AB:CD:...].")
+	flag.BoolVar(&_TLSInsecure, "insecure", false, "wss:// do not verify the server cert, only for testing.")
 	flag.StringVar(&_AuthUserPassword, "auth", "", "websocket connect used auth string[username:passwrod], default is no auth.")
+	flag.StringVar(&_ClientName, "name", "", "credential name of token auth.")
+	flag.StringVar(&_Token, "token", "", "credential token of token auth, got from the server's /api/cred/add.")
 	flag.StringVar(&_LocalNetworkHost, "l", "127.0.0.1:8000", "local-network host which can not listen WLAN-IP.")
 	flag.StringVar(&_LogLevel, "log", "warn", "log level [warn|error|debug|info], output the stdout.")
-	flag.IntVar(&_ForwardTHread, "n", MIN_THREAD, "conut of the thread which read for local-host to the forward-server, min is 8.")
+	flag.StringVar(&_LogFile, "logfile", "", "log to the rotating file instead of stdout.")
+	flag.StringVar(&_SiteID, "id", "", "site ID registered to the server, the server forward the routes of this site to here.")
+	flag.IntVar(&_MaxStream, "n", cli.Default_Max_Stream, "max count of the connections forwarded over one websocket.")
+	flag.IntVar(&_PingInterval, "ping", 30, "seconds between heartbeat pings of the websocket.")
+	flag.IntVar(&_MaxMissedPongs, "missed", 3, "close the websocket after these pings not answered.")
+	flag.IntVar(&_MinTunnels, "tunnels", cli.Default_Min_Tunnels, "count of the websocket kept connected, the idle ones are ready for the burst.")
+	flag.IntVar(&_MaxBackoff, "backoff", cli.Default_Max_Backoff, "max seconds to wait before reconnect, the wait doubles from 1 second.")
+	flag.IntVar(&_DrainTimeout, "drain", cli.Default_Drain_Timeout, "seconds to wait the forwarding connections finish when SIGINT/SIGTERM.")
+	flag.Var(&_ReverseRoutes, "reverse", "reverse route[name,listen,target], listen in the local network and the server connect the target, e.g. backup,0.0.0.0:873,10.0.0.5:873")
+	flag.StringVar(&_AllowTargets, "allow", "", "targets[CIDR|IP|hostname][:port],... the SOCKS5/HTTP CONNECT clients on the server can connect, default is none.")
+	flag.StringVar(&_PolicyFile, "policy", "", "policy file[.json|.toml] of the allowed targets, the server can not use other targets by routes or /api/set.")
+	flag.StringVar(&_ConfigFile, "config", "", "config file[.json|.toml], the flags given in command line override it.")
+	flag.BoolVar(&_Dump, "dump", false, "print the effective config and exit.")
 }
 
-var stop bool
-
-func onSignal() {
+func onSignal(agent *cli.Agent) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	// Block until a signal is received.
-	<-c
-	stop = true
+	sig := <-c
+	log.Warn("recv signal[%s], shutdown.", sig)
+	// DrainTimeout bound the wait
+	if err := agent.Shutdown(context.Background()); err != nil {
+		log.Error("shutdown err=%s", err.Error())
+	}
 }
 
-func main() {
-	flag.Parse()
-	log.Info("start app, Read From[%s], forward data To[%s], auth[%s] log-level[%s].",
-		_LocalNetworkHost, _ForwardServer, _AuthUserPassword, _LogLevel)
-
-	log.SetLevelByName(_LogLevel)
-
-	if _ForwardTHread < MIN_THREAD {
-		_ForwardTHread = MIN_THREAD
+// splitList "a, b" -> [a b], empty string is nil.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
 	}
+	return list
+}
 
+// loadConfig: flag default < config file < flag in command line
+func loadConfig() (*cli.Config, error) {
 	conf := &cli.Config{
+		ForwardServ:   _ForwardServer,
 		LocalHostServ: _LocalNetworkHost,
 		WebsocketAuth: _AuthUserPassword,
-		MaxThread:     _ForwardTHread,
+		ClientName:    _ClientName,
+		Token:         _Token,
+		MaxStream:     _MaxStream,
+		SiteID:        _SiteID,
+		LogLevel:      _LogLevel,
+		LogFile:       _LogFile,
+
+		TLSCAFile:      _TLSCAFile,
+		TLSFingerprint: _TLSFingerprint,
+		TLSInsecure:    _TLSInsecure,
+
+		PingInterval:   _PingInterval,
+		MaxMissedPongs: _MaxMissedPongs,
+
+		MinTunnels:   _MinTunnels,
+		MaxBackoff:   _MaxBackoff,
+		DrainTimeout: _DrainTimeout,
+
+		ReverseRoutes: _ReverseRoutes,
+		AllowTargets:  splitList(_AllowTargets),
+		PolicyFile:    _PolicyFile,
+	}
+	if _ConfigFile == "" {
+		return conf, nil
+	}
+
+	if err := config.Load(_ConfigFile, conf); err != nil {
+		return nil, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ping":
+			conf.PingInterval = _PingInterval
+		case "missed":
+			conf.MaxMissedPongs = _MaxMissedPongs
+		case "tunnels":
+			conf.MinTunnels = _MinTunnels
+		case "backoff":
+			conf.MaxBackoff = _MaxBackoff
+		case "drain":
+			conf.DrainTimeout = _DrainTimeout
+		case "reverse":
+			conf.ReverseRoutes = _ReverseRoutes
+		case "allow":
+			conf.AllowTargets = splitList(_AllowTargets)
+		case "policy":
+			conf.PolicyFile = _PolicyFile
+		case "f":
+			conf.ForwardServ = _ForwardServer
+		case "auth":
+			conf.WebsocketAuth = _AuthUserPassword
+		case "name":
+			conf.ClientName = _ClientName
+		case "token":
+			conf.Token = _Token
+		case "l":
+			conf.LocalHostServ = _LocalNetworkHost
+		case "log":
+			conf.LogLevel = _LogLevel
+		case "logfile":
+			conf.LogFile = _LogFile
+		case "id":
+			conf.SiteID = _SiteID
+		case "n":
+			conf.MaxStream = _MaxStream
+		case "ca":
+			conf.TLSCAFile = _TLSCAFile
+		case "fingerprint":
+			conf.TLSFingerprint = _TLSFingerprint
+		case "insecure":
+			conf.TLSInsecure = _TLSInsecure
+		}
+	})
+	return conf, nil
+}
+
+func main() {
+	flag.Parse()
+
+	conf, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
 	}
-	const (
-		default_sleep_time = 10 * time.Second
-	)
-	for {
-		cli.Connect2Serv(_ForwardServer, conf)
-		if stop {
-			break
-		} else {
-			log.Info("Connect2Serv fail, wait[%s]Second.", default_sleep_time)
-			time.Sleep(default_sleep_time)
+	if _Dump {
+		fmt.Println(config.Dump(conf, "WebsocketAuth", "Token"))
+		return
+	}
+
+	if conf.LogFile != "" {
+		h, err := log.NewRotatingFileHandler(conf.LogFile, log_file_max_bytes, log_file_backup_count)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
 		}
+		log.SetDefault(log.NewDefault(h))
+	}
+	log.SetLevelByName(conf.LogLevel)
+
+	log.Info("start app, site[%s] Read From[%s], forward data To[%s], auth[%v] token[%v] log-level[%s].",
+		conf.SiteID, conf.LocalHostServ, conf.ForwardServ, conf.WebsocketAuth != "", conf.Token != "", conf.LogLevel)
+
+	agent, err := cli.NewAgent(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
 	}
+	go onSignal(agent)
+	agent.Run()
 	log.Info("------------------- main end ------------------------")
 }
@@ -1,29 +1,55 @@
 package ctrl
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"libs/log"
+	"strings"
 )
 
 const (
 	WEBSOCKET_CONNECT_URI = "/_ws4client"
+	// 客户端在 websocket 握手时用此 header 注册所属的 site(家庭)
+	WEBSOCKET_SITE_HEADER = "X-Tunnel-Site"
+	DEFAULT_SITE          = "default"
+
+	PROTO_TCP = "tcp"
+	PROTO_UDP = "udp"
 )
 
 const (
 	Msg_Sys            = 0x00001000
-	Msg_Sys_Ok         = 0x00001000 // 4096
+	Msg_Sys_Ok         = 0x00001000 // 4096, client -> server, the target of the proxy stream Index was connected
 	Msg_Sys_Err        = 0x00001001
 	Msg_New_Connection = 0x00001002
 	Msg_Request_Finish = 0x00001003
 	Msg_Client_Busy    = 0x00001004
 	Msg_Get_Config     = 0x00001005
 	Msg_Set_Config     = 0x00001006
+	Msg_Auth_Challenge = 0x00001007 // server -> client, Content is the nonce
+	Msg_Auth_Response  = 0x00001008 // client -> server, Content is AuthResponse
+	Msg_Client_Drain   = 0x00001009 // client -> server, shutting down, no new connection
+	Msg_Window_Update  = 0x0000100A // both, Content is the bytes the stream Index can send more
+	Msg_Close_Write    = 0x0000100B // both, half-close: no more data of the stream Index, Msg_Request_Finish is full close
+)
+
+// websocket close codes of the tunnel, RFC6455 reserves 4000-4999 for the applications.
+const (
+	Close_Auth_Revoked    = 4001 // the credential was revoked or is invalid, the client stop reconnecting
+	Close_Server_Shutdown = 4002 // the server is stopping, the client reconnect later
+	Close_Protocol_Error  = 4003 // the control frame can not be understood
+	Close_Kicked          = 4004 // the admin closed the tunnel, the client reconnect later
 )
 
 //使用 websocket Text-Frame作为控制流。每Frame都是JSON格式
 // 形如 {"type":<int>,"index":<int>,"c":"string-content"}
+// 一条 websocket 上复用多个转发连接(stream), Binary-Frame 前4字节为 stream ID
 type WebSocketControlFrame struct {
-	Type  int64 `json:"type"`
+	Type int64 `json:"type"`
+	// stream ID of New-Conn/Req-finish/Err/Cli-Busy, 0 is not belong to any stream
 	Index int64 `json:"index"`
 	// Content可转成javascript对像的JSON串, 会因type不同而转出来的结构不同
 	Content string `json:"c"`
@@ -36,13 +62,69 @@ func (ctrl *WebSocketControlFrame) String() string {
 func (ctrl *WebSocketControlFrame) Bytes() []byte {
 	bytes, err := json.Marshal(ctrl)
 	if err != nil {
+		log.Error("JSON format err=%s", err.Error())
 		panic(err.Error())
-		log.Error("JSON format err=", err.Error())
-		return []byte("")
 	}
 	return bytes
 }
 
+// CertFingerprint SHA-256 of the DER certificate, format as AB:CD:...,
+// the server log it at start and the client pin it by TLSFingerprint.
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// Msg_Auth_Response 的 Content, token 本身不在网络上传输
+type AuthResponse struct {
+	Name string `json:"name"` // credential name
+	MAC  string `json:"mac"`  // AuthMAC(token, nonce)
+}
+
+// AuthMAC hex of HMAC-SHA256(token, nonce)
+func AuthMAC(token, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Msg_New_Connection 的 Content, 告诉客户端新连接属于哪条路由
+type ConnectInfo struct {
+	Route  string `json:"route"`
+	Target string `json:"target"`          // host:port in the client's local network, empty is the client's LocalHostServ
+	Proto  string `json:"proto,omitempty"` // PROTO_TCP or PROTO_UDP, empty is PROTO_TCP
+	Peer   string `json:"peer,omitempty"`  // the public peer of the UDP session
+	// direction flag, false: server -> client, the client dial the Target in its local network.
+	// true: client -> server, the client listen a LAN port and the server dial the Target.
+	Reverse bool `json:"reverse,omitempty"`
+	// the Target is asked by a SOCKS5/HTTP CONNECT client, the client must check it by its allowlist.
+	Proxy bool `json:"proxy,omitempty"`
+}
+
+func (info *ConnectInfo) String() string {
+	bytes, err := json.Marshal(info)
+	if err != nil {
+		panic(err.Error())
+	}
+	return string(bytes)
+}
+
+// ParseConnectInfo parse Content of Msg_New_Connection, empty content is the default route.
+func ParseConnectInfo(content string) (*ConnectInfo, error) {
+	info := &ConnectInfo{}
+	if content == "" {
+		return info, nil
+	}
+	if err := json.Unmarshal([]byte(content), info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
 var RquestFinishFrame []byte
 var ClientBusyFrame []byte
 var NewConnecttion []byte
@@ -75,6 +157,11 @@ func init() {
 	msgString[Msg_Client_Busy] = "Cli-Busy"
 	msgString[Msg_Get_Config] = "Get-Conf"
 	msgString[Msg_Set_Config] = "Set-Conf"
+	msgString[Msg_Auth_Challenge] = "Auth-Challenge"
+	msgString[Msg_Auth_Response] = "Auth-Response"
+	msgString[Msg_Client_Drain] = "Cli-Drain"
+	msgString[Msg_Window_Update] = "Window-Update"
+	msgString[Msg_Close_Write] = "Close-Write"
 }
 
 func (this *WebSocketControlFrame) TypeStr() string {
@@ -0,0 +1,545 @@
+package e2e
+
+import (
+	"bytes"
+	"cli"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"ctrl"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"libs/log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"svr"
+	"sync"
+	"testing"
+	"time"
+)
+
+const tunnel_timeout = 10 * time.Second
+
+func TestMain(m *testing.M) {
+	log.SetLevelByName("error")
+	os.Exit(m.Run())
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// roundTrip send payload to addr, close the write and read the reply until EOF.
+func roundTrip(addr string, payload []byte) ([]byte, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	werr := make(chan error, 1)
+	go func() {
+		_, err := c.Write(payload)
+		c.(*net.TCPConn).CloseWrite()
+		werr <- err
+	}()
+	reply, err := ioutil.ReadAll(c)
+	if err != nil {
+		return nil, err
+	}
+	return reply, <-werr
+}
+
+func startRelay(t *testing.T, conf *svr.Config) *svr.Server {
+	relay, err := StartRelay(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		relay.Shutdown(ctx)
+	})
+	return relay
+}
+
+func startAgents(t *testing.T, relay *svr.Server, n int, conf cli.Config) []*cli.Agent {
+	agents, err := StartAgents(relay, n, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { StopAgents(agents) })
+
+	tunnels := conf.MinTunnels
+	if tunnels <= 0 {
+		tunnels = cli.Default_Min_Tunnels
+	}
+	if err := WaitTunnels(relay, n*tunnels, tunnel_timeout); err != nil {
+		t.Fatal(err)
+	}
+	return agents
+}
+
+func startService(t *testing.T, listen func() (*Service, error)) *Service {
+	s, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestLargePayload(t *testing.T) {
+	echo := startService(t, ListenEcho)
+	relay := startRelay(t, &svr.Config{})
+	startAgents(t, relay, 1, cli.Config{LocalHostServ: echo.Addr()})
+
+	payload := randomBytes(8 << 20)
+	reply, err := roundTrip(RouteAddr(relay, svr.Default_Route_Name), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, reply) {
+		t.Fatal("echo not match, sent", len(payload), "got", len(reply))
+	}
+}
+
+func TestHTTPService(t *testing.T) {
+	blob := randomBytes(4 << 20)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blob", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blob)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		h := sha256.New()
+		io.Copy(h, r.Body)
+		io.WriteString(w, hex.EncodeToString(h.Sum(nil)))
+	})
+	web := startService(t, func() (*Service, error) { return ListenHTTP(mux) })
+	relay := startRelay(t, &svr.Config{})
+	startAgents(t, relay, 1, cli.Config{LocalHostServ: web.Addr()})
+	base := "http://" + RouteAddr(relay, svr.Default_Route_Name)
+	// an idle keep-alive connection would hold its stream until the drain timeout
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	resp, err := client.Get(base + "/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(body, blob) {
+		t.Fatal("download not match, got", len(body), err)
+	}
+
+	upload := randomBytes(3 << 20)
+	resp, err = client.Post(base+"/upload", "application/octet-stream", bytes.NewReader(upload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	sum := sha256.Sum256(upload)
+	if string(body) != hex.EncodeToString(sum[:]) {
+		t.Fatal("upload not match", string(body))
+	}
+}
+
+func TestConcurrentConnections(t *testing.T) {
+	echo := startService(t, ListenEcho)
+	relay := startRelay(t, &svr.Config{})
+	startAgents(t, relay, 3, cli.Config{LocalHostServ: echo.Addr(), MinTunnels: 2})
+	addr := RouteAddr(relay, svr.Default_Route_Name)
+
+	const count = 50
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload := randomBytes(256 << 10)
+			reply, err := roundTrip(addr, payload)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(payload, reply) {
+				t.Error("echo not match, sent", len(payload), "got", len(reply))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := echo.Conns(); n != count {
+		t.Fatal("want", count, "connections at the LAN service, got", n)
+	}
+}
+
+// TestSlowReader a slow target must not stall the other streams of the same websocket.
+func TestSlowReader(t *testing.T) {
+	slow := startService(t, func() (*Service, error) { return ListenSlowReader(512 << 10) })
+	echo := startService(t, ListenEcho)
+	relay := startRelay(t, &svr.Config{
+		Routes: []*svr.Route{{Name: "echo", Listen: loopback, Target: echo.Addr()}},
+	})
+	startAgents(t, relay, 1, cli.Config{LocalHostServ: slow.Addr()})
+
+	slowPayload := randomBytes(1 << 20)
+	slowDone := make(chan time.Time, 1)
+	go func() {
+		reply, err := roundTrip(RouteAddr(relay, svr.Default_Route_Name), slowPayload)
+		if err != nil {
+			t.Error(err)
+		} else if string(reply) != Digest(slowPayload) {
+			t.Error("slow reader got", string(reply), "want", Digest(slowPayload))
+		}
+		slowDone <- time.Now()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	payload := randomBytes(1 << 20)
+	reply, err := roundTrip(RouteAddr(relay, "echo"), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoDone := time.Now()
+	if !bytes.Equal(payload, reply) {
+		t.Fatal("echo not match, sent", len(payload), "got", len(reply))
+	}
+
+	select {
+	case <-time.After(tunnel_timeout):
+		t.Fatal("slow reader not finished")
+	case done := <-slowDone:
+		if !echoDone.Before(done) {
+			t.Fatal("echo stream was blocked by the slow reader")
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	echo := startService(t, ListenEcho)
+	relay, err := StartRelay(&svr.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agents := startAgents(t, relay, 1, cli.Config{LocalHostServ: echo.Addr()})
+
+	payload := randomBytes(1 << 20)
+	if reply, err := roundTrip(RouteAddr(relay, svr.Default_Route_Name), payload); err != nil || !bytes.Equal(payload, reply) {
+		t.Fatal("echo before restart fail", len(reply), err)
+	}
+
+	// restart the relay at the same address, the agent must come back.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := relay.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	relay = startRelay(t, &svr.Config{WebsocketListen: relay.Addr().String()})
+	if err := WaitTunnels(relay, 1, tunnel_timeout); err != nil {
+		t.Fatal(err)
+	}
+	if n := agents[0].NumTunnels(); n != 1 {
+		t.Fatal("agent want 1 tunnel, got", n)
+	}
+
+	if reply, err := roundTrip(RouteAddr(relay, svr.Default_Route_Name), payload); err != nil || !bytes.Equal(payload, reply) {
+		t.Fatal("echo after reconnect fail", len(reply), err)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	named := func(name string) *Service {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		})
+		return startService(t, func() (*Service, error) { return ListenHTTP(handler) })
+	}
+	a, b := named("A"), named("B")
+	relay := startRelay(t, &svr.Config{})
+	agents := startAgents(t, relay, 2, cli.Config{LocalHostServ: a.Addr()})
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	reply := func(resp *http.Response, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	get := func(addr string) string { return reply(client.Get(addr)) }
+	route := "http://" + RouteAddr(relay, svr.Default_Route_Name) + "/"
+	if got := get(route); got != "A" {
+		t.Fatal("want A, got", got)
+	}
+
+	set := url.Values{"site": {"default"}, "svr": {b.Addr()}}
+	if got := reply(client.PostForm(APIURL(relay, "set"), set)); got != "Set site[default] ["+b.Addr()+"] OK" {
+		t.Fatal("bad /api/set reply", got)
+	}
+	deadline := time.Now().Add(tunnel_timeout)
+	for _, agent := range agents {
+		for agent.LocalHostServ() != b.Addr() {
+			if time.Now().After(deadline) {
+				t.Fatal("config not pushed to the agent", agent.LocalHostServ())
+			}
+			time.Sleep(poll_interval)
+		}
+	}
+
+	// every tunnel of the site forward to the new server
+	for i := 0; i < 10; i++ {
+		if got := get(route); got != "B" {
+			t.Fatal("want B, got", got)
+		}
+	}
+	if a.Conns() != 1 {
+		t.Fatal("old server want 1 connection, got", a.Conns())
+	}
+}
+
+func apiJSON(t *testing.T, method, url string, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != "GET" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// TestKick the sessions and the tunnels listed by /api/v1/ are kicked, the agent come back.
+func TestKick(t *testing.T) {
+	echo := startService(t, ListenEcho)
+	relay := startRelay(t, &svr.Config{})
+	startAgents(t, relay, 1, cli.Config{LocalHostServ: echo.Addr()})
+
+	c, err := net.Dial("tcp", RouteAddr(relay, svr.Default_Route_Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	payload := randomBytes(64 << 10)
+	c.Write(payload)
+	if _, err := io.ReadFull(c, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+
+	var sessions []struct {
+		Tunnel            uint64
+		Stream            uint32
+		Route, Peer       string
+		BytesIn, BytesOut int64
+	}
+	apiJSON(t, "GET", APIURL(relay, "v1/sessions"), &sessions)
+	if len(sessions) != 1 || sessions[0].Route != svr.Default_Route_Name || sessions[0].Peer != c.LocalAddr().String() {
+		t.Fatal("bad sessions", sessions)
+	}
+	if s := sessions[0]; s.BytesIn != int64(len(payload)) || s.BytesOut != int64(len(payload)) {
+		t.Fatal("bad session bytes", s.BytesIn, s.BytesOut)
+	}
+
+	kick := fmt.Sprintf("v1/sessions/%d/%d", sessions[0].Tunnel, sessions[0].Stream)
+	if code := apiJSON(t, "DELETE", APIURL(relay, kick), nil); code != http.StatusOK {
+		t.Fatal("kick session", code)
+	}
+	c.SetReadDeadline(time.Now().Add(tunnel_timeout))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the kicked connection is still open")
+	}
+	if code := apiJSON(t, "DELETE", APIURL(relay, kick), nil); code != http.StatusNotFound {
+		t.Fatal("kick session twice want 404, got", code)
+	}
+
+	var tunnels []struct {
+		ID       uint64
+		BytesIn  int64
+		BytesOut int64
+	}
+	apiJSON(t, "GET", APIURL(relay, "v1/tunnels"), &tunnels)
+	if len(tunnels) != 1 || tunnels[0].BytesIn < int64(len(payload)) {
+		t.Fatal("bad tunnels", tunnels)
+	}
+	if code := apiJSON(t, "DELETE", APIURL(relay, fmt.Sprintf("v1/tunnels/%d", tunnels[0].ID)), nil); code != http.StatusOK {
+		t.Fatal("kick tunnel", code)
+	}
+	kicked := tunnels[0].ID
+	deadline := time.Now().Add(tunnel_timeout)
+	for len(tunnels) != 1 || tunnels[0].ID == kicked {
+		if time.Now().After(deadline) {
+			t.Fatal("the agent not reconnected", tunnels)
+		}
+		time.Sleep(poll_interval)
+		apiJSON(t, "GET", APIURL(relay, "v1/tunnels"), &tunnels)
+	}
+}
+
+// socks5Connect do the no-auth SOCKS5 handshake and return the REP of the CONNECT.
+func socks5Connect(c net.Conn, target string) (byte, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return 0, err
+	}
+	var p int
+	fmt.Sscanf(port, "%d", &p)
+	req := []byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}
+	req = append(append(req, host...), byte(p>>8), byte(p))
+	if _, err := c.Write(req); err != nil {
+		return 0, err
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return 0, err
+	}
+	return reply[3], nil
+}
+
+// TestProxy the proxy client get the result of the client's dial, not a closed connection.
+func TestProxy(t *testing.T) {
+	echo := startService(t, ListenEcho)
+	relay := startRelay(t, &svr.Config{
+		Routes: []*svr.Route{{Name: "px", Listen: "proxy://" + loopback}},
+	})
+	startAgents(t, relay, 1, cli.Config{LocalHostServ: echo.Addr(), AllowTargets: []string{"127.0.0.1"}})
+	addr := RouteAddr(relay, "px")
+
+	cases := []struct {
+		target string
+		rep    byte
+	}{
+		{echo.Addr(), 0x00},
+		{"127.0.0.1:1", 0x05},  // refused by the LAN
+		{"192.0.2.1:80", 0x05}, // not in the allowlist
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := socks5Connect(conn, c.target)
+		if err != nil || rep != c.rep {
+			conn.Close()
+			t.Fatal("socks5", c.target, "want", c.rep, "got", rep, err)
+		}
+		if rep == 0x00 {
+			conn.Write([]byte("ping"))
+			reply := make([]byte, 4)
+			if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+				t.Fatal("echo by socks5", string(reply), err)
+			}
+		}
+		conn.Close()
+	}
+
+	for target, status := range map[string]string{echo.Addr(): "200", "127.0.0.1:1": "502"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		line := make([]byte, len("HTTP/1.1 200"))
+		if _, err := io.ReadFull(conn, line); err != nil || !bytes.HasSuffix(line, []byte(status)) {
+			t.Fatal("CONNECT", target, "want", status, "got", string(line), err)
+		}
+		conn.Close()
+	}
+}
+
+// TestTLSToken the agents connect by wss:// with a pinned self-signed cert and token auth.
+func TestTLSToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	echo := startService(t, ListenEcho)
+	relay := startRelay(t, &svr.Config{
+		TLS:            true,
+		TLSCertFile:    filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:     filepath.Join(dir, "key.pem"),
+		CredentialFile: filepath.Join(dir, "creds.json"),
+	})
+	cred, err := relay.AddCredential("home1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("no cert generated")
+	}
+
+	conf := cli.Config{
+		ForwardServ:    "wss://" + relay.Addr().String(),
+		TLSFingerprint: ctrl.CertFingerprint(block.Bytes),
+		ClientName:     cred.Name,
+		Token:          cred.Token,
+		LocalHostServ:  echo.Addr(),
+	}
+	startAgents(t, relay, 1, conf)
+
+	payload := randomBytes(256 * 1024)
+	reply, err := roundTrip(RouteAddr(relay, svr.Default_Route_Name), payload)
+	if err != nil || !bytes.Equal(reply, payload) {
+		t.Fatal("bad reply by wss, len", len(reply), err)
+	}
+
+	// a wrong token is rejected and the agent stop reconnecting
+	bad := conf
+	bad.Token = "bad-token"
+	agents, err := StartAgents(relay, 1, bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		agents[0].Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(tunnel_timeout):
+		StopAgents(agents)
+		t.Fatal("agent of a wrong token still reconnecting")
+	}
+
+	// a wrong fingerprint never get a tunnel
+	bad = conf
+	bad.TLSFingerprint = strings.Repeat("00", 32)
+	agents, err = StartAgents(relay, 1, bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer StopAgents(agents)
+	time.Sleep(500 * time.Millisecond)
+	if n := relay.NumTunnels(); n != 1 {
+		t.Fatal("want only the good agent online, got tunnels", n)
+	}
+}
@@ -0,0 +1,227 @@
+/*
+	in-process harness of the end-to-end tests: a relay(svr.Server), the clients(cli.Agent)
+	and the fake LAN services, all listen on loopback random ports.
+*/
+
+package e2e
+
+import (
+	"cli"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"svr"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	loopback = "127.0.0.1:0"
+
+	poll_interval = 20 * time.Millisecond
+)
+
+// StartRelay start a relay, the websocket and the default route listen random ports if not set.
+func StartRelay(conf *svr.Config) (*svr.Server, error) {
+	if conf.WebsocketListen == "" {
+		conf.WebsocketListen = loopback
+	}
+	if conf.ForwardListen == "" {
+		conf.ForwardListen = loopback
+	}
+	s, err := svr.NewServer(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RouteAddr return the public ip:port of the route, empty if not found.
+func RouteAddr(s *svr.Server, name string) string {
+	if addr := s.RouteAddr(name); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// APIURL return http://ip:port/api/<api> of the relay.
+func APIURL(s *svr.Server, api string) string {
+	return "http://" + s.Addr().String() + "/api/" + api
+}
+
+// StartAgents start n agents which connect to the relay, every one by its own copy of conf.
+// empty conf.ForwardServ is the relay's ip:port, set it to wss://ip:port for a TLS relay.
+func StartAgents(s *svr.Server, n int, conf cli.Config) ([]*cli.Agent, error) {
+	var agents []*cli.Agent
+	for i := 0; i < n; i++ {
+		c := conf
+		if c.ForwardServ == "" {
+			c.ForwardServ = s.Addr().String()
+		}
+		agent, err := cli.NewAgent(&c)
+		if err != nil {
+			StopAgents(agents)
+			return nil, err
+		}
+		agent.Start()
+		agents = append(agents, agent)
+	}
+	return agents, nil
+}
+
+// StopAgents shutdown the agents in parallel.
+func StopAgents(agents []*cli.Agent) {
+	var wg sync.WaitGroup
+	for _, agent := range agents {
+		wg.Add(1)
+		go func(agent *cli.Agent) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			agent.Shutdown(ctx)
+		}(agent)
+	}
+	wg.Wait()
+}
+
+// WaitTunnels wait until the relay has n online websocket.
+func WaitTunnels(s *svr.Server, n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for s.NumTunnels() != n {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("want [%d] tunnels online, got [%d] after[%s]", n, s.NumTunnels(), timeout)
+		}
+		time.Sleep(poll_interval)
+	}
+	return nil
+}
+
+// Service a fake server in the LAN, every connection is served by handle.
+type Service struct {
+	l     net.Listener
+	http  *http.Server // nil if not ListenHTTP
+	wg    sync.WaitGroup
+	conns int64 // atomic, count of the accepted connections
+}
+
+func listenService(handle func(net.Conn)) (*Service, error) {
+	l, err := net.Listen("tcp", loopback)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{l: l}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&s.conns, 1)
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+	return s, nil
+}
+
+func (s *Service) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Conns count of the connections accepted.
+func (s *Service) Conns() int {
+	return int(atomic.LoadInt64(&s.conns))
+}
+
+// Close stop listen, the connections are not waited.
+func (s *Service) Close() error {
+	if s.http != nil {
+		return s.http.Close()
+	}
+	return s.l.Close()
+}
+
+// ListenEcho write back all it read, close the write after read EOF.
+func ListenEcho() (*Service, error) {
+	return listenService(func(c net.Conn) {
+		io.Copy(c, c)
+		closeWrite(c)
+	})
+}
+
+// ListenHTTP serve handler by net/http.
+func ListenHTTP(handler http.Handler) (*Service, error) {
+	l, err := net.Listen("tcp", loopback)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{l: l}
+	s.http = &http.Server{
+		Handler: handler,
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt64(&s.conns, 1)
+			}
+		},
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.http.Serve(l)
+	}()
+	return s, nil
+}
+
+// ListenSlowReader read at most rate bytes per second, after read EOF
+// it reply "<bytes> <sha256 hex>" of what it read.
+func ListenSlowReader(rate int) (*Service, error) {
+	return listenService(func(c net.Conn) {
+		const ticks = 10
+		h := sha256.New()
+		chunk := rate / ticks
+		if chunk <= 0 {
+			chunk = 1
+		}
+		buf := make([]byte, chunk)
+		var total int64
+		for {
+			n, err := c.Read(buf)
+			h.Write(buf[:n])
+			total += int64(n)
+			if err != nil {
+				break
+			}
+			time.Sleep(time.Second / ticks)
+		}
+		fmt.Fprintf(c, "%d %s", total, hex.EncodeToString(h.Sum(nil)))
+		closeWrite(c)
+	})
+}
+
+// Digest is the reply of the slow reader for data.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%d %s", len(data), hex.EncodeToString(sum[:]))
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+	}
+}
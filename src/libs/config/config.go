@@ -0,0 +1,84 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Load read the config file into v, the format is chosen by the extension.
+// .json is decoded by encoding/json, .toml is parsed to a map and then decoded
+// by encoding/json, so v only need the json tags.
+func Load(fileName string, v interface{}) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+	case ".toml":
+		m, err := ParseTOML(data)
+		if err != nil {
+			return fmt.Errorf("%s: %s", fileName, err.Error())
+		}
+		if data, err = json.Marshal(m); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s: unknown config format, only .json and .toml supported", fileName)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %s", fileName, err.Error())
+	}
+	return nil
+}
+
+// Dump format v as indented JSON, the values of the secrets keys are redacted at any depth,
+// "user:password" keep the user.
+func Dump(v interface{}, secrets ...string) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	var m interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err.Error()
+	}
+	keys := make(map[string]bool)
+	for _, key := range secrets {
+		keys[key] = true
+	}
+	m = redact(m, keys, false)
+
+	if data, err = json.MarshalIndent(m, "", "  "); err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+const redacted = "******"
+
+func redact(v interface{}, keys map[string]bool, secret bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = redact(value, keys, secret || keys[key])
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redact(value, keys, secret)
+		}
+	case string:
+		if secret && v != "" {
+			if pos := strings.Index(v, ":"); pos > 0 {
+				return v[:pos+1] + redacted
+			}
+			return redacted
+		}
+	}
+	return v
+}
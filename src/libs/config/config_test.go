@@ -0,0 +1,143 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testRoute struct {
+	Name   string `json:"Name"`
+	Listen string `json:"Listen"`
+}
+
+type testConfig struct {
+	Auth    string       `json:"Auth"`
+	Level   string       `json:"LogLevel"`
+	Max     int          `json:"MaxStream"`
+	Debug   bool         `json:"Debug"`
+	Allow   []string     `json:"Allow"`
+	Routes  []*testRoute `json:"Routes"`
+	Default string       `json:"Default"`
+}
+
+const tomlConfig = `
+# relay config
+Auth = "user:p#ss" # comment after value
+LogLevel = 'info'
+MaxStream = 1_024
+Debug = true
+Allow = ["192.168.1.0/24", "10.0.0.1:22"]
+
+[[Routes]]
+Name = "cam"
+Listen = "0.0.0.0:8080"
+
+[[Routes]]
+Name = "ssh"
+Listen = "0.0.0.0:2222"
+`
+
+func writeFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestLoadTOML(t *testing.T) {
+	fileName := writeFile(t, "svr.toml", tomlConfig)
+	defer os.RemoveAll(filepath.Dir(fileName))
+
+	conf := &testConfig{Default: "keep"}
+	if err := Load(fileName, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Auth != "user:p#ss" || conf.Level != "info" || conf.Max != 1024 || !conf.Debug {
+		t.Fatal("bad scalar values", Dump(conf))
+	}
+	if len(conf.Allow) != 2 || conf.Allow[1] != "10.0.0.1:22" {
+		t.Fatal("bad array", conf.Allow)
+	}
+	if len(conf.Routes) != 2 || conf.Routes[1].Name != "ssh" || conf.Routes[1].Listen != "0.0.0.0:2222" {
+		t.Fatal("bad array of table", Dump(conf.Routes))
+	}
+	if conf.Default != "keep" {
+		t.Fatal("value not in the file must be kept")
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	fileName := writeFile(t, "cli.json", `{"Auth":"a:b","Routes":[{"Name":"cam"}]}`)
+	defer os.RemoveAll(filepath.Dir(fileName))
+
+	conf := &testConfig{}
+	if err := Load(fileName, conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Auth != "a:b" || len(conf.Routes) != 1 {
+		t.Fatal("bad json config", Dump(conf))
+	}
+}
+
+func TestParseTOMLError(t *testing.T) {
+	bad := []string{
+		"key",
+		"key = ",
+		"key = [1, 2",
+		"a = 1\na = 2",
+		"[table",
+		"v = yes",
+		"X = []\n[X]",
+		"X = [\"a\"]\n[X]",
+		"X = 1\n[X]",
+		"[a]\nx = 1\n[b]\n[a]",
+		"[[a]]\n[a.b]\n[a.b]",
+	}
+	for _, s := range bad {
+		if _, err := ParseTOML([]byte(s)); err == nil {
+			t.Error("want error for", s)
+		} else if !strings.HasPrefix(err.Error(), "line ") {
+			t.Error("want the line number, got", err)
+		}
+	}
+
+	// the same sub-table of different array elements, and a table after its sub-table
+	good := []string{
+		"[[a]]\n[a.b]\n[[a]]\n[a.b]",
+		"[x.y]\n[x]",
+	}
+	for _, s := range good {
+		if _, err := ParseTOML([]byte(s)); err != nil {
+			t.Error(s, err)
+		}
+	}
+}
+
+func TestDumpSecrets(t *testing.T) {
+	conf := map[string]interface{}{
+		"Auth":   "admin:secret",
+		"Token":  "0123abcd",
+		"Empty":  "",
+		"Routes": []interface{}{map[string]interface{}{"Name": "web", "Auth": []string{"bob:pass"}}},
+	}
+	s := Dump(conf, "Auth", "Token", "Empty")
+	for _, secret := range []string{"secret", "0123abcd", "pass"} {
+		if strings.Contains(s, secret) {
+			t.Fatal("secret", secret, "in dump", s)
+		}
+	}
+	for _, want := range []string{`"admin:******"`, `"bob:******"`, `"Token": "******"`, `"Empty": ""`, `"web"`} {
+		if !strings.Contains(s, want) {
+			t.Fatal("want", want, "in dump", s)
+		}
+	}
+}
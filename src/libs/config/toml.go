@@ -0,0 +1,228 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseTOML parse the subset of TOML which the config files need:
+// key = value, [table], [[array-of-table]] and # comment.
+// value may be string, integer, float, boolean or a one-line array of them.
+func ParseTOML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	current := root
+	defined := make(map[string]bool) // path of the [table] headers
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(line, "[["):
+			if !strings.HasSuffix(line, "]]") {
+				return nil, fmt.Errorf("line %d: bad array table[%s]", lineNo, line)
+			}
+			current, err = arrayTable(root, strings.TrimSpace(line[2:len(line)-2]))
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: bad table[%s]", lineNo, line)
+			}
+			var path string
+			if current, path, err = table(root, strings.TrimSpace(line[1:len(line)-1])); err == nil {
+				if defined[path] {
+					err = fmt.Errorf("table[%s] defined more than once", path)
+				}
+				defined[path] = true
+			}
+		default:
+			pos := strings.Index(line, "=")
+			if pos <= 0 {
+				return nil, fmt.Errorf("line %d: want key = value, got[%s]", lineNo, line)
+			}
+			key := unquoteKey(strings.TrimSpace(line[:pos]))
+			if _, find := current[key]; find {
+				return nil, fmt.Errorf("line %d: duplicate key[%s]", lineNo, key)
+			}
+			current[key], err = parseValue(strings.TrimSpace(line[pos+1:]))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err.Error())
+		}
+	}
+	return root, scanner.Err()
+}
+
+// stripComment remove the # comment which is not inside a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteKey(key string) string {
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+		return key[1 : len(key)-1]
+	}
+	return key
+}
+
+// table return the table of name, the path tell the element of the array tables,
+// "a[1].b" is [a.b] after the second [[a]].
+func table(root map[string]interface{}, name string) (map[string]interface{}, string, error) {
+	current := root
+	var path []string
+	for _, key := range strings.Split(name, ".") {
+		key = unquoteKey(strings.TrimSpace(key))
+		switch v := current[key].(type) {
+		case nil:
+			m := make(map[string]interface{})
+			current[key] = m
+			current = m
+			path = append(path, key)
+		case map[string]interface{}:
+			current = v
+			path = append(path, key)
+		case []interface{}:
+			// [a.b] after [[a]] is the last element of a
+			if len(v) == 0 {
+				return nil, "", fmt.Errorf("key[%s] is an empty array, not a table", key)
+			}
+			m, ok := v[len(v)-1].(map[string]interface{})
+			if !ok {
+				return nil, "", fmt.Errorf("key[%s] is an array of values, not a table", key)
+			}
+			current = m
+			path = append(path, fmt.Sprintf("%s[%d]", key, len(v)-1))
+		default:
+			return nil, "", fmt.Errorf("key[%s] is not a table", key)
+		}
+	}
+	return current, strings.Join(path, "."), nil
+}
+
+func arrayTable(root map[string]interface{}, name string) (map[string]interface{}, error) {
+	parent := root
+	keys := strings.Split(name, ".")
+	if len(keys) > 1 {
+		var err error
+		parent, _, err = table(root, strings.Join(keys[:len(keys)-1], "."))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key := unquoteKey(strings.TrimSpace(keys[len(keys)-1]))
+	m := make(map[string]interface{})
+	switch v := parent[key].(type) {
+	case nil:
+		parent[key] = []interface{}{m}
+	case []interface{}:
+		parent[key] = append(v, m)
+	default:
+		return nil, fmt.Errorf("key[%s] is not an array of table", key)
+	}
+	return m, nil
+}
+
+func parseValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("empty value")
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("bad literal string[%s]", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s[0] == '[':
+		return parseArray(s)
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	}
+
+	number := strings.Replace(s, "_", "", -1)
+	if i, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unsupported value[%s]", s)
+}
+
+func parseArray(s string) ([]interface{}, error) {
+	if s[len(s)-1] != ']' {
+		return nil, fmt.Errorf("array must be in one line[%s]", s)
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+
+	result := []interface{}{}
+	for s != "" {
+		end := valueEnd(s)
+		v, err := parseValue(strings.TrimSpace(s[:end]))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+
+		s = strings.TrimSpace(s[end:])
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if s != "" {
+			return nil, fmt.Errorf("want ',' in array, got[%s]", s)
+		}
+	}
+	return result, nil
+}
+
+// valueEnd return the end of the first value in the array body s.
+func valueEnd(s string) int {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			return i
+		}
+	}
+	return len(s)
+}
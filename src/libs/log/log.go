@@ -65,6 +65,11 @@ func newStdHandler() *StreamHandler {
 
 var std = NewDefault(newStdHandler())
 
+// SetDefault replace the std logger, call it before any log output.
+func SetDefault(l *Logger) {
+	std = l
+}
+
 func (l *Logger) run() {
 	for {
 		select {
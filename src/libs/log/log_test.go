@@ -50,3 +50,24 @@ func TestRotatingFileLog(t *testing.T) {
 
 	os.RemoveAll(path)
 }
+
+func TestRingHandler(t *testing.T) {
+	h, _ := NewRingHandler(nil, 3)
+	for _, s := range []string{"a", "b", "c", "d"} {
+		h.Write([]byte(s))
+	}
+
+	lines := h.Lines(0)
+	if len(lines) != 3 || lines[0].Seq != 2 || lines[0].Text != "b" || lines[2].Text != "d" {
+		t.Fatal("bad lines", lines)
+	}
+	if lines := h.Lines(3); len(lines) != 1 || lines[0].Seq != 4 {
+		t.Fatal("bad lines after 3", lines)
+	}
+	if lines := h.Lines(4); len(lines) != 0 {
+		t.Fatal("want no new line", lines)
+	}
+	if lines := h.Lines(100); len(lines) != 0 {
+		t.Fatal("want no line after a future seq", lines)
+	}
+}
@@ -0,0 +1,81 @@
+package log
+
+import (
+	"sync"
+)
+
+// RingHandler keep the last lines in memory for the log viewer, and write them to the next handler.
+type RingHandler struct {
+	next Handler // nil is memory only
+
+	mu    sync.Mutex
+	lines []string
+	size  int
+	last  uint64 // Seq of the newest line, the first line is 1
+}
+
+type Line struct {
+	Seq  uint64
+	Text string
+}
+
+func NewRingHandler(next Handler, size int) (*RingHandler, error) {
+	if size <= 0 {
+		size = 1000
+	}
+	h := new(RingHandler)
+
+	h.next = next
+	h.size = size
+	h.lines = make([]string, size)
+
+	return h, nil
+}
+
+func (h *RingHandler) Write(b []byte) (n int, err error) {
+	h.mu.Lock()
+	h.last++
+	h.lines[h.last%uint64(h.size)] = string(b)
+	h.mu.Unlock()
+
+	if h.next == nil {
+		return len(b), nil
+	}
+	return h.next.Write(b)
+}
+
+// Lines return the lines kept which Seq is after seq, the oldest first.
+func (h *RingHandler) Lines(after uint64) []Line {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	first := uint64(1)
+	if h.last > uint64(h.size) {
+		first = h.last - uint64(h.size) + 1
+	}
+	if after+1 > first {
+		first = after + 1
+	}
+	if first > h.last {
+		return nil
+	}
+	lines := make([]Line, 0, h.last+1-first)
+	for seq := first; seq <= h.last; seq++ {
+		lines = append(lines, Line{Seq: seq, Text: h.lines[seq%uint64(h.size)]})
+	}
+	return lines
+}
+
+// Last return Seq of the newest line, 0 is no line yet.
+func (h *RingHandler) Last() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last
+}
+
+func (h *RingHandler) Close() error {
+	if h.next != nil {
+		return h.next.Close()
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// close status codes, RFC6455 7.4.1, 4000-4999 are for the applications.
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005 // never sent, the close frame has no payload
+	CloseAbnormalClosure  = 1006 // never sent, the connection was lost without close frame
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseInternalError    = 1011
+
+	// max time CloseWithCode wait for the peer's close frame.
+	Default_Close_Timeout = 3 * time.Second
+)
+
+// CloseError the code and reason of the close frame.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket close %d: %s", e.Code, e.Text)
+}
+
+// FormatCloseMessage build the close frame payload, the reason is cut to fit a control frame.
+func FormatCloseMessage(code int, reason string) []byte {
+	if code == CloseNoStatusReceived || code == CloseAbnormalClosure {
+		return []byte{}
+	}
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	buf := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(buf, uint16(code))
+	copy(buf[2:], reason)
+	return buf
+}
+
+// ParseCloseMessage parse the payload of a close frame, empty payload is CloseNoStatusReceived.
+func ParseCloseMessage(payload []byte) *CloseError {
+	if len(payload) < 2 {
+		return &CloseError{Code: CloseNoStatusReceived}
+	}
+	return &CloseError{Code: int(binary.BigEndian.Uint16(payload)), Text: string(payload[2:])}
+}
+
+// peerClosed the peer's close frame was read or the read failed, the wait of CloseWithCode ends.
+func (c *Conn) peerClosed(e *CloseError) {
+	c.closeOnce.Do(func() {
+		c.closeErr = e
+		close(c.readDone)
+	})
+}
+
+// CloseError return the close frame received from the peer, nil if not received.
+func (c *Conn) CloseError() *CloseError {
+	select {
+	case <-c.readDone:
+		return c.closeErr
+	default:
+		return nil
+	}
+}
+
+// WriteClose send the close frame once, the later calls do nothing.
+func (c *Conn) WriteClose(code int, reason string) error {
+	err := c.sendFrame(CloseMessage, FormatCloseMessage(code, reason))
+	if err == ErrCloseSent {
+		return nil
+	}
+	return err
+}
+
+// CloseWithCode send the close frame, wait the peer's close frame at most Default_Close_Timeout,
+// then close the socket. The peer's frame is read by the goroutine calling Read,
+// if no one is reading it always wait the timeout.
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	c.SetWriteDeadline(time.Now().Add(Default_Close_Timeout))
+	err := c.WriteClose(code, reason)
+	if err == nil {
+		timer := time.NewTimer(Default_Close_Timeout)
+		select {
+		case <-c.readDone:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	// the read loop may close it too when the reply arrives
+	if cerr := c.conn.Close(); err == nil && !errors.Is(cerr, net.ErrClosed) {
+		err = cerr
+	}
+	return err
+}
+
+// CloseCodeOf the close code to fail the connection by the read error,
+// 0 if the error is not a violation of the peer.
+func CloseCodeOf(err error) int {
+	switch err {
+	case ErrInvalidUTF8:
+		return CloseInvalidPayload
+	case ErrMessageTooBig:
+		return CloseMessageTooBig
+	case ErrRSVNotSupport, ErrControlTooLong, ErrPayloadError, ErrControlFragmented,
+		ErrUnmaskedFrame, ErrMaskedFrame, ErrBadOpcode, ErrBadCloseCode,
+		ErrUnexpectedContinuation, ErrMessageNotFinished:
+		return CloseProtocolError
+	}
+	return 0
+}
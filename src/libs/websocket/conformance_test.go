@@ -0,0 +1,239 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// rawFrame build a frame by hand, so the broken frames can be sent.
+func rawFrame(fin bool, rsv, opcode byte, payload []byte, masked bool) []byte {
+	var b0 byte = rsv<<4 | opcode
+	if fin {
+		b0 |= 0x80
+	}
+	buf := []byte{b0}
+
+	var mask byte
+	if masked {
+		mask = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, mask|byte(n))
+	case n <= 0xFFFF:
+		buf = append(buf, mask|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, mask|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(n))
+	}
+
+	if !masked {
+		return append(buf, payload...)
+	}
+	key := []byte{0x11, 0x22, 0x33, 0x44}
+	buf = append(buf, key...)
+	for i, b := range payload {
+		buf = append(buf, b^key[i%4])
+	}
+	return buf
+}
+
+// frames from the client, masked.
+func cFrame(fin bool, opcode byte, payload string) []byte {
+	return rawFrame(fin, 0, opcode, []byte(payload), true)
+}
+
+func closePayload(code int, reason string) string {
+	return string(FormatCloseMessage(code, reason))
+}
+
+type wantMsg struct {
+	typ  byte
+	data string
+}
+
+var conformanceCases = []struct {
+	name   string
+	client bool // the reader is the client, the frames are from the server
+	frames [][]byte
+	want   []wantMsg
+	err    error // the Read after the wanted messages
+}{
+	{name: "text", frames: [][]byte{cFrame(true, TextMessage, "hello")},
+		want: []wantMsg{{TextMessage, "hello"}}},
+	{name: "empty binary", frames: [][]byte{cFrame(true, BinaryMessage, "")},
+		want: []wantMsg{{BinaryMessage, ""}}},
+	{name: "16-bit length", frames: [][]byte{cFrame(true, BinaryMessage, strings.Repeat("a", 300))},
+		want: []wantMsg{{BinaryMessage, strings.Repeat("a", 300)}}},
+	{name: "64-bit length", frames: [][]byte{cFrame(true, BinaryMessage, strings.Repeat("b", 70000))},
+		want: []wantMsg{{BinaryMessage, strings.Repeat("b", 70000)}}},
+	{name: "64-bit length MSB set", frames: [][]byte{{0x82, 0x80 | 127, 0x80, 0, 0, 0, 0, 0, 0, 1}},
+		err: ErrPayloadError},
+
+	// masking
+	{name: "unmasked from client", frames: [][]byte{rawFrame(true, 0, TextMessage, []byte("x"), false)},
+		err: ErrUnmaskedFrame},
+	{name: "unmasked from server", client: true, frames: [][]byte{rawFrame(true, 0, TextMessage, []byte("x"), false)},
+		want: []wantMsg{{TextMessage, "x"}}},
+	{name: "masked from server", client: true, frames: [][]byte{cFrame(true, TextMessage, "x")},
+		err: ErrMaskedFrame},
+
+	// header
+	{name: "rsv bit", frames: [][]byte{rawFrame(true, 4, TextMessage, []byte("x"), true)},
+		err: ErrRSVNotSupport},
+	{name: "reserved data opcode", frames: [][]byte{cFrame(true, 3, "")}, err: ErrBadOpcode},
+	{name: "reserved control opcode", frames: [][]byte{cFrame(true, 0x0B, "")}, err: ErrBadOpcode},
+
+	// control frames
+	{name: "ping", frames: [][]byte{cFrame(true, PingMessage, "p")},
+		want: []wantMsg{{PingMessage, "p"}}},
+	{name: "fragmented ping", frames: [][]byte{cFrame(false, PingMessage, "p")},
+		err: ErrControlFragmented},
+	{name: "ping 126 bytes", frames: [][]byte{cFrame(true, PingMessage, strings.Repeat("p", 126))},
+		err: ErrControlTooLong},
+	{name: "close empty", frames: [][]byte{cFrame(true, CloseMessage, "")},
+		want: []wantMsg{{CloseMessage, ""}}},
+	{name: "close with reason", frames: [][]byte{cFrame(true, CloseMessage, closePayload(CloseGoingAway, "bye"))},
+		want: []wantMsg{{CloseMessage, closePayload(CloseGoingAway, "bye")}}},
+	{name: "close 1 byte", frames: [][]byte{cFrame(true, CloseMessage, "\x03")}, err: ErrPayloadError},
+	{name: "close code 1005", frames: [][]byte{cFrame(true, CloseMessage, "\x03\xed")}, err: ErrBadCloseCode},
+	{name: "close code 999", frames: [][]byte{cFrame(true, CloseMessage, "\x03\xe7")}, err: ErrBadCloseCode},
+	{name: "close code 5000", frames: [][]byte{cFrame(true, CloseMessage, "\x13\x88")}, err: ErrBadCloseCode},
+	{name: "close reason not UTF-8", frames: [][]byte{cFrame(true, CloseMessage, "\x03\xe8\xff")}, err: ErrInvalidUTF8},
+
+	// fragmentation
+	{name: "fragmented text", frames: [][]byte{
+		cFrame(false, TextMessage, "frag"), cFrame(false, 0, "men"), cFrame(true, 0, "ted")},
+		want: []wantMsg{{TextMessage, "fragmented"}}},
+	{name: "ping between fragments", frames: [][]byte{
+		cFrame(false, BinaryMessage, "ab"), cFrame(true, PingMessage, "p"), cFrame(true, 0, "cd")},
+		want: []wantMsg{{BinaryMessage, "abcd"}, {PingMessage, "p"}}},
+	{name: "continuation without start", frames: [][]byte{cFrame(true, 0, "x")},
+		err: ErrUnexpectedContinuation},
+	{name: "new message before final", frames: [][]byte{
+		cFrame(false, TextMessage, "a"), cFrame(true, TextMessage, "b")},
+		err: ErrMessageNotFinished},
+	{name: "close between fragments", frames: [][]byte{
+		cFrame(false, TextMessage, "a"), cFrame(true, CloseMessage, closePayload(CloseNormalClosure, ""))},
+		err: &CloseError{Code: CloseNormalClosure}},
+
+	// UTF-8
+	{name: "utf-8 text", frames: [][]byte{cFrame(true, TextMessage, "κόσμε")},
+		want: []wantMsg{{TextMessage, "κόσμε"}}},
+	{name: "utf-8 rune split by frames", frames: [][]byte{
+		cFrame(false, TextMessage, "κ\xcf"), cFrame(true, 0, "\x8cσμε")},
+		want: []wantMsg{{TextMessage, "κόσμε"}}},
+	{name: "invalid utf-8", frames: [][]byte{cFrame(true, TextMessage, "\xc3\x28")}, err: ErrInvalidUTF8},
+	{name: "surrogate", frames: [][]byte{cFrame(true, TextMessage, "\xed\xa0\x80")}, err: ErrInvalidUTF8},
+	{name: "surrogate split by frames", frames: [][]byte{
+		cFrame(false, TextMessage, "a\xed"), cFrame(true, 0, "\xa0\x80")}, err: ErrInvalidUTF8},
+	{name: "above U+10FFFF", frames: [][]byte{cFrame(false, TextMessage, "\xf4\x90"), cFrame(true, 0, "\x80\x80")},
+		err: ErrInvalidUTF8},
+	{name: "truncated rune", frames: [][]byte{cFrame(true, TextMessage, "a\xe2\x82")}, err: ErrInvalidUTF8},
+	{name: "binary is not checked", frames: [][]byte{cFrame(true, BinaryMessage, "\xc3\x28")},
+		want: []wantMsg{{BinaryMessage, "\xc3\x28"}}},
+}
+
+func TestConformance(t *testing.T) {
+	for _, tc := range conformanceCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			go func() {
+				for _, f := range tc.frames {
+					if _, err := c1.Write(f); err != nil {
+						return
+					}
+				}
+			}()
+
+			conn := NewConn(c2, !tc.client)
+			for _, want := range tc.want {
+				typ, msg, err := conn.Read()
+				if err != nil {
+					t.Fatal("read", MsgTypeS(want.typ), "err", err)
+				}
+				if typ != want.typ || string(msg) != want.data {
+					t.Fatalf("want %s %q, got %s %q", MsgTypeS(want.typ), want.data, MsgTypeS(typ), msg)
+				}
+			}
+			if tc.err == nil {
+				return
+			}
+			_, _, err := conn.Read()
+			if e, ok := tc.err.(*CloseError); ok {
+				if got, ok := err.(*CloseError); !ok || got.Code != e.Code {
+					t.Fatal("want", tc.err, "got", err)
+				}
+				return
+			}
+			if err != tc.err {
+				t.Fatal("want", tc.err, "got", err)
+			}
+			if CloseCodeOf(err) == 0 {
+				t.Fatal("no close code for", err)
+			}
+		})
+	}
+}
+
+// TestRoundTrip the frames written by Conn are read back by Conn, in both directions.
+func TestRoundTrip(t *testing.T) {
+	cli, svr := newPipe()
+	defer cli.Close()
+	defer svr.Close()
+
+	for _, size := range []int{0, 125, 126, 0xFFFF, 0x10000, 200000} {
+		payload := bytes.Repeat([]byte{byte(size)}, size)
+		go cli.WriteBinary(payload)
+		if typ, msg, err := svr.Read(); err != nil || typ != BinaryMessage || !bytes.Equal(msg, payload) {
+			t.Fatal("client to server, size", size, len(msg), err)
+		}
+		go svr.WriteBinary(payload)
+		if typ, msg, err := cli.Read(); err != nil || typ != BinaryMessage || !bytes.Equal(msg, payload) {
+			t.Fatal("server to client, size", size, len(msg), err)
+		}
+	}
+}
+
+func TestMaskingKey(t *testing.T) {
+	c := NewConn(nil, false)
+	var or [4]byte
+	for i := 0; i < 64; i++ {
+		key, err := c.newMaskingKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, b := range key {
+			or[j] |= b
+		}
+	}
+	for j, b := range or {
+		if b == 0 {
+			t.Fatal("masking key byte", j, "is always 0")
+		}
+	}
+}
+
+func TestFailCode(t *testing.T) {
+	cli, svr := newPipe()
+	defer cli.Close()
+	go cli.conn.Write(rawFrame(true, 0, TextMessage, []byte("\xff"), true))
+
+	_, _, err := svr.Read()
+	if err != ErrInvalidUTF8 {
+		t.Fatal("want ErrInvalidUTF8, got", err)
+	}
+	go func() {
+		svr.WriteClose(CloseCodeOf(err), err.Error())
+		svr.Close()
+	}()
+	typ, msg, _ := cli.Read()
+	if typ != CloseMessage || ParseCloseMessage(msg).Code != CloseInvalidPayload {
+		t.Fatal("want close 1007, got", MsgTypeS(typ), msg)
+	}
+}
@@ -2,12 +2,13 @@ package websocket
 
 import (
 	"bufio"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -45,6 +46,12 @@ var (
 	ErrControlFragmented = errors.New("control message can not be fragmented")
 	ErrNotTCPConn        = errors.New("not a tcp connection")
 	ErrWriteError        = errors.New("write error")
+	ErrUnmaskedFrame     = errors.New("frame from the client must be masked")
+	ErrMaskedFrame       = errors.New("frame from the server must not be masked")
+	ErrBadOpcode         = errors.New("unknown opcode")
+	ErrInvalidUTF8       = errors.New("invalid UTF-8 in text message")
+	ErrBadCloseCode      = errors.New("invalid close code")
+	ErrCloseSent         = errors.New("websocket close frame was sent")
 )
 
 type Conn struct {
@@ -53,6 +60,22 @@ type Conn struct {
 	br *bufio.Reader
 
 	isServer bool
+
+	hbuf      [8]byte // frame header
+	readLimit int64
+	reader    *messageReader // of the message returned by NextReader
+	pending   []controlFrame // read in the middle of a fragmented message
+
+	// Conn is safe for one reader and many writers: wmu keep the frames whole, msgMu keep the
+	// frames of one data message together, the control frames only wait wmu, so a Ping or Close
+	// is sent between the fragments of a large message.
+	wmu   sync.Mutex
+	msgMu sync.Mutex
+
+	closeSent bool // the close frame was sent, guarded by wmu
+	closeOnce sync.Once
+	closeErr  *CloseError   // the peer's close frame
+	readDone  chan struct{} // closed when the peer's close frame was read or the read failed
 }
 
 func (c *Conn) String() string {
@@ -68,6 +91,10 @@ func NewConn(conn net.Conn, isServer bool) *Conn {
 
 	c.isServer = isServer
 
+	c.readDone = make(chan struct{})
+
+	c.readLimit = Default_Max_Message_Size
+
 	return c
 }
 
@@ -75,39 +102,14 @@ func (c *Conn) ReadMessage() (messageType byte, message []byte, err error) {
 	return c.Read()
 }
 
+// Read the whole message, see NextReader.
 func (c *Conn) Read() (messageType byte, message []byte, err error) {
-	buf := make([]byte, 8, 8)
-
-	message = []byte{}
-
-	messageType = 0
-
-	for {
-		opcode, data, err := c.readFrame(buf)
-
-		if err != nil {
-			return messageType, message, err
-		}
-
-		message = append(message, data...)
-
-		if opcode&0x80 != 0 {
-			//final
-			if opcode&0x0F > 0 {
-				//not continue frame
-				messageType = opcode & 0x0F
-			}
-			return messageType, message, nil
-
-		} else {
-			if opcode&0x0F > 0 {
-				//first continue frame
-				messageType = opcode & 0x0F
-			}
-		}
+	messageType, r, err := c.NextReader()
+	if err != nil {
+		return messageType, []byte{}, err
 	}
-
-	return
+	message, err = io.ReadAll(r)
+	return messageType, message, err
 }
 
 func (c *Conn) Write(message []byte, binary bool) error {
@@ -140,7 +142,7 @@ func (c *Conn) Pong(message []byte) error {
 	return c.sendFrame(PongMessage, message)
 }
 
-//close socket, not send websocket close message
+//close socket, not send websocket close message, see CloseWithCode
 func (c *Conn) Close() error {
 	return c.conn.Close()
 }
@@ -191,75 +193,33 @@ func (c *Conn) readPayloadLen(length byte, buf []byte) (payloadLen uint64, err e
 		if err != nil {
 			return
 		}
-		payloadLen = uint64(binary.BigEndian.Uint16(buf[:8]))
+		payloadLen = binary.BigEndian.Uint64(buf[:8])
+		// the most significant bit MUST be 0
+		if payloadLen>>63 != 0 {
+			err = ErrPayloadError
+		}
 	}
 
 	return
 }
 
-func (c *Conn) readFrame(buf []byte) (opcode byte, messsage []byte, err error) {
-	//minimum head may 2 byte
-
-	err = c.read(buf[:2])
-	if err != nil {
-		return
-	}
-
-	opcode = buf[0]
-
-	if opcode&0x70 > 0 {
-		err = ErrRSVNotSupport
-		return
-	}
-
-	//isMasking := (0x80 & buf[1]) > 0
-	isMasking := (0x80 & buf[1]) > 0
-
-	var payloadLen uint64
-	payloadLen, err = c.readPayloadLen(buf[1]&0x7F, buf)
-	if err != nil {
-		return
-	}
-
-	if opcode&0x08 > 0 && payloadLen > 125 {
-		err = ErrControlTooLong
-		return
-	}
-
-	var masking []byte
-
-	if isMasking {
-		err = c.read(buf[:4])
-		if err != nil {
-			return
-		}
-
-		masking = buf[:4]
-	}
-
-	messsage = make([]byte, payloadLen)
-	err = c.read(messsage)
-
-	if err != nil {
-		return
-	}
-
-	if isMasking {
-		//maskingKey := c.newMaskingKey()
-		c.maskingData(messsage, masking)
+func (c *Conn) sendFrame(opcode byte, message []byte) error {
+	if !isControl(opcode) {
+		c.msgMu.Lock()
+		defer c.msgMu.Unlock()
 	}
-
-	return
+	return c.writeFrame(true, opcode, message)
 }
 
-func (c *Conn) sendFrame(opcode byte, message []byte) error {
+// writeFrame fin is false for the frames of a fragmented message except the last.
+func (c *Conn) writeFrame(fin bool, opcode byte, message []byte) error {
+	if isControl(opcode) && len(message) >= 126 {
+		return ErrControlTooLong
+	}
 	//max frame header may 14 length
 	buf := make([]byte, 0, len(message)+14)
-	//here we don not support continue frame, all are final
-	opcode |= 0x80
-
-	if opcode&0x08 > 0 && len(message) >= 126 {
-		return ErrControlTooLong
+	if fin {
+		opcode |= 0x80
 	}
 
 	buf = append(buf, opcode)
@@ -287,7 +247,10 @@ func (c *Conn) sendFrame(opcode byte, message []byte) error {
 	}
 
 	if !c.isServer {
-		maskingKey := c.newMaskingKey()
+		maskingKey, err := c.newMaskingKey()
+		if err != nil {
+			return err
+		}
 		buf = append(buf, maskingKey...)
 
 		pos := len(buf)
@@ -299,6 +262,18 @@ func (c *Conn) sendFrame(opcode byte, message []byte) error {
 		buf = append(buf, message...)
 	}
 
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// nothing can be sent after the close frame, RFC6455 5.5.1,
+	// checked in wmu so a frame which passed can not be written after the close frame
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode&0x0F == CloseMessage {
+		c.closeSent = true
+	}
+
 	tmpBuf := buf
 	for i := 0; i < 3; i++ {
 		n, err := c.conn.Write(tmpBuf)
@@ -337,7 +312,11 @@ func (c *Conn) maskingData(data []byte, maskingKey []byte) {
 	}
 }
 
-func (c *Conn) newMaskingKey() []byte {
-	n := rand.Uint32()
-	return []byte{byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 32)}
+// newMaskingKey the key must be unpredictable to the application (RFC6455 10.3).
+func (c *Conn) newMaskingKey() ([]byte, error) {
+	key := make([]byte, 4)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
@@ -0,0 +1,380 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+const (
+	// payload size of one frame of NextWriter, a larger message is sent as continuation frames.
+	Default_Fragment_Size = 16 * 1024
+	// max size of one incoming message, see SetReadLimit.
+	Default_Max_Message_Size = 16 << 20
+)
+
+var (
+	ErrMessageTooBig          = errors.New("message exceeds the read limit")
+	ErrUnexpectedContinuation = errors.New("continuation frame without a started message")
+	ErrMessageNotFinished     = errors.New("data frame in the middle of a fragmented message")
+	ErrBadMessageType         = errors.New("message type must be text or binary")
+	ErrWriterClosed           = errors.New("message writer was closed")
+)
+
+type frameHeader struct {
+	fin    bool
+	opcode byte
+	length uint64
+	masked bool
+	mask   [4]byte
+}
+
+func isControl(opcode byte) bool {
+	return opcode&0x08 != 0
+}
+
+// control frame which was read in the middle of a fragmented message.
+type controlFrame struct {
+	opcode  byte
+	payload []byte
+}
+
+// SetReadLimit the max size of one incoming message, <= 0 is no limit.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+func (c *Conn) readHeader() (h frameHeader, err error) {
+	buf := c.hbuf[:]
+
+	//minimum head may 2 byte
+	if err = c.read(buf[:2]); err != nil {
+		return
+	}
+
+	if buf[0]&0x70 > 0 {
+		err = ErrRSVNotSupport
+		return
+	}
+	h.fin = buf[0]&0x80 != 0
+	h.opcode = buf[0] & 0x0F
+	h.masked = buf[1]&0x80 != 0
+
+	switch h.opcode {
+	case 0, TextMessage, BinaryMessage, CloseMessage, PingMessage, PongMessage:
+	default:
+		err = ErrBadOpcode
+		return
+	}
+	if isControl(h.opcode) && !h.fin {
+		err = ErrControlFragmented
+		return
+	}
+	// RFC6455 5.1, a client masks all frames, a server never.
+	if c.isServer && !h.masked {
+		err = ErrUnmaskedFrame
+		return
+	}
+	if !c.isServer && h.masked {
+		err = ErrMaskedFrame
+		return
+	}
+
+	h.length, err = c.readPayloadLen(buf[1]&0x7F, buf)
+	if err != nil {
+		return
+	}
+
+	if isControl(h.opcode) && h.length > 125 {
+		err = ErrControlTooLong
+		return
+	}
+
+	if h.masked {
+		err = c.read(h.mask[:])
+	}
+	return
+}
+
+// readControl read the whole payload of the control frame h.
+func (c *Conn) readControl(h *frameHeader) ([]byte, error) {
+	payload := make([]byte, h.length)
+	if err := c.read(payload); err != nil {
+		return nil, err
+	}
+	if h.masked {
+		c.maskingData(payload, h.mask[:])
+	}
+	if h.opcode == CloseMessage {
+		if err := checkCloseMessage(payload); err != nil {
+			return nil, err
+		}
+		c.peerClosed(ParseCloseMessage(payload))
+	}
+	return payload, nil
+}
+
+// NextReader return the next message, the data frames are read when the reader is read,
+// so a large message is not held in memory. The unread data of the previous reader is discarded.
+// Control frames are returned as messages too, those arrive inside a fragmented message are
+// returned after it.
+func (c *Conn) NextReader() (messageType byte, r io.Reader, err error) {
+	if c.reader != nil {
+		_, err = io.Copy(io.Discard, c.reader)
+		c.reader = nil
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if len(c.pending) > 0 {
+		f := c.pending[0]
+		c.pending = c.pending[1:]
+		return f.opcode, bytes.NewReader(f.payload), nil
+	}
+
+	h, err := c.readHeader()
+	if err != nil {
+		c.peerClosed(&CloseError{Code: CloseAbnormalClosure, Text: err.Error()})
+		return 0, nil, err
+	}
+
+	if isControl(h.opcode) {
+		payload, err := c.readControl(&h)
+		if err != nil {
+			c.peerClosed(&CloseError{Code: CloseAbnormalClosure, Text: err.Error()})
+			return 0, nil, err
+		}
+		return h.opcode, bytes.NewReader(payload), nil
+	}
+
+	if h.opcode == 0 {
+		return 0, nil, ErrUnexpectedContinuation
+	}
+	if c.readLimit > 0 && h.length > uint64(c.readLimit) {
+		return 0, nil, ErrMessageTooBig
+	}
+	c.reader = &messageReader{c: c, h: h, remain: h.length, text: h.opcode == TextMessage}
+	return h.opcode, c.reader, nil
+}
+
+type messageReader struct {
+	c      *Conn
+	h      frameHeader // of the current frame
+	remain uint64      // payload bytes of the current frame not read
+	pos    int         // masking key offset of the current frame
+	size   int64       // bytes of the message read
+	err    error
+
+	text    bool   // validate UTF-8
+	partial []byte // the incomplete rune at the end of the last Read
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	for r.remain == 0 {
+		if r.h.fin {
+			r.err = io.EOF
+			if len(r.partial) > 0 {
+				r.err = ErrInvalidUTF8
+			}
+			return 0, r.err
+		}
+		if r.err = r.nextFrame(); r.err != nil {
+			if r.err != ErrMessageTooBig {
+				r.c.peerClosed(&CloseError{Code: CloseAbnormalClosure, Text: r.err.Error()})
+			}
+			return 0, r.err
+		}
+	}
+
+	if uint64(len(p)) > r.remain {
+		p = p[:r.remain]
+	}
+	n, err := r.c.br.Read(p)
+	if r.h.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= r.h.mask[(r.pos+i)%4]
+		}
+		r.pos += n
+	}
+	r.remain -= uint64(n)
+	r.size += int64(n)
+	if r.text && !r.validUTF8(p[:n]) {
+		r.err = ErrInvalidUTF8
+		return n, r.err
+	}
+
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+		r.c.peerClosed(&CloseError{Code: CloseAbnormalClosure, Text: err.Error()})
+	}
+	return n, err
+}
+
+// validUTF8 check p with the incomplete rune of the last Read, a rune can be split by frames.
+func (r *messageReader) validUTF8(p []byte) bool {
+	if len(r.partial) > 0 {
+		p = append(r.partial, p...)
+		r.partial = nil
+	}
+	for len(p) > 0 {
+		if p[0] < utf8.RuneSelf {
+			p = p[1:]
+			continue
+		}
+		if !utf8.FullRune(p) {
+			// the rest may be in the next Read, but it must be a valid prefix
+			if !validPrefix(p) {
+				return false
+			}
+			r.partial = append([]byte{}, p...)
+			return true
+		}
+		c, size := utf8.DecodeRune(p)
+		if c == utf8.RuneError && size == 1 {
+			return false
+		}
+		p = p[size:]
+	}
+	return true
+}
+
+// validPrefix p is an incomplete rune, check it can still be completed to a valid one, RFC3629.
+func validPrefix(p []byte) bool {
+	lo, hi := byte(0x80), byte(0xBF) // range of the second byte
+	switch b := p[0]; {
+	case b >= 0xC2 && b <= 0xDF, b >= 0xE1 && b <= 0xEC, b == 0xEE, b == 0xEF, b >= 0xF1 && b <= 0xF3:
+	case b == 0xE0:
+		lo = 0xA0
+	case b == 0xED:
+		hi = 0x9F // no surrogates
+	case b == 0xF0:
+		lo = 0x90
+	case b == 0xF4:
+		hi = 0x8F // max U+10FFFF
+	default:
+		return false
+	}
+	for i, b := range p[1:] {
+		if i == 0 && (b < lo || b > hi) || i > 0 && (b < 0x80 || b > 0xBF) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCloseMessage RFC6455 5.5.1 and 7.4, the payload is empty or a valid code with a UTF-8 reason.
+func checkCloseMessage(payload []byte) error {
+	switch {
+	case len(payload) == 0:
+		return nil
+	case len(payload) == 1:
+		return ErrPayloadError
+	case !utf8.Valid(payload[2:]):
+		return ErrInvalidUTF8
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014, code >= 3000 && code <= 4999:
+		return nil
+	}
+	return ErrBadCloseCode
+}
+
+// nextFrame read the header of the next continuation frame, the control frames before it are kept.
+func (r *messageReader) nextFrame() error {
+	for {
+		h, err := r.c.readHeader()
+		if err != nil {
+			return err
+		}
+		if isControl(h.opcode) {
+			payload, err := r.c.readControl(&h)
+			if err != nil {
+				return err
+			}
+			if h.opcode == CloseMessage {
+				// the peer will send nothing more
+				return ParseCloseMessage(payload)
+			}
+			r.c.pending = append(r.c.pending, controlFrame{h.opcode, payload})
+			continue
+		}
+		if h.opcode != 0 {
+			return ErrMessageNotFinished
+		}
+		if r.c.readLimit > 0 && uint64(r.size)+h.length > uint64(r.c.readLimit) {
+			return ErrMessageTooBig
+		}
+		r.h, r.remain, r.pos = h, h.length, 0
+		return nil
+	}
+}
+
+// NextWriter return a writer of a text or binary message, the data is sent as
+// Default_Fragment_Size frames, Close send the final frame. The other data messages
+// wait until Close, the control frames do not, so Close must always be called.
+func (c *Conn) NextWriter(messageType byte) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, ErrBadMessageType
+	}
+	c.msgMu.Lock()
+	return &messageWriter{
+		c:      c,
+		opcode: messageType,
+		buf:    make([]byte, 0, Default_Fragment_Size),
+	}, nil
+}
+
+type messageWriter struct {
+	c      *Conn
+	opcode byte // of the next frame, continuation after the first frame
+	buf    []byte
+	closed bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	n := 0
+	for len(p) > 0 {
+		// 缓冲满且还有数据时才发出, 最后一帧留给 Close, 带 FIN
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (w *messageWriter) flush(fin bool) error {
+	err := w.c.writeFrame(fin, w.opcode, w.buf)
+	w.opcode = 0
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Close send the final frame of the message.
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.c.msgMu.Unlock()
+	return w.flush(true)
+}
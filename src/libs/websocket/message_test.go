@@ -0,0 +1,86 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+func newPipe() (*Conn, *Conn) {
+	c1, c2 := net.Pipe()
+	return NewConn(c1, false), NewConn(c2, true)
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	cli, svr := newPipe()
+	defer cli.Close()
+	defer svr.Close()
+
+	payload := make([]byte, Default_Fragment_Size*3+100)
+	rand.Read(payload)
+
+	go func() {
+		w, _ := cli.NextWriter(BinaryMessage)
+		// small writes are merged into fragments
+		for p := payload; len(p) > 0; p = p[1000:] {
+			if len(p) < 1000 {
+				w.Write(p)
+				break
+			}
+			w.Write(p[:1000])
+		}
+		// a Ping between the fragments
+		cli.Ping([]byte("p"))
+		w.Close()
+		cli.WriteMessage(TextMessage, []byte("next"))
+	}()
+
+	typ, r, err := svr.NextReader()
+	if err != nil || typ != BinaryMessage {
+		t.Fatal("bad message", typ, err)
+	}
+	result, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, payload) {
+		t.Fatal("data not match, size", len(result))
+	}
+
+	// the Ping inside the message is returned after it.
+	if typ, msg, err := svr.Read(); err != nil || typ != PingMessage || string(msg) != "p" {
+		t.Fatal("want the ping, got", typ, string(msg), err)
+	}
+	if typ, msg, err := svr.Read(); err != nil || typ != TextMessage || string(msg) != "next" {
+		t.Fatal("want the next message, got", typ, string(msg), err)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	cli, svr := newPipe()
+	defer cli.Close()
+	defer svr.Close()
+	svr.SetReadLimit(Default_Fragment_Size * 2)
+
+	go func() {
+		w, _ := cli.NextWriter(BinaryMessage)
+		w.Write(make([]byte, Default_Fragment_Size*3))
+		w.Close()
+	}()
+
+	_, r, err := svr.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != ErrMessageTooBig {
+		t.Fatal("want ErrMessageTooBig, got", err)
+	}
+
+	// one frame larger than the limit fails at once.
+	go cli.WriteBinary(make([]byte, Default_Fragment_Size*2+1))
+	if _, _, err := svr.NextReader(); err != ErrMessageTooBig {
+		t.Fatal("want ErrMessageTooBig, got", err)
+	}
+}
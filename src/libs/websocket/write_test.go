@@ -0,0 +1,154 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentWrites many goroutines write whole and fragmented messages and Pings on one Conn,
+// every message must arrive whole, run it with -race.
+func TestConcurrentWrites(t *testing.T) {
+	cli, svr := newPipe()
+	defer cli.Close()
+	defer svr.Close()
+
+	const writers, count = 16, 20
+	message := func(id int) []byte {
+		size := 100 + id*1000
+		if id%2 == 1 {
+			size = Default_Fragment_Size*2 + id // fragmented
+		}
+		return bytes.Repeat([]byte{byte(id)}, size)
+	}
+
+	var wg sync.WaitGroup
+	for id := 0; id < writers; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			data := message(id)
+			for i := 0; i < count; i++ {
+				if id%2 == 0 {
+					if err := cli.WriteBinary(data); err != nil {
+						t.Error(err)
+					}
+					continue
+				}
+				w, _ := cli.NextWriter(BinaryMessage)
+				for p := data; len(p) > 0; {
+					n := 1000
+					if n > len(p) {
+						n = len(p)
+					}
+					w.Write(p[:n])
+					p = p[n:]
+				}
+				if err := w.Close(); err != nil {
+					t.Error(err)
+				}
+			}
+		}(id)
+	}
+	// the Pings go between the fragments
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			if err := cli.Ping([]byte{byte(i)}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	pings, messages := 0, 0
+	for messages < writers*count || pings < count {
+		typ, msg, err := svr.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch typ {
+		case PingMessage:
+			pings++
+		case BinaryMessage:
+			messages++
+			if len(msg) == 0 || !bytes.Equal(msg, message(int(msg[0]))) {
+				t.Fatal("message corrupted, size", len(msg))
+			}
+		default:
+			t.Fatal("bad message type", MsgTypeS(typ))
+		}
+	}
+	wg.Wait()
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	cli, svr := newPipe()
+	defer svr.Close()
+
+	go svr.Read()
+	if err := cli.WriteClose(CloseNormalClosure, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.WriteBinary([]byte("x")); err != ErrCloseSent {
+		t.Fatal("want ErrCloseSent, got", err)
+	}
+	cli.Close()
+}
+
+// TestNoFrameAfterClose the writers racing with WriteClose never put a frame after the close frame.
+func TestNoFrameAfterClose(t *testing.T) {
+	c1, c2 := net.Pipe()
+	cli := NewConn(c1, false)
+	defer cli.Close()
+
+	// masking a large payload keep the writers between the check and the lock longer
+	data := make([]byte, 60000)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cli.WriteBinary(data) == nil {
+			}
+		}()
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cli.WriteClose(CloseNormalClosure, "")
+	}()
+
+	closed := false
+	for {
+		if closed {
+			c2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		}
+		// opcode, mask|len, extended len, masking key
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c2, header); err != nil {
+			if !closed {
+				t.Fatal(err)
+			}
+			break
+		}
+		if closed {
+			t.Fatal("frame opcode", header[0]&0x0F, "after the close frame")
+		}
+		size := int(header[1] & 0x7F)
+		if size == 126 {
+			ext := make([]byte, 2)
+			io.ReadFull(c2, ext)
+			size = int(binary.BigEndian.Uint16(ext))
+		}
+		if _, err := io.ReadFull(c2, make([]byte, 4+size)); err != nil {
+			t.Fatal(err)
+		}
+		closed = header[0]&0x0F == CloseMessage
+	}
+	c2.Close()
+	wg.Wait()
+}
@@ -1,111 +1,141 @@
 package svr
 
 import (
+	"ctrl"
 	"fmt"
 	"io"
 	"libs/log"
 	"net/http"
+	"strings"
+	"time"
 )
 
-func init() {
-	println("svr.admin.init")
+// the changes must be POST, a cross-site <img> or link can not do them by GET.
+var api_post_only = map[string]bool{
+	"/api/route/add": true,
+	"/api/route/del": true,
+	"/api/cred/add":  true,
+	"/api/cred/del":  true,
+	"/api/vhost/add": true,
+	"/api/vhost/del": true,
+	"/api/set":       true,
 }
 
-var control_html = `<html><head></head><body>
-localhost-IP：<input id='local_network_ip' value='%s' />
-<input type='button' value='Set' onclick='javascript:setLocalnetworkHostPort();'><br>
-
-<br><br>Note: If you find that localhost-IP does not update, try and disable your browser's cache
-<lable  id='resutl'> </ lable>
-<script type='text/javascript' language='javascript'>
- var http_request = false;
- //var control_port = %d 
- function setLocalnetworkHostPort(){
- 	var ip = document.getElementById('local_network_ip').value 
- 	makeRequest('svr='+ip)
- }
- function makeRequest(parameters) {
- 	http_request = false;
-  	if (window.XMLHttpRequest) { // Mozilla, Safari,...
-    		http_request = new XMLHttpRequest();
-    		if (http_request.overrideMimeType) {
- 			// set type accordingly to anticipated content type
- 			//http_request.overrideMimeType('text/xml');
- 			http_request.overrideMimeType('text/html');
-    		}
-  	} else if (window.ActiveXObject) { // IE
-  		try {
-    			http_request = new ActiveXObject('Msxml2.XMLHTTP');
-  		} catch (e) {
-    			try {
-       			http_request = new ActiveXObject('Microsoft.XMLHTTP');
-  			} catch (e) {}
- 		}
-  	}
-  	if (!http_request) {
- 		alert('Cannot create XMLHTTP instance');
- 		return false;
-  	}
-    http_request.onreadystatechange = alertContents;
-	//http_request.open('GET', 'http://'+window.location.hostname+':'+control_port+'/?' + parameters, true);
-	http_request.open('GET', '/api/set?' + parameters, true);
-    http_request.send(null);
- }
- function alertContents() {
-    if (http_request.readyState == 4) {
-      if (http_request.status == 200) {
-        alert(http_request.responseText);
-        result = http_request.responseText;
-        document.getElementById('result').innerHTML = result;            
-      } else {
-        alert('There was a problem controlling the camera.');
-      }
-    }
- }
-</script>`
-
-// URI: /admin/
-func httpAdminHandler(w http.ResponseWriter, r *http.Request) {
-
-	log.Info("admin Handler: %s %s %s", r.Method, r.URL.RequestURI(), r.RemoteAddr)
+// URI: /api/
+func (s *Server) httpApiHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info("api Handler: %s %s %s", r.Method, r.URL.RequestURI(), r.RemoteAddr)
 
-	if !authOK(r) {
-		noAuthResponse(w)
+	if _, ok := s.authenticate(w, r, s.limiter, s.adminAuth, "admin"); !ok {
 		return
 	}
-
-	setSTDheader(w)
-	resp := fmt.Sprintf(control_html, pConfig.client_conf_forward_host)
-	io.WriteString(w, resp)
-}
-
-// URI: /api/
-func httpApiHandler(w http.ResponseWriter, r *http.Request) {
-	log.Info("api Handler: %s %s %s", r.Method, r.URL.RequestURI(), r.RemoteAddr, r.FormValue("svr"))
-
-	if !authOK(r) {
-		noAuthResponse(w)
+	if api_post_only[r.URL.Path] && r.Method != "POST" {
+		setSTDheader(w)
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, r.URL.Path+" must be POST")
 		return
 	}
 	var status = 200
 	var resp string
 
-	svr := r.FormValue("svr")
-	if svr != "" && svr != pConfig.client_conf_forward_host {
-		cli, err := getFreeClient()
-		if cli == nil {
-			resp = err.Error()
+	switch r.URL.Path {
+	case "/api/route/add":
+		route := &Route{
+			Name:   r.FormValue("name"),
+			Listen: r.FormValue("listen"),
+			Target: r.FormValue("target"),
+			Site:   r.FormValue("site"),
+			Proto:  r.FormValue("proto"),
+		}
+		// http route: auth=user:password, can be repeated
+		route.Auth = r.Form["auth"]
+		route.AuthMode = r.FormValue("authmode")
+		if err := s.AddRoute(route); err != nil {
+			status, resp = 400, err.Error()
 		} else {
-			err := cli.tellClientSetConfig(svr)
-			if err != nil {
-				resp = err.Error()
-			} else {
-				resp = fmt.Sprintf("Set [%s] OK", svr)
+			resp = fmt.Sprintf("Add route[%s] OK", route)
+		}
+	case "/api/route/del":
+		name := r.FormValue("name")
+		if err := s.RemoveRoute(name); err != nil {
+			status, resp = 400, err.Error()
+		} else {
+			resp = fmt.Sprintf("Remove route[%s] OK", name)
+		}
+	case "/api/routes":
+		for _, route := range s.Routes() {
+			resp += route.String()
+			if route.isVHost() {
+				resp += " vhosts[" + route.vhostsString() + "]"
+			}
+			if route.isHTTP() && len(route.Auth) > 0 {
+				resp += fmt.Sprintf(" auth[%s users=%d]", route.authMode(), len(route.Auth))
 			}
+			resp += "\n"
 		}
+	case "/api/vhost/add":
+		vhost := &VHost{
+			Host:   r.FormValue("host"),
+			Target: r.FormValue("target"),
+			Site:   r.FormValue("site"),
+		}
+		if err := s.AddVHost(r.FormValue("route"), vhost); err != nil {
+			status, resp = 400, err.Error()
+		} else {
+			resp = fmt.Sprintf("Add vhost[%s] OK", vhost)
+		}
+	case "/api/vhost/del":
+		host := r.FormValue("host")
+		if err := s.RemoveVHost(r.FormValue("route"), host); err != nil {
+			status, resp = 400, err.Error()
+		} else {
+			resp = fmt.Sprintf("Remove vhost[%s] OK", host)
+		}
+	case "/api/sites":
+		for _, site := range s.sitesStatus() {
+			resp += fmt.Sprintf("%s tunnels[%d] streams[%d] local[%s] clients[%s] routes[%s]\n",
+				site.Site, site.Tunnels, site.Streams, site.LocalHostServ,
+				site.clientsString(), strings.Join(site.Routes, " "))
+		}
+	case "/api/cred/add":
+		cred, err := s.AddCredential(r.FormValue("name"), r.FormValue("site"))
+		if err != nil {
+			status, resp = 400, err.Error()
+		} else {
+			// the only time the token is shown
+			resp = fmt.Sprintf("%s %s %s", cred.Name, cred.Site, cred.Token)
+		}
+	case "/api/cred/del":
+		name := r.FormValue("name")
+		if err := s.RevokeCredential(name); err != nil {
+			status, resp = 400, err.Error()
+		} else {
+			resp = fmt.Sprintf("Revoke credential[%s] OK", name)
+		}
+	case "/api/creds":
+		for _, cred := range s.Credentials() {
+			resp += fmt.Sprintf("%s site[%s] created[%s] online[%d]\n",
+				cred.Name, cred.Site, cred.Created.Format(time.RFC3339), len(s.clientsOfCredential(cred.Name)))
+		}
+	default:
+		resp = s.setClientConfig(r.FormValue("site"), r.FormValue("svr"))
 	}
 
 	setSTDheader(w)
 	w.WriteHeader(status)
 	io.WriteString(w, resp)
 }
+
+// POST /api/set site=default&svr=ip:port
+func (s *Server) setClientConfig(site, svr string) string {
+	if svr == "" {
+		return ""
+	}
+	if site == "" {
+		site = ctrl.DEFAULT_SITE
+	}
+	if err := s.setSiteConfig(site, svr); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("Set site[%s] [%s] OK", site, svr)
+}
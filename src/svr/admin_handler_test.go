@@ -0,0 +1,66 @@
+package svr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestApiPostOnly(t *testing.T) {
+	s := newTestServer(t)
+	do := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		var r *http.Request
+		if method == "POST" {
+			r = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(method, path+"?"+form.Encode(), nil)
+		}
+		w := httptest.NewRecorder()
+		s.ServeMux().ServeHTTP(w, r)
+		return w
+	}
+
+	route := url.Values{"name": {"cam"}, "listen": {"127.0.0.1:0"}}
+	if w := do("GET", "/api/route/add", route); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Fatal("GET route/add want 405, got", w.Code)
+	}
+	if s.findRoute("cam") != nil {
+		t.Fatal("route added by GET")
+	}
+	if w := do("POST", "/api/route/add", route); w.Code != http.StatusOK {
+		t.Fatal("POST route/add", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/route/del", url.Values{"name": {"cam"}}); w.Code != http.StatusMethodNotAllowed {
+		t.Fatal("GET route/del want 405, got", w.Code)
+	}
+	if w := do("POST", "/api/route/del", url.Values{"name": {"cam"}}); w.Code != http.StatusOK {
+		t.Fatal("POST route/del", w.Code, w.Body.String())
+	}
+
+	cred := url.Values{"name": {"pi"}, "site": {"home"}}
+	if w := do("GET", "/api/cred/add", cred); w.Code != http.StatusMethodNotAllowed || len(s.Credentials()) != 0 {
+		t.Fatal("GET cred/add want 405, got", w.Code)
+	}
+	if w := do("GET", "/api/cred/del", cred); w.Code != http.StatusMethodNotAllowed {
+		t.Fatal("GET cred/del want 405, got", w.Code)
+	}
+
+	vhost := url.Values{"route": {"web"}, "host": {"cam.example.com"}}
+	for _, path := range []string{"/api/vhost/add", "/api/vhost/del"} {
+		if w := do("GET", path, vhost); w.Code != http.StatusMethodNotAllowed {
+			t.Fatal("GET", path, "want 405, got", w.Code)
+		}
+	}
+
+	set := url.Values{"site": {"default"}, "svr": {"127.0.0.1:80"}}
+	if w := do("GET", "/api/set", set); w.Code != http.StatusMethodNotAllowed {
+		t.Fatal("GET set want 405, got", w.Code)
+	}
+	// no client online, but it reach the handler
+	if w := do("POST", "/api/set", set); !strings.Contains(w.Body.String(), "no websocket connect online") {
+		t.Fatal("POST set", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,601 @@
+/*
+	versioned JSON admin API, for the scripts and the monitoring.
+
+	GET    /api/v1/health
+	GET    /api/v1/tunnels[?site=]               online websocket
+	DELETE /api/v1/tunnels/{id}                  kick, the client reconnect later
+	GET    /api/v1/sessions[?tunnel=&route=]     forwarding connections
+	DELETE /api/v1/sessions/{tunnel}/{stream}    kick
+	GET    /api/v1/routes
+	POST   /api/v1/routes                        body is Route
+	GET    /api/v1/routes/{name}
+	PUT    /api/v1/routes/{name}                 body is Route, Auth and VHosts are kept if omitted
+	DELETE /api/v1/routes/{name}
+	GET    /api/v1/sites
+	GET    /api/v1/sites/{site}
+	PUT    /api/v1/sites/{site}                  body {"LocalHostServ":"ip:port"}
+	GET    /api/v1/logs[?after=seq]              the last log lines, if SetLogViewer was called
+
+	POST, PUT and DELETE must be Content-Type: application/json, even without a body.
+	the errors are {"Error":"..."} with 4xx/5xx status.
+*/
+
+package svr
+
+import (
+	"ctrl"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"libs/log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"tunnel"
+)
+
+const (
+	API_V1_URI = "/api/v1/"
+
+	api_max_body = 1 << 20
+)
+
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+)
+
+type apiError struct {
+	Error string
+}
+
+type apiHealth struct {
+	Status       string // "ok", or "degraded" if some site has routes but no online tunnel
+	Started      time.Time
+	Uptime       float64 // seconds
+	Tunnels      int
+	Sessions     int
+	Routes       int
+	Sites        int
+	OfflineSites []string `json:",omitempty"`
+	Goroutines   int
+}
+
+type apiTunnel struct {
+	ID            uint64
+	Site          string
+	Addr          string // websocket remote addr
+	Credential    string `json:",omitempty"`
+	LocalHostServ string
+	Connected     time.Time
+	Uptime        float64 // seconds
+	Streams       int
+	BytesIn       int64   // from the client
+	BytesOut      int64   // to the client
+	RTT           float64 // seconds of the last heartbeat, 0 is not measured yet
+	Draining      bool
+}
+
+type apiSession struct {
+	Tunnel   uint64
+	Stream   uint32
+	Site     string
+	Route    string
+	Target   string // empty is the client's LocalHostServ
+	Proto    string `json:",omitempty"`
+	Peer     string // the public conn, or the UDP peer
+	Reverse  bool   `json:",omitempty"`
+	Proxy    bool   `json:",omitempty"`
+	Started  time.Time
+	Uptime   float64 // seconds
+	BytesIn  int64   // from the client
+	BytesOut int64   // to the client
+}
+
+type apiRoute struct {
+	Name      string
+	Proto     string
+	Listen    string
+	Addr      string // the real listen address
+	Target    string
+	Site      string
+	VHosts    []*VHost `json:",omitempty"`
+	AuthMode  string   `json:",omitempty"`
+	AuthUsers []string `json:",omitempty"` // only the names, the passwords are never shown
+	Sessions  int
+}
+
+// apiRouteBody the body of POST and PUT routes, the read-only fields of apiRoute are ignored,
+// so a route read by GET can be put back.
+type apiRouteBody struct {
+	Route
+	Addr      string   `json:",omitempty"`
+	AuthUsers []string `json:",omitempty"`
+	Sessions  int      `json:",omitempty"`
+}
+
+type apiSite struct {
+	Site          string
+	Tunnels       int
+	Streams       int
+	LocalHostServ string
+	Routes        []string
+}
+
+type apiSiteConfig struct {
+	LocalHostServ string
+}
+
+type apiLogs struct {
+	Lines []log.Line
+	Last  uint64 // Seq of the last line, the next ?after=, less than after if the server restarted
+}
+
+// httpError carry the status code of an API error.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func apiErrorf(status int, format string, v ...interface{}) error {
+	return &httpError{status: status, err: fmt.Errorf(format, v...)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*httpError); ok {
+		status = e.status
+	}
+	writeJSON(w, status, &apiError{Error: err.Error()})
+}
+
+// URI: /api/v1/
+func (s *Server) httpApiV1Handler(w http.ResponseWriter, r *http.Request) {
+	log.Info("api v1 Handler: %s %s %s", r.Method, r.URL.RequestURI(), r.RemoteAddr)
+
+	if _, err := s.checkAuth(r, s.limiter, s.adminAuth, "api"); err != nil {
+		if err == ErrLockedOut {
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.limiter.lockout.Seconds())))
+			writeAPIError(w, &httpError{http.StatusTooManyRequests, err})
+			return
+		}
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"TCP-Forward-Serv\"")
+		writeAPIError(w, &httpError{http.StatusUnauthorized, err})
+		return
+	}
+
+	path, err := splitAPIPath(r.URL.EscapedPath())
+	if err != nil {
+		writeAPIError(w, &httpError{http.StatusBadRequest, err})
+		return
+	}
+
+	var handle func(r *http.Request, args []string) (int, interface{}, error)
+	var methods []string
+	switch {
+	case len(path) == 1 && path[0] == "health":
+		handle, methods = s.apiHealth, []string{"GET"}
+	case len(path) == 1 && path[0] == "tunnels":
+		handle, methods = s.apiTunnels, []string{"GET"}
+	case len(path) == 2 && path[0] == "tunnels":
+		handle, methods = s.apiKickTunnel, []string{"DELETE"}
+	case len(path) == 1 && path[0] == "sessions":
+		handle, methods = s.apiSessions, []string{"GET"}
+	case len(path) == 3 && path[0] == "sessions":
+		handle, methods = s.apiKickSession, []string{"DELETE"}
+	case len(path) == 1 && path[0] == "routes":
+		handle, methods = s.apiRoutes, []string{"GET", "POST"}
+	case len(path) == 2 && path[0] == "routes":
+		handle, methods = s.apiRoute, []string{"GET", "PUT", "DELETE"}
+	case len(path) == 1 && path[0] == "sites":
+		handle, methods = s.apiSites, []string{"GET"}
+	case len(path) == 2 && path[0] == "sites":
+		handle, methods = s.apiSite, []string{"GET", "PUT"}
+	case len(path) == 1 && path[0] == "logs":
+		handle, methods = s.apiLogs, []string{"GET"}
+	default:
+		writeAPIError(w, apiErrorf(http.StatusNotFound, "%s %s", r.URL.Path, ErrNotFound))
+		return
+	}
+
+	allowed := false
+	for _, m := range methods {
+		allowed = allowed || r.Method == m
+	}
+	if !allowed {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeAPIError(w, apiErrorf(http.StatusMethodNotAllowed, "%s %s", r.Method, ErrMethodNotAllowed))
+		return
+	}
+
+	// a cross-site form can only send the simple types, application/json needs the CORS preflight
+	if r.Method != "GET" && r.Method != "HEAD" && !isJSON(r) {
+		writeAPIError(w, apiErrorf(http.StatusUnsupportedMediaType, "Content-Type must be application/json"))
+		return
+	}
+
+	status, resp, err := handle(r, path[1:])
+	if err != nil {
+		log.Warn("api v1 %s %s err=%s", r.Method, r.URL.Path, err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, status, resp)
+}
+
+// splitAPIPath "/api/v1/routes/a%2Fb" -> [routes a/b]
+func splitAPIPath(escaped string) ([]string, error) {
+	p := strings.Trim(strings.TrimPrefix(escaped, strings.TrimSuffix(API_V1_URI, "/")), "/")
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		v, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = v
+	}
+	return parts, nil
+}
+
+func isJSON(r *http.Request) bool {
+	ctype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && ctype == "application/json"
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, api_max_body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return apiErrorf(http.StatusBadRequest, "bad json body: %s", err.Error())
+	}
+	return nil
+}
+
+func (c *wsClient) status() *apiTunnel {
+	return &apiTunnel{
+		ID:            c.id,
+		Site:          c.site,
+		Addr:          c.req.RemoteAddr,
+		Credential:    c.cred,
+		LocalHostServ: c.getLocalHostServ(),
+		Connected:     c.connected,
+		Uptime:        time.Since(c.connected).Seconds(),
+		Streams:       c.session.NumStreams(),
+		BytesIn:       c.session.BytesIn(),
+		BytesOut:      c.session.BytesOut(),
+		RTT:           c.session.RTT().Seconds(),
+		Draining:      c.isDraining(),
+	}
+}
+
+func (s *Server) findTunnel(arg string) (*wsClient, error) {
+	id, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "bad tunnel id[%s]", arg)
+	}
+	for _, c := range s.onlineClients() {
+		if c.id == id {
+			return c, nil
+		}
+	}
+	return nil, apiErrorf(http.StatusNotFound, "tunnel[%d] %s", id, ErrNotFound)
+}
+
+// tunnels order by ID, the oldest first.
+func (s *Server) tunnels() []*wsClient {
+	clients := s.onlineClients()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+func sessionStatus(c *wsClient, stream *tunnel.Stream) *apiSession {
+	status := &apiSession{
+		Tunnel:   c.id,
+		Stream:   stream.ID(),
+		Site:     c.site,
+		Peer:     stream.Peer(),
+		Started:  stream.Created(),
+		Uptime:   time.Since(stream.Created()).Seconds(),
+		BytesIn:  stream.BytesIn(),
+		BytesOut: stream.BytesOut(),
+	}
+	if info, err := ctrl.ParseConnectInfo(stream.Info()); err == nil {
+		status.Route, status.Target, status.Proto = info.Route, info.Target, info.Proto
+		status.Reverse, status.Proxy = info.Reverse, info.Proxy
+		if info.Peer != "" {
+			status.Peer = info.Peer
+		}
+	}
+	return status
+}
+
+func (s *Server) sessions() []*apiSession {
+	sessions := []*apiSession{}
+	for _, c := range s.tunnels() {
+		for _, stream := range c.session.Streams() {
+			sessions = append(sessions, sessionStatus(c, stream))
+		}
+	}
+	return sessions
+}
+
+func (s *Server) routeStatus(route *Route, sessions []*apiSession) *apiRoute {
+	status := &apiRoute{
+		Name:   route.Name,
+		Proto:  route.Proto,
+		Listen: route.Listen,
+		Target: route.Target,
+		Site:   route.site(),
+	}
+	if status.Proto == "" {
+		status.Proto = ctrl.PROTO_TCP
+	}
+	if addr := s.RouteAddr(route.Name); addr != nil {
+		status.Addr = addr.String()
+	}
+	route.vrw.RLock()
+	status.VHosts = append(status.VHosts, route.VHosts...)
+	route.vrw.RUnlock()
+	if len(route.Auth) > 0 {
+		status.AuthMode = route.authMode()
+		for _, u := range route.Auth {
+			status.AuthUsers = append(status.AuthUsers, strings.SplitN(u, ":", 2)[0])
+		}
+	}
+	for _, session := range sessions {
+		if session.Route == route.Name && !session.Reverse {
+			status.Sessions++
+		}
+	}
+	return status
+}
+
+// GET /api/v1/health
+func (s *Server) apiHealth(r *http.Request, args []string) (int, interface{}, error) {
+	health := &apiHealth{
+		Status:     "ok",
+		Started:    s.started,
+		Uptime:     time.Since(s.started).Seconds(),
+		Tunnels:    s.NumTunnels(),
+		Sessions:   len(s.sessions()),
+		Routes:     len(s.Routes()),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	for _, site := range s.sitesStatus() {
+		health.Sites++
+		if site.Tunnels == 0 && len(site.Routes) > 0 {
+			health.OfflineSites = append(health.OfflineSites, site.Site)
+			health.Status = "degraded"
+		}
+	}
+	return http.StatusOK, health, nil
+}
+
+// GET /api/v1/tunnels[?site=]
+func (s *Server) apiTunnels(r *http.Request, args []string) (int, interface{}, error) {
+	site := r.FormValue("site")
+	tunnels := []*apiTunnel{}
+	for _, c := range s.tunnels() {
+		if site == "" || c.site == site {
+			tunnels = append(tunnels, c.status())
+		}
+	}
+	return http.StatusOK, tunnels, nil
+}
+
+// DELETE /api/v1/tunnels/{id}
+func (s *Server) apiKickTunnel(r *http.Request, args []string) (int, interface{}, error) {
+	c, err := s.findTunnel(args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	status := c.status()
+	log.Warn("tunnel[%s] id[%d] kicked by admin.", c, c.id)
+	c.session.CloseWithCode(ctrl.Close_Kicked, "kicked by admin")
+	return http.StatusOK, status, nil
+}
+
+// GET /api/v1/sessions[?tunnel=&route=]
+func (s *Server) apiSessions(r *http.Request, args []string) (int, interface{}, error) {
+	var tunnelID uint64
+	if v := r.FormValue("tunnel"); v != "" {
+		c, err := s.findTunnel(v)
+		if err != nil {
+			return 0, nil, err
+		}
+		tunnelID = c.id
+	}
+	route := r.FormValue("route")
+
+	sessions := []*apiSession{}
+	for _, session := range s.sessions() {
+		if (tunnelID == 0 || session.Tunnel == tunnelID) && (route == "" || session.Route == route) {
+			sessions = append(sessions, session)
+		}
+	}
+	return http.StatusOK, sessions, nil
+}
+
+// DELETE /api/v1/sessions/{tunnel}/{stream}
+func (s *Server) apiKickSession(r *http.Request, args []string) (int, interface{}, error) {
+	c, err := s.findTunnel(args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	id, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return 0, nil, apiErrorf(http.StatusBadRequest, "bad stream id[%s]", args[1])
+	}
+	stream := c.session.Stream(uint32(id))
+	if stream == nil {
+		return 0, nil, apiErrorf(http.StatusNotFound, "session[%d/%d] %s", c.id, id, ErrNotFound)
+	}
+	status := sessionStatus(c, stream)
+	log.Warn("[%s] kicked by admin.", stream)
+	stream.Reset(errors.New("kicked by admin"))
+	return http.StatusOK, status, nil
+}
+
+// GET /api/v1/routes, POST /api/v1/routes
+func (s *Server) apiRoutes(r *http.Request, args []string) (int, interface{}, error) {
+	if r.Method == "POST" {
+		body := &apiRouteBody{}
+		if err := readJSON(r, body); err != nil {
+			return 0, nil, err
+		}
+		route := &body.Route
+		if s.findRoute(route.Name) != nil {
+			return 0, nil, apiErrorf(http.StatusConflict, "route[%s] already exists.", route.Name)
+		}
+		if err := s.AddRoute(route); err != nil {
+			return 0, nil, &httpError{http.StatusBadRequest, err}
+		}
+		// the server keep its own copy with Listen and Proto normalized
+		if added := s.findRoute(route.Name); added != nil {
+			route = added
+		}
+		return http.StatusCreated, s.routeStatus(route, nil), nil
+	}
+
+	sessions := s.sessions()
+	routes := []*apiRoute{}
+	for _, route := range s.Routes() {
+		routes = append(routes, s.routeStatus(route, sessions))
+	}
+	return http.StatusOK, routes, nil
+}
+
+// GET, PUT, DELETE /api/v1/routes/{name}
+func (s *Server) apiRoute(r *http.Request, args []string) (int, interface{}, error) {
+	name := args[0]
+	old := s.findRoute(name)
+	if old == nil {
+		return 0, nil, apiErrorf(http.StatusNotFound, "route[%s] %s", name, ErrNotFound)
+	}
+
+	switch r.Method {
+	case "PUT":
+		body := &apiRouteBody{}
+		if err := readJSON(r, body); err != nil {
+			return 0, nil, err
+		}
+		route := &body.Route
+		if route.Name == "" {
+			route.Name = name
+		}
+		if route.Name != name {
+			return 0, nil, apiErrorf(http.StatusBadRequest, "route name[%s] can not be changed to[%s].", name, route.Name)
+		}
+		// GET never show the passwords, a route read and put back keep its users
+		prev := old.clone()
+		if route.Auth == nil {
+			route.Auth = prev.Auth
+			if route.AuthMode == "" {
+				route.AuthMode = prev.AuthMode
+			}
+		}
+		if route.VHosts == nil {
+			route.VHosts = prev.VHosts
+		}
+		if err := s.UpdateRoute(route); err != nil {
+			return 0, nil, &httpError{http.StatusBadRequest, err}
+		}
+		if updated := s.findRoute(name); updated != nil {
+			route = updated
+		}
+		return http.StatusOK, s.routeStatus(route, s.sessions()), nil
+	case "DELETE":
+		status := s.routeStatus(old, s.sessions())
+		if err := s.RemoveRoute(name); err != nil {
+			return 0, nil, apiErrorf(http.StatusNotFound, "%s", err.Error())
+		}
+		return http.StatusOK, status, nil
+	}
+	return http.StatusOK, s.routeStatus(old, s.sessions()), nil
+}
+
+func siteStatusOf(site *siteStatus) *apiSite {
+	return &apiSite{
+		Site:          site.Site,
+		Tunnels:       site.Tunnels,
+		Streams:       site.Streams,
+		LocalHostServ: site.LocalHostServ,
+		Routes:        append([]string{}, site.Routes...),
+	}
+}
+
+// GET /api/v1/sites
+func (s *Server) apiSites(r *http.Request, args []string) (int, interface{}, error) {
+	sites := []*apiSite{}
+	for _, site := range s.sitesStatus() {
+		sites = append(sites, siteStatusOf(site))
+	}
+	return http.StatusOK, sites, nil
+}
+
+// GET, PUT /api/v1/sites/{site}
+func (s *Server) apiSite(r *http.Request, args []string) (int, interface{}, error) {
+	name := args[0]
+	if r.Method == "PUT" {
+		conf := &apiSiteConfig{}
+		if err := readJSON(r, conf); err != nil {
+			return 0, nil, err
+		}
+		if _, _, err := net.SplitHostPort(conf.LocalHostServ); err != nil {
+			return 0, nil, apiErrorf(http.StatusBadRequest, "bad LocalHostServ[%s], must be ip:port.", conf.LocalHostServ)
+		}
+		if err := s.setSiteConfig(name, conf.LocalHostServ); err != nil {
+			return 0, nil, &httpError{http.StatusConflict, err}
+		}
+		// the clients answer by Msg_Get_Config, the status may still be the old one
+		return http.StatusAccepted, &apiSiteConfig{LocalHostServ: conf.LocalHostServ}, nil
+	}
+
+	for _, site := range s.sitesStatus() {
+		if site.Site == name {
+			return http.StatusOK, siteStatusOf(site), nil
+		}
+	}
+	return 0, nil, apiErrorf(http.StatusNotFound, "site[%s] %s", name, ErrNotFound)
+}
+
+// GET /api/v1/logs[?after=seq]
+func (s *Server) apiLogs(r *http.Request, args []string) (int, interface{}, error) {
+	if s.logs == nil {
+		return 0, nil, apiErrorf(http.StatusNotFound, "log viewer is not enabled.")
+	}
+	var after uint64
+	if v := r.FormValue("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return 0, nil, apiErrorf(http.StatusBadRequest, "bad after[%s]", v)
+		}
+	}
+	logs := &apiLogs{Lines: s.logs.Lines(after), Last: s.logs.Last()}
+	if n := len(logs.Lines); n > 0 {
+		logs.Last = logs.Lines[n-1].Seq
+	} else {
+		logs.Lines = []log.Line{}
+	}
+	return http.StatusOK, logs, nil
+}
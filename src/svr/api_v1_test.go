@@ -0,0 +1,195 @@
+package svr
+
+import (
+	"encoding/json"
+	"libs/log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func apiDo(t *testing.T, s *Server, method, path, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	var r *http.Request
+	if body == "" {
+		r = httptest.NewRequest(method, API_V1_URI+path, nil)
+	} else {
+		r = httptest.NewRequest(method, API_V1_URI+path, strings.NewReader(body))
+	}
+	if method != "GET" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	s.ServeMux().ServeHTTP(w, r)
+	var v map[string]interface{}
+	if strings.HasPrefix(strings.TrimSpace(w.Body.String()), "{") {
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+			t.Fatal(method, path, "bad json", err, w.Body.String())
+		}
+	}
+	return w, v
+}
+
+func TestAPIV1Routes(t *testing.T) {
+	s := newTestServer(t)
+	defer s.RemoveRoute("cam")
+
+	w, v := apiDo(t, s, "POST", "routes", `{"Name":"cam","Listen":"127.0.0.1:0","Target":"192.168.1.10:80","Auth":["bob:secret"]}`)
+	if w.Code != http.StatusCreated || v["Name"] != "cam" || v["Addr"] == "" {
+		t.Fatal("create route", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Fatal("password leaked", w.Body.String())
+	}
+	if w, _ := apiDo(t, s, "POST", "routes", `{"Name":"cam","Listen":"127.0.0.1:0"}`); w.Code != http.StatusConflict {
+		t.Fatal("want 409 for a duplicate route, got", w.Code)
+	}
+	if w, _ := apiDo(t, s, "POST", "routes", `{"Name":`); w.Code != http.StatusBadRequest {
+		t.Fatal("want 400 for bad json, got", w.Code)
+	}
+
+	w, v = apiDo(t, s, "PUT", "routes/cam", `{"Listen":"127.0.0.1:0","Target":"192.168.1.11:80"}`)
+	if w.Code != http.StatusOK || v["Target"] != "192.168.1.11:80" {
+		t.Fatal("update route", w.Code, w.Body.String())
+	}
+	// Auth omitted, the users are kept
+	if route := s.findRoute("cam"); route == nil || len(route.Auth) != 1 {
+		t.Fatal("auth lost by update", route)
+	}
+	if w, _ := apiDo(t, s, "PUT", "routes/cam", `{"Name":"other","Listen":"127.0.0.1:0"}`); w.Code != http.StatusBadRequest {
+		t.Fatal("want 400 for renaming, got", w.Code)
+	}
+
+	// a route read by GET and put back keep its users
+	w, _ = apiDo(t, s, "GET", "routes/cam", "")
+	got := w.Body.String()
+	if w, _ := apiDo(t, s, "PUT", "routes/cam", got); w.Code != http.StatusOK {
+		t.Fatal("put back the route read by GET", w.Code, w.Body.String())
+	}
+	if route := s.findRoute("cam"); route == nil || len(route.Auth) != 1 || route.Target != "192.168.1.11:80" {
+		t.Fatal("route changed by GET and PUT", route)
+	}
+
+	w, _ = apiDo(t, s, "GET", "routes", "")
+	var routes []*apiRoute
+	if err := json.Unmarshal(w.Body.Bytes(), &routes); err != nil || len(routes) != 1 || routes[0].AuthUsers[0] != "bob" {
+		t.Fatal("list routes", err, w.Body.String())
+	}
+
+	if w, _ := apiDo(t, s, "DELETE", "routes/cam", ""); w.Code != http.StatusOK {
+		t.Fatal("delete route", w.Code)
+	}
+	if w, _ := apiDo(t, s, "GET", "routes/cam", ""); w.Code != http.StatusNotFound {
+		t.Fatal("want 404 after delete, got", w.Code)
+	}
+}
+
+func TestAPIV1Errors(t *testing.T) {
+	s := newTestServer(t)
+
+	cases := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "nothing", http.StatusNotFound},
+		{"GET", "tunnels/1/2", http.StatusNotFound},
+		{"POST", "health", http.StatusMethodNotAllowed},
+		{"DELETE", "tunnels/abc", http.StatusBadRequest},
+		{"DELETE", "tunnels/42", http.StatusNotFound},
+		{"DELETE", "sessions/42/1", http.StatusNotFound},
+		{"GET", "sites/nowhere", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w, v := apiDo(t, s, c.method, c.path, "")
+		if w.Code != c.code || v["Error"] == nil {
+			t.Error(c.method, c.path, "want", c.code, "got", w.Code, w.Body.String())
+		}
+	}
+	w, _ := apiDo(t, s, "PUT", "health", "")
+	if w.Header().Get("Allow") != "GET" {
+		t.Fatal("bad Allow header", w.Header())
+	}
+	if w, _ := apiDo(t, s, "PUT", "sites/default", `{"LocalHostServ":"no-port"}`); w.Code != http.StatusBadRequest {
+		t.Fatal("want 400 for a bad LocalHostServ, got", w.Code)
+	}
+}
+
+// TestAPIV1ContentType a cross-site <form enctype="text/plain"> must not change anything.
+func TestAPIV1ContentType(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, ctype := range []string{"text/plain", "application/x-www-form-urlencoded", ""} {
+		r := httptest.NewRequest("POST", API_V1_URI+"routes", strings.NewReader(`{"Name":"csrf","Listen":"127.0.0.1:0","x":"="}`))
+		if ctype != "" {
+			r.Header.Set("Content-Type", ctype)
+		}
+		w := httptest.NewRecorder()
+		s.ServeMux().ServeHTTP(w, r)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Error(ctype, "want 415, got", w.Code, w.Body.String())
+		}
+	}
+	if s.findRoute("csrf") != nil {
+		s.RemoveRoute("csrf")
+		t.Fatal("route added by a non-json body")
+	}
+
+	r := httptest.NewRequest("DELETE", API_V1_URI+"tunnels/1", nil)
+	w := httptest.NewRecorder()
+	s.ServeMux().ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatal("DELETE want 415 without Content-Type, got", w.Code)
+	}
+}
+
+func TestAPIV1Health(t *testing.T) {
+	s := newTestServer(t)
+
+	w, v := apiDo(t, s, "GET", "health", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Fatal("health", w.Code, w.Header())
+	}
+	if v["Tunnels"] != 0.0 || v["Sessions"] != 0.0 {
+		t.Fatal("bad health", w.Body.String())
+	}
+}
+
+func TestAPIV1Auth(t *testing.T) {
+	s, err := NewServer(&Config{AdminUsers: []string{"admin:secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, v := apiDo(t, s, "GET", "health", "")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" || v["Error"] == nil {
+		t.Fatal("want 401, got", w.Code, w.Header(), w.Body.String())
+	}
+
+	r := httptest.NewRequest("GET", API_V1_URI+"health", nil)
+	r.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	s.ServeMux().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("want 200 with the admin user, got", w.Code, w.Body.String())
+	}
+}
+
+func TestAPIV1Logs(t *testing.T) {
+	s := newTestServer(t)
+	if w, _ := apiDo(t, s, "GET", "logs", ""); w.Code != http.StatusNotFound {
+		t.Fatal("want 404 if no log viewer, got", w.Code)
+	}
+
+	h, _ := log.NewRingHandler(nil, 10)
+	s.SetLogViewer(h)
+	h.Write([]byte("[Info] one\n"))
+	h.Write([]byte("[Warn] two\n"))
+
+	w, v := apiDo(t, s, "GET", "logs?after=1", "")
+	if w.Code != http.StatusOK || v["Last"] != 2.0 || !strings.Contains(w.Body.String(), "two") || strings.Contains(w.Body.String(), "one") {
+		t.Fatal("bad logs", w.Code, w.Body.String())
+	}
+	if w, _ := apiDo(t, s, "GET", "logs?after=x", ""); w.Code != http.StatusBadRequest {
+		t.Fatal("want 400, got", w.Code)
+	}
+}
@@ -0,0 +1,261 @@
+/*
+	auth of the admin endpoints(/admin/, /api/) and the websocket tunnel.
+*/
+
+package svr
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"libs/log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Default_Max_Auth_Failures = 5
+	Default_Auth_Lockout      = 300 // seconds
+
+	anonymous_user = "anonymous"
+
+	audit_log_max_bytes    = 10 << 20
+	audit_log_backup_count = 5
+)
+
+var (
+	ErrNoCredentials  = errors.New("no credentials")
+	ErrBadCredentials = errors.New("username and password do not match")
+	ErrLockedOut      = errors.New("too many auth failures, try later")
+)
+
+// Authenticator check the credentials of a http request.
+type Authenticator interface {
+	// Authenticate return the user name if the request is allowed.
+	Authenticate(r *http.Request) (user string, err error)
+}
+
+// noAuth allow everyone, used when no user configured.
+type noAuth struct{}
+
+func (noAuth) Authenticate(r *http.Request) (string, error) {
+	return anonymous_user, nil
+}
+
+// basicAuth http Basic auth, the passwords are compared in constant time.
+type basicAuth struct {
+	users map[string][sha256.Size]byte // user -> SHA-256 of password
+}
+
+// newBasicAuth users are "username:password", noAuth is returned if users is empty.
+func newBasicAuth(users ...string) (Authenticator, error) {
+	auth := &basicAuth{users: make(map[string][sha256.Size]byte)}
+	for _, u := range users {
+		if u == "" {
+			continue
+		}
+		pos := strings.Index(u, ":")
+		if pos <= 0 {
+			return nil, fmt.Errorf("auth user must be username:password")
+		}
+		auth.users[u[:pos]] = sha256.Sum256([]byte(u[pos+1:]))
+	}
+	if len(auth.users) == 0 {
+		return noAuth{}, nil
+	}
+	return auth, nil
+}
+
+func (auth *basicAuth) Authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	// hash first, so the compare time not depend on the password length,
+	// and an unknown user cost the same as a wrong password.
+	got := sha256.Sum256([]byte(password))
+	want, find := auth.users[user]
+	if subtle.ConstantTimeCompare(got[:], want[:]) != 1 || !find {
+		return user, ErrBadCredentials
+	}
+	return user, nil
+}
+
+type failRecord struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// authLimiter lock the IP out after maxFailures continuous auth failures.
+type authLimiter struct {
+	maxFailures int
+	lockout     time.Duration
+
+	rw       *sync.Mutex
+	failures map[string]*failRecord // key is IP
+}
+
+func newAuthLimiter(maxFailures int, lockout time.Duration) *authLimiter {
+	if maxFailures <= 0 {
+		maxFailures = Default_Max_Auth_Failures
+	}
+	if lockout <= 0 {
+		lockout = Default_Auth_Lockout * time.Second
+	}
+	return &authLimiter{
+		maxFailures: maxFailures,
+		lockout:     lockout,
+		rw:          new(sync.Mutex),
+		failures:    make(map[string]*failRecord),
+	}
+}
+
+func (l *authLimiter) locked(ip string) bool {
+	l.rw.Lock()
+	defer l.rw.Unlock()
+	record, find := l.failures[ip]
+	return find && time.Now().Before(record.lockedUntil)
+}
+
+// fail return true if the IP is locked out by this failure.
+func (l *authLimiter) fail(ip string) bool {
+	l.rw.Lock()
+	defer l.rw.Unlock()
+
+	now := time.Now()
+	l.expire(now)
+
+	record, find := l.failures[ip]
+	if !find {
+		record = &failRecord{}
+		l.failures[ip] = record
+	}
+	record.count++
+	record.last = now
+	if record.count >= l.maxFailures {
+		record.count = 0
+		record.lockedUntil = now.Add(l.lockout)
+		return true
+	}
+	return false
+}
+
+func (l *authLimiter) success(ip string) {
+	l.rw.Lock()
+	defer l.rw.Unlock()
+	delete(l.failures, ip)
+}
+
+// expire remove the records older than lockout, must be called with the lock held.
+func (l *authLimiter) expire(now time.Time) {
+	for ip, record := range l.failures {
+		if now.Sub(record.last) > l.lockout && now.After(record.lockedUntil) {
+			delete(l.failures, ip)
+		}
+	}
+}
+
+func (s *Server) audit(ok bool, format string, v ...interface{}) {
+	format = "[audit] " + format
+	switch {
+	case s.auditLog != nil:
+		s.auditLog.Output(2, log.LevelInfo, format, v...)
+	case ok:
+		log.Info(format, v...)
+	default:
+		log.Warn(format, v...)
+	}
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// authenticate check the request by auth, write the 401/429 response if fail.
+// the failures are counted by l, s.limiter for the admin and s.routeLimiter for the routes.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, l *authLimiter, auth Authenticator, endpoint string) (string, bool) {
+	user, err := s.checkAuth(r, l, auth, endpoint)
+	switch err {
+	case nil:
+		return user, true
+	case ErrLockedOut:
+		lockedResponse(w, l)
+	default:
+		noAuthResponse(w)
+	}
+	return "", false
+}
+
+// checkAuth is authenticate without the response, the failure is counted and audited.
+func (s *Server) checkAuth(r *http.Request, l *authLimiter, auth Authenticator, endpoint string) (string, error) {
+	ip := remoteIP(r)
+	if l.locked(ip) {
+		s.audit(false, "%s %s from[%s] rejected, locked out", endpoint, r.URL.Path, ip)
+		return "", ErrLockedOut
+	}
+
+	user, err := auth.Authenticate(r)
+	if err != nil {
+		if err != ErrNoCredentials {
+			locked := l.fail(ip)
+			s.audit(false, "%s %s from[%s] user[%s] auth fail, err=%s locked[%v]", endpoint, r.URL.Path, ip, user, err.Error(), locked)
+		}
+		return "", err
+	}
+
+	l.success(ip)
+	s.audit(true, "%s %s %s from[%s] user[%s] auth ok", endpoint, r.Method, r.URL.Path, ip, user)
+	return user, nil
+}
+
+func lockedResponse(w http.ResponseWriter, l *authLimiter) {
+	setSTDheader(w)
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(l.lockout.Seconds())))
+	w.WriteHeader(429)
+	w.Write([]byte(`429: ` + ErrLockedOut.Error()))
+}
+
+// initAuth build the authenticators from the config.
+func (s *Server) initAuth() error {
+	conf := s.conf
+	auth, err := newBasicAuth(append([]string{conf.Auth}, conf.AdminUsers...)...)
+	if err != nil {
+		return err
+	}
+	s.adminAuth = auth
+	s.limiter = newAuthLimiter(conf.MaxAuthFailures, time.Duration(conf.AuthLockout)*time.Second)
+	s.routeLimiter = newAuthLimiter(conf.MaxAuthFailures, time.Duration(conf.AuthLockout)*time.Second)
+
+	if conf.AuditLogFile != "" {
+		h, err := log.NewRotatingFileHandler(conf.AuditLogFile, audit_log_max_bytes, audit_log_backup_count)
+		if err != nil {
+			return err
+		}
+		s.auditLog = log.New(h, log.Ltime)
+	}
+
+	if _, ok := auth.(noAuth); ok {
+		log.Warn("no admin user configured, /admin/ and /api/ are open to everyone.")
+	}
+	return nil
+}
+
+// SetAdminAuthenticator replace the users of Config.Auth and Config.AdminUsers by auth,
+// it check /admin/, /api/ and the tunnels when no CredentialFile.
+// Call it before Start.
+func (s *Server) SetAdminAuthenticator(auth Authenticator) {
+	if auth == nil {
+		panic("admin authenticator is nil.")
+	}
+	s.adminAuth = auth
+	log.Info("admin authenticator replaced by [%T].", auth)
+}
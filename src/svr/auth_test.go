@@ -0,0 +1,117 @@
+package svr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBasicAuth(t *testing.T) {
+	auth, err := newBasicAuth("admin:secret", "ops:pass:word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"admin", "secret", true},
+		{"ops", "pass:word", true},
+		{"admin", "secret1", false},
+		{"admin", "", false},
+		{"nobody", "secret", false},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/api/", nil)
+		r.SetBasicAuth(c.user, c.password)
+		_, err := auth.Authenticate(r)
+		if (err == nil) != c.ok {
+			t.Errorf("%s:%s want ok[%v], err=%v", c.user, c.password, c.ok, err)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/api/", nil)
+	if _, err := auth.Authenticate(r); err != ErrNoCredentials {
+		t.Fatal("want ErrNoCredentials, got", err)
+	}
+
+	if _, err := newBasicAuth("no-password"); err == nil {
+		t.Fatal("want error of bad user format")
+	}
+	if auth, _ := newBasicAuth(""); auth != (noAuth{}) {
+		t.Fatal("empty user want noAuth")
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	auth, _ := newBasicAuth("admin:secret")
+	s := &Server{limiter: newAuthLimiter(3, time.Minute)}
+
+	request := func(password string) int {
+		r := httptest.NewRequest("GET", "/api/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.SetBasicAuth("admin", password)
+		w := httptest.NewRecorder()
+		s.authenticate(w, r, s.limiter, auth, "test")
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := request("bad"); code != 401 {
+			t.Fatal("want 401, got", code)
+		}
+	}
+	// locked, even the right password
+	if code := request("secret"); code != 429 {
+		t.Fatal("want 429, got", code)
+	}
+
+	s.limiter.success("10.0.0.1")
+	if code := request("secret"); code != 200 {
+		t.Fatal("want 200, got", code)
+	}
+}
+
+// headerAuth a custom authenticator, the user is in the X-User header.
+type headerAuth struct {
+	calls int
+}
+
+func (a *headerAuth) Authenticate(r *http.Request) (string, error) {
+	a.calls++
+	if user := r.Header.Get("X-User"); user == "ops" {
+		return user, nil
+	}
+	return "", ErrNoCredentials
+}
+
+func TestSetAdminAuthenticator(t *testing.T) {
+	// the config users are replaced, not added to
+	s, err := NewServer(&Config{Auth: "admin:secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &headerAuth{}
+	s.SetAdminAuthenticator(auth)
+
+	get := func(path string, set func(r *http.Request)) int {
+		r := httptest.NewRequest("GET", path, nil)
+		set(r)
+		w := httptest.NewRecorder()
+		s.ServeMux().ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := get("/api/v1/health", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }); code != http.StatusUnauthorized {
+		t.Fatal("config user want 401, got", code)
+	}
+	for _, path := range []string{"/api/v1/health", "/admin/", "/api/routes"} {
+		if code := get(path, func(r *http.Request) { r.Header.Set("X-User", "ops") }); code != http.StatusOK {
+			t.Error(path, "want 200 by the custom authenticator, got", code)
+		}
+	}
+	if auth.calls != 4 {
+		t.Fatal("custom authenticator want 4 calls, got", auth.calls)
+	}
+}
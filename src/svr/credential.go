@@ -0,0 +1,186 @@
+/*
+	per-client credentials of the websocket tunnel, stored in Config.CredentialFile.
+	the client prove it has the token by HMAC challenge-response, the token never goes over the wire.
+*/
+
+package svr
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"ctrl"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"libs/log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	token_bytes = 32
+	nonce_bytes = 32
+)
+
+type Credential struct {
+	Name    string    `json:"Name"`
+	Token   string    `json:"Token"` // HMAC secret, only shown once when added
+	Site    string    `json:"Site"`  // the client is bound to the site, empty is ctrl.DEFAULT_SITE
+	Created time.Time `json:"Created"`
+}
+
+type credentialStore struct {
+	file  string // empty is token auth disabled
+	creds map[string]*Credential
+	rw    *sync.RWMutex
+}
+
+func newCredentialStore() *credentialStore {
+	return &credentialStore{
+		creds: make(map[string]*Credential),
+		rw:    new(sync.RWMutex),
+	}
+}
+
+// load enable token auth of the tunnel, the file is created if not exists.
+func (store *credentialStore) load(file string) error {
+	store.rw.Lock()
+	defer store.rw.Unlock()
+
+	store.file = file
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		log.Warn("credential file[%s] not exists, add client by /api/cred/add.", file)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var creds []*Credential
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return fmt.Errorf("%s: %s", file, err.Error())
+	}
+	for _, cred := range creds {
+		store.creds[cred.Name] = cred
+	}
+	log.Info("load [%d] credentials from[%s]", len(creds), file)
+	return nil
+}
+
+func (store *credentialStore) enabled() bool {
+	store.rw.RLock()
+	defer store.rw.RUnlock()
+	return store.file != ""
+}
+
+// save must be called with the lock held.
+func (store *credentialStore) save() error {
+	creds := make([]*Credential, 0, len(store.creds))
+	for _, cred := range store.creds {
+		creds = append(creds, cred)
+	}
+	sort.Slice(creds, func(i, j int) bool { return creds[i].Name < creds[j].Name })
+
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(store.file, data, 0600)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// AddCredential create a client with a new random token.
+func (s *Server) AddCredential(name, site string) (*Credential, error) {
+	if name == "" {
+		return nil, fmt.Errorf("credential name can not be empty.")
+	}
+	if site == "" {
+		site = ctrl.DEFAULT_SITE
+	}
+	token, err := randomHex(token_bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	s.creds.rw.Lock()
+	defer s.creds.rw.Unlock()
+
+	if s.creds.file == "" {
+		return nil, fmt.Errorf("token auth is disabled, set CredentialFile in the config.")
+	}
+	if _, find := s.creds.creds[name]; find {
+		return nil, fmt.Errorf("credential[%s] already exists.", name)
+	}
+	cred := &Credential{Name: name, Token: token, Site: site, Created: time.Now()}
+	s.creds.creds[name] = cred
+	if err := s.creds.save(); err != nil {
+		delete(s.creds.creds, name)
+		return nil, err
+	}
+	log.Info("credential[%s] of site[%s] added.", name, site)
+	return cred, nil
+}
+
+// RevokeCredential delete the credential and close its online tunnels.
+func (s *Server) RevokeCredential(name string) error {
+	s.creds.rw.Lock()
+	if _, find := s.creds.creds[name]; !find {
+		s.creds.rw.Unlock()
+		return fmt.Errorf("credential[%s] not found.", name)
+	}
+	delete(s.creds.creds, name)
+	err := s.creds.save()
+	s.creds.rw.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, cli := range s.clientsOfCredential(name) {
+		log.Warn("credential[%s] revoked, close tunnel[%s].", name, cli)
+		go cli.session.CloseWithCode(ctrl.Close_Auth_Revoked, "credential revoked")
+	}
+	log.Info("credential[%s] revoked.", name)
+	return nil
+}
+
+// Credentials return all credentials order by name, the tokens are removed.
+func (s *Server) Credentials() []*Credential {
+	s.creds.rw.RLock()
+	defer s.creds.rw.RUnlock()
+
+	creds := make([]*Credential, 0, len(s.creds.creds))
+	for _, cred := range s.creds.creds {
+		c := *cred
+		c.Token = ""
+		creds = append(creds, &c)
+	}
+	sort.Slice(creds, func(i, j int) bool { return creds[i].Name < creds[j].Name })
+	return creds
+}
+
+// verify return the credential if the MAC of the nonce is right.
+func (store *credentialStore) verify(resp *ctrl.AuthResponse, nonce string) (*Credential, error) {
+	store.rw.RLock()
+	cred, find := store.creds[resp.Name]
+	store.rw.RUnlock()
+
+	if !find {
+		return nil, fmt.Errorf("credential[%s] not found.", resp.Name)
+	}
+	want := ctrl.AuthMAC(cred.Token, nonce)
+	if !hmac.Equal([]byte(want), []byte(resp.MAC)) {
+		return nil, fmt.Errorf("credential[%s] MAC not match.", resp.Name)
+	}
+	return cred, nil
+}
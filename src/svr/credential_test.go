@@ -0,0 +1,217 @@
+package svr
+
+import (
+	"cli"
+	"context"
+	"ctrl"
+	"encoding/json"
+	"io/ioutil"
+	"libs/websocket"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCredTestServer(t *testing.T) *Server {
+	dir, err := ioutil.TempDir("", "cred_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := NewServer(&Config{
+		WebsocketListen: "127.0.0.1:0",
+		CredentialFile:  filepath.Join(dir, "creds.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCredentialFile(t *testing.T) {
+	s := newCredTestServer(t)
+	cred, err := s.AddCredential("home1", "office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddCredential("home1", ""); err == nil {
+		t.Fatal("want error of a duplicate credential")
+	}
+
+	info, err := os.Stat(s.conf.CredentialFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatal("the tokens must be readable only by the owner, mode", mode)
+	}
+
+	// reload from the file
+	store := newCredentialStore()
+	if err := store.load(s.conf.CredentialFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.creds["home1"]; got == nil || got.Token != cred.Token || got.Site != "office" {
+		t.Fatal("credential not saved", got)
+	}
+	for _, c := range s.Credentials() {
+		if c.Token != "" {
+			t.Fatal("token shown by Credentials", c)
+		}
+	}
+}
+
+func TestCredentialVerify(t *testing.T) {
+	s := newCredTestServer(t)
+	cred, _ := s.AddCredential("home1", "")
+
+	cases := []struct {
+		name, token string
+		ok          bool
+	}{
+		{"home1", cred.Token, true},
+		{"home1", "bad-token", false},
+		{"nobody", cred.Token, false},
+	}
+	for _, c := range cases {
+		resp := &ctrl.AuthResponse{Name: c.name, MAC: ctrl.AuthMAC(c.token, "nonce")}
+		got, err := s.creds.verify(resp, "nonce")
+		if (err == nil) != c.ok || (c.ok && got.Site != ctrl.DEFAULT_SITE) {
+			t.Error(c.name, "want ok", c.ok, "got", got, err)
+		}
+	}
+	// the MAC of an old nonce can not be replayed
+	resp := &ctrl.AuthResponse{Name: "home1", MAC: ctrl.AuthMAC(cred.Token, "nonce")}
+	if _, err := s.creds.verify(resp, "other-nonce"); err == nil {
+		t.Fatal("want error of a replayed MAC")
+	}
+}
+
+func TestChallengeClient(t *testing.T) {
+	s := newCredTestServer(t)
+	cred, _ := s.AddCredential("home1", "office")
+
+	// answer build the reply of the client from the nonce
+	cases := []struct {
+		answer func(nonce string) *ctrl.WebSocketControlFrame
+		ok     bool
+	}{
+		{func(nonce string) *ctrl.WebSocketControlFrame {
+			resp, _ := json.Marshal(&ctrl.AuthResponse{Name: "home1", MAC: ctrl.AuthMAC(cred.Token, nonce)})
+			return &ctrl.WebSocketControlFrame{Type: ctrl.Msg_Auth_Response, Content: string(resp)}
+		}, true},
+		{func(nonce string) *ctrl.WebSocketControlFrame {
+			resp, _ := json.Marshal(&ctrl.AuthResponse{Name: "home1", MAC: ctrl.AuthMAC("", nonce)})
+			return &ctrl.WebSocketControlFrame{Type: ctrl.Msg_Auth_Response, Content: string(resp)}
+		}, false},
+		{func(nonce string) *ctrl.WebSocketControlFrame {
+			return &ctrl.WebSocketControlFrame{Type: ctrl.Msg_Get_Config, Content: "10.0.0.1:80"}
+		}, false},
+	}
+	for i, c := range cases {
+		c1, c2 := net.Pipe()
+		server, client := websocket.NewConn(c1, true), websocket.NewConn(c2, false)
+		go func() {
+			_, msg, err := client.Read()
+			if err != nil {
+				return
+			}
+			challenge := ctrl.WebSocketControlFrame{}
+			json.Unmarshal(msg, &challenge)
+			if challenge.Type != ctrl.Msg_Auth_Challenge || len(challenge.Content) != nonce_bytes*2 {
+				t.Error("bad challenge", string(msg))
+			}
+			client.WriteString(c.answer(challenge.Content).Bytes())
+		}()
+
+		got, err := s.challengeClient(server)
+		if (err == nil) != c.ok || (c.ok && got.Site != "office") {
+			t.Error(i, "want ok", c.ok, "got", got, err)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+// waitAgentStop return false if the agent still reconnecting after timeout.
+func waitAgentStop(agent *cli.Agent, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		agent.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func waitTunnels(t *testing.T, s *Server, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.NumTunnels() != n {
+		if time.Now().After(deadline) {
+			t.Fatal("want tunnels", n, "got", s.NumTunnels())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestRevokeCredential the tunnel is closed by Close_Auth_Revoked and the agent stop reconnecting.
+func TestRevokeCredential(t *testing.T) {
+	s := newCredTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	cred, _ := s.AddCredential("home1", "")
+
+	agent, err := cli.NewAgent(&cli.Config{ForwardServ: s.Addr().String(), ClientName: "home1", Token: cred.Token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.Start()
+	defer agent.Shutdown(context.Background())
+	waitTunnels(t, s, 1)
+
+	if err := s.RevokeCredential("home1"); err != nil {
+		t.Fatal(err)
+	}
+	waitTunnels(t, s, 0)
+	if !waitAgentStop(agent, 5*time.Second) {
+		t.Fatal("agent still reconnecting after the credential revoked")
+	}
+	if err := s.RevokeCredential("home1"); err == nil {
+		t.Fatal("want error of revoking twice")
+	}
+}
+
+// TestAgentNoToken a server of token auth never accept the agent without token, it must not retry.
+func TestAgentNoToken(t *testing.T) {
+	s := newCredTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	agent, err := cli.NewAgent(&cli.Config{ForwardServ: s.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.Start()
+	defer agent.Shutdown(context.Background())
+	if !waitAgentStop(agent, 5*time.Second) {
+		t.Fatal("agent without token still reconnecting")
+	}
+	if s.NumTunnels() != 0 {
+		t.Fatal("tunnel accepted without token")
+	}
+
+	if _, err := cli.NewAgent(&cli.Config{ClientName: "home1"}); err == nil {
+		t.Fatal("want error of ClientName without Token")
+	}
+}
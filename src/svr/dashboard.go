@@ -0,0 +1,46 @@
+/*
+	dashboard of the relay at /admin/, the static assets are built into the binary,
+	the page read and change everything by /api/v1/ with the admin's auth.
+*/
+
+package svr
+
+import (
+	"embed"
+	"io/fs"
+	"libs/log"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboard_assets embed.FS
+
+var dashboard_files = func() http.Handler {
+	sub, err := fs.Sub(dashboard_assets, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix(WEBSOCKET_CONTORL_URI, http.FileServer(http.FS(sub)))
+}()
+
+// URI: /admin/
+func (s *Server) httpAdminHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info("admin Handler: %s %s %s", r.Method, r.URL.RequestURI(), r.RemoteAddr)
+
+	if _, ok := s.authenticate(w, r, s.limiter, s.adminAuth, "admin"); !ok {
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// no inline script, no other origin, not framed
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "DENY")
+	// a new binary may bring new assets
+	w.Header().Set("Cache-Control", "no-cache")
+	dashboard_files.ServeHTTP(w, r)
+}
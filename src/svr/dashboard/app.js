@@ -0,0 +1,408 @@
+/*
+	dashboard of the relay, everything is read and changed by the JSON API /api/v1/,
+	the browser send the Basic auth of this page with the requests.
+*/
+
+'use strict';
+
+const API = '/api/v1/';
+const POLL_INTERVAL = 2000; // ms
+const GRAPH_POINTS = 60;    // 2 minutes of the throughput
+const LOG_MAX_LINES = 2000;
+const LOG_LEVELS = ['Trace', 'Debug', 'Info', 'Warn', 'Error', 'Fatal'];
+
+async function api(method, path, body) {
+	const opt = { method: method, headers: {}, credentials: 'same-origin', cache: 'no-store' };
+	if (method !== 'GET') {
+		// the API refuse the other types, a cross-site form can not send this one
+		opt.headers['Content-Type'] = 'application/json';
+	}
+	if (body !== undefined) {
+		opt.body = JSON.stringify(body);
+	}
+	const resp = await fetch(API + path, opt);
+	let data = null;
+	try {
+		data = await resp.json();
+	} catch (e) {
+	}
+	if (!resp.ok) {
+		const err = new Error((data && data.Error) || resp.status + ' ' + resp.statusText);
+		err.status = resp.status;
+		throw err;
+	}
+	return data;
+}
+
+// el('td', {className: 'num'}, 'text', child...), the text is never parsed as HTML.
+function el(tag, attrs, ...children) {
+	const e = document.createElement(tag);
+	Object.assign(e, attrs || {});
+	for (const c of children) {
+		if (c !== null && c !== undefined) {
+			e.append(c instanceof Node ? c : String(c));
+		}
+	}
+	return e;
+}
+
+function button(text, onclick, className) {
+	return el('button', { type: 'button', className: className || '', onclick: onclick }, text);
+}
+
+function fmtBytes(n) {
+	const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return (i === 0 ? n : n.toFixed(1)) + ' ' + units[i];
+}
+
+function fmtRate(n) {
+	return fmtBytes(Math.round(n)) + '/s';
+}
+
+function fmtDuration(sec) {
+	sec = Math.floor(sec);
+	if (sec < 60) return sec + 's';
+	if (sec < 3600) return Math.floor(sec / 60) + 'm' + (sec % 60) + 's';
+	if (sec < 86400) return Math.floor(sec / 3600) + 'h' + Math.floor(sec % 3600 / 60) + 'm';
+	return Math.floor(sec / 86400) + 'd' + Math.floor(sec % 86400 / 3600) + 'h';
+}
+
+function showError(err) {
+	const box = document.getElementById('error');
+	if (!err) {
+		box.hidden = true;
+		return;
+	}
+	box.textContent = err.status === 401 ? 'Not authenticated, reload the page and log in again.' : String(err.message || err);
+	box.hidden = false;
+}
+
+function fillTable(section, rows, columns) {
+	const tbody = document.querySelector('#' + section + ' tbody');
+	if (rows.length === 0) {
+		rows = [el('tr', null, el('td', { className: 'empty', colSpan: columns }, 'none'))];
+	}
+	tbody.replaceChildren(...rows);
+}
+
+// editing is true if the user is typing in the section, it is not redrawn then.
+function editing(section) {
+	const active = document.activeElement;
+	return active && active.tagName === 'INPUT' && document.getElementById(section).contains(active);
+}
+
+async function act(what, fn) {
+	try {
+		await fn();
+		showError(null);
+		refresh();
+	} catch (err) {
+		alert(what + ' fail: ' + err.message);
+	}
+}
+
+/* rates: the bytes of the last poll, keyed by tunnel or session */
+
+const counters = new Map();
+
+function rate(key, bytesIn, bytesOut, now) {
+	let c = counters.get(key);
+	if (!c) {
+		c = { bytesIn: bytesIn, bytesOut: bytesOut, at: now, in: [], out: [], seen: now };
+		counters.set(key, c);
+		return c;
+	}
+	const sec = (now - c.at) / 1000;
+	if (sec > 0) {
+		c.in.push(Math.max(0, bytesIn - c.bytesIn) / sec);
+		c.out.push(Math.max(0, bytesOut - c.bytesOut) / sec);
+		if (c.in.length > GRAPH_POINTS) {
+			c.in.shift();
+			c.out.shift();
+		}
+	}
+	c.bytesIn = bytesIn;
+	c.bytesOut = bytesOut;
+	c.at = now;
+	c.seen = now;
+	return c;
+}
+
+function forgetRates(now) {
+	for (const [key, c] of counters) {
+		if (c.seen !== now) counters.delete(key);
+	}
+}
+
+function last(a) {
+	return a.length ? a[a.length - 1] : 0;
+}
+
+function graph(c) {
+	const w = 180, h = 36, ratio = window.devicePixelRatio || 1;
+	const canvas = el('canvas', { width: w * ratio, height: h * ratio });
+	canvas.style.width = w + 'px';
+	canvas.style.height = h + 'px';
+	canvas.title = 'in ' + fmtRate(last(c.in)) + ', out ' + fmtRate(last(c.out));
+
+	const ctx = canvas.getContext('2d');
+	ctx.scale(ratio, ratio);
+	ctx.fillStyle = '#f4f6f9';
+	ctx.fillRect(0, 0, w, h);
+	const max = Math.max(1024, ...c.in, ...c.out);
+	const line = (points, color) => {
+		ctx.strokeStyle = color;
+		ctx.lineWidth = 1.5;
+		ctx.beginPath();
+		points.forEach((v, i) => {
+			const x = w - (points.length - 1 - i) * (w / (GRAPH_POINTS - 1));
+			const y = h - 2 - (v / max) * (h - 4);
+			i === 0 ? ctx.moveTo(x, y) : ctx.lineTo(x, y);
+		});
+		ctx.stroke();
+	};
+	line(c.in, '#2a7ae2');
+	line(c.out, '#e2762a');
+	ctx.fillStyle = '#666';
+	ctx.font = '10px sans-serif';
+	ctx.fillText(fmtRate(max), 2, 10);
+	return canvas;
+}
+
+/* sections */
+
+function renderHealth(h) {
+	const offline = h.OfflineSites && h.OfflineSites.length ? 'offline: ' + h.OfflineSites.join(' ') : null;
+	document.getElementById('health').replaceChildren(
+		el('span', { className: 'badge ' + h.Status }, h.Status),
+		el('span', null, 'up ' + fmtDuration(h.Uptime)),
+		el('span', null, h.Tunnels + ' tunnels'),
+		el('span', null, h.Sessions + ' sessions'),
+		el('span', null, h.Routes + ' routes'),
+		offline && el('span', null, offline));
+}
+
+function renderTunnels(tunnels, now) {
+	fillTable('tunnels', tunnels.map(t => {
+		const c = rate('t' + t.ID, t.BytesIn, t.BytesOut, now);
+		return el('tr', { className: t.Draining ? 'draining' : '' },
+			el('td', { className: 'num' }, t.ID),
+			el('td', null, t.Site),
+			el('td', null, t.Addr),
+			el('td', null, t.Credential || ''),
+			el('td', null, t.LocalHostServ),
+			el('td', null, fmtDuration(t.Uptime)),
+			el('td', { className: 'num' }, t.Streams),
+			el('td', { className: 'num' }, fmtBytes(t.BytesIn)),
+			el('td', { className: 'num' }, fmtBytes(t.BytesOut)),
+			el('td', { className: 'num' }, fmtRate(last(c.in)) + ' / ' + fmtRate(last(c.out))),
+			el('td', { className: 'num' }, t.RTT ? Math.round(t.RTT * 1000) + 'ms' : '-'),
+			el('td', null, button('Kick', () => {
+				if (confirm('Kick tunnel ' + t.ID + ' of ' + t.Addr + '? The client reconnect later.')) {
+					act('kick tunnel', () => api('DELETE', 'tunnels/' + t.ID));
+				}
+			}, 'danger')));
+	}), 12);
+}
+
+function renderSessions(sessions, now) {
+	fillTable('sessions', sessions.map(s => {
+		const c = rate('s' + s.Tunnel + '/' + s.Stream, s.BytesIn, s.BytesOut, now);
+		let route = s.Route;
+		if (s.Reverse) route += ' (reverse)';
+		if (s.Proxy) route += ' (proxy)';
+		return el('tr', null,
+			el('td', { className: 'num' }, s.Tunnel + '/' + s.Stream),
+			el('td', null, route),
+			el('td', null, s.Target || 'LAN server'),
+			el('td', null, s.Peer),
+			el('td', null, fmtDuration(s.Uptime)),
+			el('td', { className: 'num' }, fmtBytes(s.BytesIn)),
+			el('td', { className: 'num' }, fmtBytes(s.BytesOut)),
+			el('td', null, graph(c)),
+			el('td', null, button('Kick', () => {
+				act('kick session', () => api('DELETE', 'sessions/' + s.Tunnel + '/' + s.Stream));
+			}, 'danger')));
+	}), 9);
+}
+
+function renderRoutes(routes) {
+	fillTable('routes', routes.map(r => {
+		let auth = '';
+		if (r.AuthUsers && r.AuthUsers.length) {
+			auth = (r.AuthMode || 'basic') + ': ' + r.AuthUsers.join(' ');
+		}
+		let target = r.Target || 'LAN server';
+		if (r.VHosts && r.VHosts.length) {
+			target = r.VHosts.map(v => v.Host + '->' + (v.Target || 'LAN server')).join(' ');
+		}
+		return el('tr', null,
+			el('td', null, r.Name),
+			el('td', null, r.Proto),
+			el('td', { title: r.Listen }, r.Addr || r.Listen),
+			el('td', null, target),
+			el('td', null, r.Site),
+			el('td', null, auth),
+			el('td', { className: 'num' }, r.Sessions),
+			el('td', null,
+				button('Edit', () => editRoute(r)),
+				' ',
+				button('Delete', () => {
+					if (confirm('Delete route ' + r.Name + '? Its connections are closed.')) {
+						act('delete route', () => api('DELETE', 'routes/' + encodeURIComponent(r.Name)));
+					}
+				}, 'danger')));
+	}), 8);
+}
+
+const routeForm = document.getElementById('route-form');
+
+function editRoute(r) {
+	const f = routeForm.elements;
+	f.Name.value = r.Name;
+	f.Name.readOnly = true;
+	f.Proto.value = r.Proto;
+	f.Listen.value = r.Listen;
+	f.Target.value = r.Target;
+	f.Site.value = r.Site;
+	f.AuthMode.value = r.AuthMode === 'cookie' ? 'cookie' : '';
+	f.Auth.value = '';
+	document.getElementById('route-form-title').textContent = 'Edit route ' + r.Name;
+	routeForm.scrollIntoView({ behavior: 'smooth' });
+}
+
+function resetRouteForm() {
+	routeForm.reset();
+	routeForm.elements.Name.readOnly = false;
+	document.getElementById('route-form-title').textContent = 'Add route';
+}
+
+routeForm.addEventListener('submit', ev => {
+	ev.preventDefault();
+	const f = routeForm.elements;
+	const route = {
+		Name: f.Name.value.trim(),
+		Proto: f.Proto.value,
+		Listen: f.Listen.value.trim(),
+		Target: f.Target.value.trim(),
+		Site: f.Site.value.trim(),
+		AuthMode: f.AuthMode.value,
+	};
+	const users = f.Auth.value.split('\n').map(s => s.trim()).filter(s => s);
+	if (users.length) route.Auth = users;
+	const update = f.Name.readOnly;
+	act(update ? 'update route' : 'add route', async () => {
+		if (update) {
+			await api('PUT', 'routes/' + encodeURIComponent(route.Name), route);
+		} else {
+			await api('POST', 'routes', route);
+		}
+		resetRouteForm();
+	});
+});
+document.getElementById('route-form-cancel').addEventListener('click', resetRouteForm);
+
+function renderSites(sites) {
+	fillTable('sites', sites.map(s => {
+		const input = el('input', { value: s.LocalHostServ, placeholder: 'ip:port', size: 22 });
+		const push = () => {
+			const svr = input.value.trim();
+			act('push config', () => api('PUT', 'sites/' + encodeURIComponent(s.Site), { LocalHostServ: svr }));
+			input.blur();
+		};
+		input.addEventListener('keydown', ev => {
+			if (ev.key === 'Enter') push();
+		});
+		return el('tr', null,
+			el('td', null, s.Site),
+			el('td', { className: 'num' }, s.Tunnels),
+			el('td', { className: 'num' }, s.Streams),
+			el('td', null, (s.Routes || []).join(' ')),
+			el('td', null, input, ' ', button('Push', push)));
+	}), 5);
+}
+
+let refreshing = false;
+
+async function refresh() {
+	if (refreshing) return;
+	refreshing = true;
+	try {
+		const [health, tunnels, sessions, routes, sites] = await Promise.all([
+			api('GET', 'health'), api('GET', 'tunnels'), api('GET', 'sessions'), api('GET', 'routes'), api('GET', 'sites'),
+		]);
+		const now = Date.now();
+		renderHealth(health);
+		renderTunnels(tunnels, now);
+		renderSessions(sessions, now);
+		forgetRates(now);
+		renderRoutes(routes);
+		if (!editing('sites')) renderSites(sites);
+		showError(null);
+	} catch (err) {
+		document.getElementById('health').replaceChildren(el('span', { className: 'badge down' }, 'down'));
+		showError(err);
+	} finally {
+		refreshing = false;
+	}
+}
+
+/* log viewer */
+
+const logs = { after: 0, lines: [], enabled: true };
+const logBox = document.getElementById('log-lines');
+
+function logLevel(text) {
+	const m = text.match(/\[(Trace|Debug|Info|Warn|Error|Fatal)\]/);
+	return m ? m[1] : 'Info';
+}
+
+function renderLogs() {
+	const min = Number(document.getElementById('log-level').value);
+	const filter = document.getElementById('log-filter').value.toLowerCase();
+	const bottom = logBox.scrollTop + logBox.clientHeight >= logBox.scrollHeight - 4;
+	logBox.replaceChildren(...logs.lines
+		.filter(l => LOG_LEVELS.indexOf(l.level) >= min && (!filter || l.text.toLowerCase().includes(filter)))
+		.map(l => el('span', { className: l.level }, l.text)));
+	if (bottom) logBox.scrollTop = logBox.scrollHeight;
+}
+
+async function pollLogs() {
+	if (!logs.enabled || document.getElementById('log-pause').checked) return;
+	try {
+		const resp = await api('GET', 'logs?after=' + logs.after);
+		const restarted = resp.Last < logs.after;
+		if (restarted) {
+			logs.lines = [];
+		}
+		for (const l of resp.Lines) {
+			logs.lines.push({ text: l.Text.endsWith('\n') ? l.Text : l.Text + '\n', level: logLevel(l.Text) });
+		}
+		logs.lines.splice(0, logs.lines.length - LOG_MAX_LINES);
+		logs.after = resp.Last;
+		if (resp.Lines.length || restarted) renderLogs();
+	} catch (err) {
+		if (err.status === 404) {
+			logs.enabled = false;
+			logBox.textContent = err.message;
+		}
+	}
+}
+
+document.getElementById('log-level').addEventListener('change', renderLogs);
+document.getElementById('log-filter').addEventListener('input', renderLogs);
+document.getElementById('log-clear').addEventListener('click', () => {
+	logs.lines = [];
+	renderLogs();
+});
+
+function loop() {
+	Promise.all([refresh(), pollLogs()]).finally(() => setTimeout(loop, POLL_INTERVAL));
+}
+
+loop();
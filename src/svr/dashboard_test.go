@@ -0,0 +1,53 @@
+package svr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	s, err := NewServer(&Config{AdminUsers: []string{"admin:secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(method, path string, auth bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if auth {
+			r.SetBasicAuth("admin", "secret")
+		}
+		w := httptest.NewRecorder()
+		s.ServeMux().ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("GET", "/admin/", false); w.Code != http.StatusUnauthorized {
+		t.Fatal("want 401 without auth, got", w.Code)
+	}
+
+	w := get("GET", "/admin/", true)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<script src="app.js">`) {
+		t.Fatal("bad index", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("Content-Security-Policy"), "default-src 'self'") {
+		t.Fatal("no CSP", w.Header())
+	}
+
+	cases := map[string]string{
+		"/admin/app.js":    "javascript",
+		"/admin/style.css": "text/css",
+	}
+	for path, ctype := range cases {
+		w := get("GET", path, true)
+		if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Type"), ctype) {
+			t.Error(path, w.Code, w.Header())
+		}
+	}
+	if w := get("GET", "/admin/nothing.js", true); w.Code != http.StatusNotFound {
+		t.Fatal("want 404, got", w.Code)
+	}
+	if w := get("POST", "/admin/", true); w.Code != http.StatusMethodNotAllowed {
+		t.Fatal("want 405, got", w.Code)
+	}
+}
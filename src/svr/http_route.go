@@ -0,0 +1,362 @@
+/*
+	http route: a reverse proxy on the public port, the requests are checked by the
+	route's users and sent over the tunnel to the target.
+*/
+
+package svr
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"libs/log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Route_Auth_Basic  = "basic"
+	Route_Auth_Cookie = "cookie"
+
+	route_login_uri   = "/_tunnel/login"
+	route_logout_uri  = "/_tunnel/logout"
+	route_cookie      = "tunnel_session"
+	route_session_ttl = 12 * time.Hour
+)
+
+type routeSession struct {
+	user    string
+	expires time.Time
+}
+
+type httpRoute struct {
+	svr   *Server
+	route *Route
+	auth  Authenticator // noAuth if the route has no users
+	proxy *httputil.ReverseProxy
+	hs    *http.Server
+
+	rw       *sync.Mutex
+	sessions map[string]*routeSession // key is the cookie value
+}
+
+func newHTTPRoute(s *Server, route *Route) (*httpRoute, error) {
+	auth, err := newBasicAuth(route.Auth...)
+	if err != nil {
+		return nil, err
+	}
+	switch route.AuthMode {
+	case "", Route_Auth_Basic, Route_Auth_Cookie:
+	default:
+		return nil, fmt.Errorf("route[%s] unknown auth mode[%s].", route.Name, route.AuthMode)
+	}
+
+	h := &httpRoute{
+		svr:      s,
+		route:    route,
+		auth:     auth,
+		rw:       new(sync.Mutex),
+		sessions: make(map[string]*routeSession),
+	}
+	h.proxy = &httputil.ReverseProxy{
+		Director:       h.director,
+		ModifyResponse: h.modifyResponse,
+		ErrorHandler:   h.proxyError,
+		// mjpg-streamer 等流式响应要立即发出
+		FlushInterval: -1,
+		Transport: &http.Transport{
+			DialContext:         h.dial,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+			DisableCompression:  true,
+		},
+	}
+	h.hs = &http.Server{Handler: h, MaxHeaderBytes: 1 << 20}
+	return h, nil
+}
+
+func (h *httpRoute) serve(l net.Listener) {
+	log.Debug("IP Forward Listening HTTP[%s] for route[%s]", h.route.Listen, h.route.Name)
+	err := h.hs.Serve(l)
+	if err != nil && !h.svr.isRouteRemoved(h.route) {
+		log.Error("http route[%s] serve err=%s", h.route.Name, err.Error())
+	}
+	log.Info("route[%s] stop listen.", h.route)
+}
+
+// target is the host:port in the client side, only used for the Host header and the Location rewrite.
+func (h *httpRoute) target() string {
+	if h.route.Target != "" {
+		return h.route.Target
+	}
+	for _, c := range h.svr.clientsOfSite(h.route.site()) {
+		if host := c.getLocalHostServ(); host != "" {
+			return host
+		}
+	}
+	return "localhost"
+}
+
+// dial open a stream to the route's target, addr is ignored.
+func (h *httpRoute) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := h.svr.getFreeClient(h.route.site())
+	if err != nil {
+		return nil, err
+	}
+	stream, err := client.session.Open(h.route.connectInfo())
+	if err != nil {
+		return nil, err
+	}
+	return stream.Conn(), nil
+}
+
+func (h *httpRoute) director(r *http.Request) {
+	target := h.target()
+	r.URL.Scheme = "http"
+	r.URL.Host = target
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	r.Header.Set("X-Forwarded-Proto", requestScheme(r))
+	r.Host = target
+
+	// the route's credentials are not for the target
+	if h.hasAuth() {
+		r.Header.Del("Authorization")
+		removeCookie(r, route_cookie)
+	}
+	// X-Forwarded-For is appended by ReverseProxy
+}
+
+// modifyResponse rewrite the Location which point to the target to the public host.
+func (h *httpRoute) modifyResponse(resp *http.Response) error {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	if !sameHost(u.Host, resp.Request.URL.Host) {
+		return nil
+	}
+	u.Scheme = resp.Request.Header.Get("X-Forwarded-Proto")
+	u.Host = resp.Request.Header.Get("X-Forwarded-Host")
+	resp.Header.Set("Location", u.String())
+	return nil
+}
+
+func (h *httpRoute) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Warn("[http] route[%s] %s %s proxy err=%s", h.route.Name, r.Method, r.URL.Path, err.Error())
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func (r *Route) authMode() string {
+	if r.AuthMode == "" {
+		return Route_Auth_Basic
+	}
+	return r.AuthMode
+}
+
+func (h *httpRoute) hasAuth() bool {
+	_, ok := h.auth.(noAuth)
+	return !ok
+}
+
+func (h *httpRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	lw := &logResponseWriter{ResponseWriter: w, status: 200}
+
+	user := h.serveAuth(lw, r)
+	if user != "" {
+		h.proxy.ServeHTTP(lw, r)
+	}
+	log.Info("[http] route[%s] %s %s %s %d %dB %s user[%s] ua[%s]",
+		h.route.Name, remoteIP(r), r.Method, r.URL.RequestURI(), lw.status, lw.size,
+		time.Since(start), user, r.UserAgent())
+}
+
+// serveAuth return the user if the request can be proxied, otherwise the response is written.
+func (h *httpRoute) serveAuth(w http.ResponseWriter, r *http.Request) string {
+	if !h.hasAuth() {
+		return anonymous_user
+	}
+	endpoint := "route:" + h.route.Name
+
+	if h.route.authMode() == Route_Auth_Basic {
+		user, _ := h.svr.authenticate(w, r, h.svr.routeLimiter, h.auth, endpoint)
+		return user
+	}
+
+	switch r.URL.Path {
+	case route_login_uri:
+		h.login(w, r, endpoint)
+		return ""
+	case route_logout_uri:
+		h.logout(w, r)
+		return ""
+	}
+	if user := h.sessionUser(r); user != "" {
+		return user
+	}
+	http.Redirect(w, r, route_login_uri+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+	return ""
+}
+
+const route_login_html = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Login</title></head>
+<body><form method="POST" action="` + route_login_uri + `">
+<p>%s</p>
+<input type="hidden" name="next" value="%s" />
+<p>User <input name="user" /></p>
+<p>Password <input name="password" type="password" /></p>
+<p><input type="submit" value="Login" /></p>
+</form></body></html>`
+
+func (h *httpRoute) login(w http.ResponseWriter, r *http.Request, endpoint string) {
+	next := r.FormValue("next")
+	// only the local path, no open redirect
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+
+	if r.Method != "POST" {
+		setSTDheader(w)
+		fmt.Fprintf(w, route_login_html, html.EscapeString(h.route.Name), html.EscapeString(next))
+		return
+	}
+
+	req := &http.Request{Method: r.Method, URL: r.URL, Header: http.Header{}, RemoteAddr: r.RemoteAddr}
+	req.SetBasicAuth(r.FormValue("user"), r.FormValue("password"))
+	user, err := h.svr.checkAuth(req, h.svr.routeLimiter, h.auth, endpoint)
+	if err != nil {
+		setSTDheader(w)
+		if err == ErrLockedOut {
+			w.WriteHeader(429)
+		} else {
+			w.WriteHeader(401)
+		}
+		fmt.Fprintf(w, route_login_html, html.EscapeString(err.Error()), html.EscapeString(next))
+		return
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.rw.Lock()
+	h.expire()
+	h.sessions[token] = &routeSession{user: user, expires: time.Now().Add(route_session_ttl)}
+	h.rw.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     route_cookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(route_session_ttl.Seconds()),
+	})
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+func (h *httpRoute) logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(route_cookie); err == nil {
+		h.rw.Lock()
+		delete(h.sessions, c.Value)
+		h.rw.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: route_cookie, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, route_login_uri, http.StatusFound)
+}
+
+func (h *httpRoute) sessionUser(r *http.Request) string {
+	c, err := r.Cookie(route_cookie)
+	if err != nil {
+		return ""
+	}
+	h.rw.Lock()
+	defer h.rw.Unlock()
+	session, find := h.sessions[c.Value]
+	if !find || time.Now().After(session.expires) {
+		return ""
+	}
+	return session.user
+}
+
+// expire remove the expired sessions, must be called with the lock held.
+func (h *httpRoute) expire() {
+	now := time.Now()
+	for token, session := range h.sessions {
+		if now.After(session.expires) {
+			delete(h.sessions, token)
+		}
+	}
+}
+
+func (h *httpRoute) close() error {
+	return h.hs.Close()
+}
+
+// logResponseWriter record the status and size for the request log.
+type logResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *logResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *logResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Unwrap let http.ResponseController find Flush and Hijack of the ResponseWriter.
+func (w *logResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *logResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// sameHost compare host[:port] a and b, the default port 80 can be omitted.
+func sameHost(a, b string) bool {
+	withPort := func(h string) string {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			return net.JoinHostPort(h, "80")
+		}
+		return h
+	}
+	return strings.EqualFold(withPort(a), withPort(b))
+}
+
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
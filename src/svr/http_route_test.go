@@ -0,0 +1,131 @@
+package svr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *Server {
+	s, err := NewServer(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestHTTPRouteLocation(t *testing.T) {
+	h, err := newHTTPRoute(newTestServer(t), &Route{Name: "web", Target: "192.168.1.10:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://cam.example.com/a", nil)
+	h.director(req)
+	if req.Host != "192.168.1.10:8080" || req.Header.Get("X-Forwarded-Host") != "cam.example.com" {
+		t.Fatal("bad director", req.Host, req.Header)
+	}
+
+	cases := map[string]string{
+		"http://192.168.1.10:8080/login?x=1": "http://cam.example.com/login?x=1",
+		"/relative":                          "/relative",
+		"http://other.com/":                  "http://other.com/",
+	}
+	for location, want := range cases {
+		resp := &http.Response{Header: http.Header{}, Request: req}
+		resp.Header.Set("Location", location)
+		h.modifyResponse(resp)
+		if got := resp.Header.Get("Location"); got != want {
+			t.Error("location", location, "want", want, "got", got)
+		}
+	}
+}
+
+func TestHTTPRouteCookieAuth(t *testing.T) {
+	h, err := newHTTPRoute(newTestServer(t), &Route{Name: "web", Auth: []string{"bob:secret"}, AuthMode: Route_Auth_Cookie})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/video?a=1", nil))
+	if w.Code != 302 || w.Header().Get("Location") != route_login_uri+"?next="+url.QueryEscape("/video?a=1") {
+		t.Fatal("want redirect to login, got", w.Code, w.Header())
+	}
+
+	login := func(password, next string) *httptest.ResponseRecorder {
+		form := url.Values{"user": {"bob"}, "password": {password}, "next": {next}}
+		r := httptest.NewRequest("POST", route_login_uri, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := login("bad", "/"); w.Code != 401 {
+		t.Fatal("bad password, want 401 got", w.Code)
+	}
+	w = login("secret", "//evil.com/")
+	if w.Code != 302 || w.Header().Get("Location") != "/" {
+		t.Fatal("next must be a local path", w.Code, w.Header())
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatal("bad cookie", cookies)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	r.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+	if user := h.sessionUser(r); user != "bob" {
+		t.Fatal("cookie not accepted, user", user)
+	}
+	// the route's cookie must not be sent to the target.
+	h.director(r)
+	if c := r.Header.Get("Cookie"); c != "app=1" {
+		t.Fatal("bad cookie to target", c)
+	}
+}
+
+// TestRouteLockoutApart failing a route's login must not lock the IP out of the admin.
+func TestRouteLockoutApart(t *testing.T) {
+	s, err := NewServer(&Config{AdminUsers: []string{"admin:secret"}, MaxAuthFailures: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHTTPRoute(s, &Route{Name: "web", Auth: []string{"bob:pw"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(handler http.Handler, path, user, password string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.SetBasicAuth(user, password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := do(h, "/", "bob", "bad"); code != 401 {
+			t.Fatal("want 401, got", code)
+		}
+	}
+	if code := do(h, "/", "bob", "pw"); code != 429 {
+		t.Fatal("route want 429, got", code)
+	}
+	if code := do(s.ServeMux(), "/api/creds", "admin", "secret"); code != 200 {
+		t.Fatal("admin locked out by the route, got", code)
+	}
+
+	// and the admin's failures do not lock the routes
+	s.routeLimiter.success("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		do(s.ServeMux(), "/api/creds", "admin", "bad")
+	}
+	if code := do(s.ServeMux(), "/api/creds", "admin", "secret"); code != 429 {
+		t.Fatal("admin want 429, got", code)
+	}
+	if code := do(h, "/", "bob", "pw"); code == 401 || code == 429 {
+		t.Fatal("route locked out by the admin, got", code)
+	}
+}
@@ -0,0 +1,320 @@
+/*
+	proxy route: SOCKS5(RFC1928, RFC1929) and HTTP CONNECT on one port,
+	the destination is sent to the client in Msg_New_Connection.
+*/
+
+package svr
+
+import (
+	"bufio"
+	"ctrl"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"libs/log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"tunnel"
+)
+
+const (
+	socks5_version      = 0x05
+	socks5_auth_version = 0x01
+
+	socks5_method_no_auth  = 0x00
+	socks5_method_password = 0x02
+	socks5_method_none     = 0xFF
+
+	socks5_cmd_connect = 0x01
+
+	socks5_atyp_ipv4   = 0x01
+	socks5_atyp_domain = 0x03
+	socks5_atyp_ipv6   = 0x04
+
+	socks5_rep_ok                = 0x00
+	socks5_rep_fail              = 0x01
+	socks5_rep_refused           = 0x05
+	socks5_rep_cmd_not_supported = 0x07
+	socks5_rep_atyp_not_support  = 0x08
+
+	// the greeting, auth and request of the proxy client must be read in it.
+	proxy_handshake_timeout = 10 * time.Second
+	// the client must dial the target in it.
+	proxy_connect_timeout = 30 * time.Second
+)
+
+var (
+	ErrProxyVersion = errors.New("not SOCKS5 or HTTP CONNECT")
+	ErrProxyCommand = errors.New("only CONNECT is supported")
+)
+
+// bufferedConn read the data which bufio.Reader has buffered first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite keep the half-close of TCP.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (s *Server) serveProxy(conn net.Conn, route *Route) {
+	// the route's own users, never the admin users: the proxy passwords are sent in cleartext
+	auth, err := newBasicAuth(route.Auth...)
+	if err != nil {
+		log.Error("proxy route[%s] err=%s", route.Name, err.Error())
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(proxy_handshake_timeout))
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+
+	var target string
+	isSocks5 := first[0] == socks5_version
+	if isSocks5 {
+		target, err = s.socks5Handshake(conn, r, route, auth)
+	} else {
+		target, err = s.httpConnectHandshake(conn, r, route, auth)
+	}
+	if err != nil {
+		log.Warn("proxy route[%s] conn[%s] err=%s", route.Name, conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	// 客户端连上目标后才回复成功, 目标不可达时代理客户端能得到错误而不是一个马上关闭的连接
+	stream, err := s.openProxyStream(route, target)
+	if err != nil {
+		log.Error("proxy route[%s] target[%s] err=%s", route.Name, target, err.Error())
+		proxyReply(conn, isSocks5, false)
+		return
+	}
+	if err := proxyReply(conn, isSocks5, true); err != nil {
+		stream.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	log.Info("proxy conn[%s] route[%s] to[%s] by stream[%s].", conn.RemoteAddr(), route.Name, target, stream)
+
+	tunnel.Join(stream, &bufferedConn{Conn: conn, r: r})
+}
+
+// openProxyStream return the stream after the client connected the target.
+func (s *Server) openProxyStream(route *Route, target string) (*tunnel.Stream, error) {
+	client, err := s.getFreeClient(route.site())
+	if err != nil {
+		return nil, err
+	}
+	info := ctrl.ConnectInfo{Route: route.Name, Target: target, Proxy: true}
+	stream, err := client.session.Open(info.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.WaitConnected(proxy_connect_timeout); err != nil {
+		stream.Reset(err)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// proxyReply tell the proxy client the result of the CONNECT.
+func proxyReply(conn net.Conn, isSocks5, ok bool) error {
+	var err error
+	switch {
+	case isSocks5 && ok:
+		err = socks5Reply(conn, socks5_rep_ok)
+	case isSocks5:
+		err = socks5Reply(conn, socks5_rep_refused)
+	case ok:
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	default:
+		_, err = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+	}
+	return err
+}
+
+// proxyAuth check the username and password by the users of the route.
+func (s *Server) proxyAuth(conn net.Conn, route *Route, auth Authenticator, header http.Header) error {
+	r := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Path: route.Name},
+		Header:     header,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	_, err := s.checkAuth(r, s.routeLimiter, auth, "route:"+route.Name)
+	return err
+}
+
+func (s *Server) socks5Handshake(conn net.Conn, r *bufio.Reader, route *Route, auth Authenticator) (string, error) {
+	// VER NMETHODS METHODS
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socks5_method_no_auth)
+	if _, ok := auth.(noAuth); !ok {
+		method = socks5_method_password
+	}
+	found := false
+	for _, m := range methods {
+		if m == method {
+			found = true
+		}
+	}
+	if !found {
+		conn.Write([]byte{socks5_version, socks5_method_none})
+		return "", fmt.Errorf("socks5 method[%d] not offered", method)
+	}
+	if _, err := conn.Write([]byte{socks5_version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5_method_password {
+		if err := s.socks5Password(conn, r, route, auth); err != nil {
+			return "", err
+		}
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return "", err
+	}
+	if req[1] != socks5_cmd_connect {
+		socks5Reply(conn, socks5_rep_cmd_not_supported)
+		return "", ErrProxyCommand
+	}
+
+	var host string
+	switch req[3] {
+	case socks5_atyp_ipv4, socks5_atyp_ipv6:
+		size := net.IPv4len
+		if req[3] == socks5_atyp_ipv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5_atyp_domain:
+		size, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, size)
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5_rep_atyp_not_support)
+		return "", fmt.Errorf("socks5 address type[%d] not supported", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	// 目标是否允许由客户端的白名单决定, 客户端拒绝时回复 socks5_rep_refused
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socks5Password RFC1929: VER ULEN UNAME PLEN PASSWD
+func (s *Server) socks5Password(conn net.Conn, r *bufio.Reader, route *Route, auth Authenticator) error {
+	readString := func() (string, error) {
+		size, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, size)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != socks5_auth_version {
+		return fmt.Errorf("socks5 auth version[%d] not supported", version)
+	}
+	user, err := readString()
+	if err != nil {
+		return err
+	}
+	password, err := readString()
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	req := &http.Request{Header: header}
+	req.SetBasicAuth(user, password)
+	if err := s.proxyAuth(conn, route, auth, header); err != nil {
+		conn.Write([]byte{socks5_auth_version, socks5_rep_fail})
+		return err
+	}
+	_, err = conn.Write([]byte{socks5_auth_version, socks5_rep_ok})
+	return err
+}
+
+func socks5Reply(conn net.Conn, rep byte) error {
+	// BND.ADDR and BND.PORT are not meaningful through the tunnel
+	_, err := conn.Write([]byte{socks5_version, rep, 0x00, socks5_atyp_ipv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (s *Server) httpConnectHandshake(conn net.Conn, r *bufio.Reader, route *Route, auth Authenticator) (string, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", ErrProxyVersion
+	}
+	if req.Method != "CONNECT" {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nContent-Length: 0\r\n\r\n"))
+		return "", ErrProxyCommand
+	}
+
+	if _, ok := auth.(noAuth); !ok {
+		header := http.Header{}
+		if auth := req.Header.Get("Proxy-Authorization"); auth != "" {
+			header.Set("Authorization", auth)
+		}
+		switch err := s.proxyAuth(conn, route, auth, header); err {
+		case nil:
+		case ErrLockedOut:
+			conn.Write([]byte("HTTP/1.1 429 Too Many Requests\r\nContent-Length: 0\r\n\r\n"))
+			return "", err
+		default:
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"TCP-Forward-Serv\"\r\nContent-Length: 0\r\n\r\n"))
+			return "", err
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
+		return "", err
+	}
+	return req.Host, nil
+}
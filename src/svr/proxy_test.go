@@ -0,0 +1,119 @@
+package svr
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func newProxyTest(t *testing.T) (*Server, *Route) {
+	s, err := NewServer(&Config{AdminUsers: []string{"admin:secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, &Route{Name: "px", Proto: Route_Proto_Proxy, Auth: []string{"bob:pw"}}
+}
+
+// dialProxy serve a proxy conn like ipforward, return the client side.
+func dialProxy(s *Server, route *Route) net.Conn {
+	c1, c2 := net.Pipe()
+	go func() {
+		defer c2.Close()
+		s.serveProxy(c2, route)
+	}()
+	return c1
+}
+
+// socks5Login offer the methods and send the password if the server choose it,
+// return the chosen method and the auth status.
+func socks5Login(t *testing.T, c net.Conn, methods []byte, user, password string) (byte, byte) {
+	c.Write(append([]byte{socks5_version, byte(len(methods))}, methods...))
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5_method_password {
+		return reply[1], 0
+	}
+	req := append([]byte{socks5_auth_version, byte(len(user))}, user...)
+	req = append(append(req, byte(len(password))), password...)
+	c.Write(req)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[0], reply[1]
+}
+
+func TestProxySocks5Auth(t *testing.T) {
+	s, route := newProxyTest(t)
+
+	cases := []struct {
+		methods        []byte
+		user, password string
+		method, status byte
+	}{
+		{[]byte{socks5_method_no_auth}, "", "", socks5_method_none, 0},
+		{[]byte{socks5_method_no_auth, socks5_method_password}, "bob", "bad", socks5_auth_version, socks5_rep_fail},
+		// the admin users are not the proxy users
+		{[]byte{socks5_method_password}, "admin", "secret", socks5_auth_version, socks5_rep_fail},
+		{[]byte{socks5_method_password}, "bob", "pw", socks5_auth_version, socks5_rep_ok},
+	}
+	for _, c := range cases {
+		c1 := dialProxy(s, route)
+		method, status := socks5Login(t, c1, c.methods, c.user, c.password)
+		if method != c.method || status != c.status {
+			t.Error(c.user, c.password, "want", c.method, c.status, "got", method, status)
+		}
+		if method == socks5_auth_version && status == socks5_rep_ok {
+			// logged in, no client online: the CONNECT fails with refused
+			c1.Write([]byte{socks5_version, socks5_cmd_connect, 0, socks5_atyp_ipv4, 10, 0, 0, 1, 0, 80})
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(c1, reply); err != nil || reply[1] != socks5_rep_refused {
+				t.Error("want refused after login, got", reply, err)
+			}
+		}
+		c1.Close()
+	}
+}
+
+func TestProxyConnectAuth(t *testing.T) {
+	s, route := newProxyTest(t)
+
+	cases := []struct {
+		user, password string
+		status         int
+	}{
+		{"", "", http.StatusProxyAuthRequired},
+		{"admin", "secret", http.StatusProxyAuthRequired},
+		{"bob", "pw", http.StatusBadGateway}, // logged in, no client online
+	}
+	for _, c := range cases {
+		c1 := dialProxy(s, route)
+		req, _ := http.NewRequest("CONNECT", "http://10.0.0.1:80", nil)
+		req.Host = "10.0.0.1:80"
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+			req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+			req.Header.Del("Authorization")
+		}
+		go req.Write(c1)
+		resp, err := http.ReadResponse(bufio.NewReader(c1), req)
+		if err != nil || resp.StatusCode != c.status {
+			t.Error(c.user, "want", c.status, "got", resp, err)
+		}
+		c1.Close()
+	}
+}
+
+func TestProxyNoUsers(t *testing.T) {
+	s, route := newProxyTest(t)
+	route.Auth = nil
+
+	c1 := dialProxy(s, route)
+	defer c1.Close()
+	if method, _ := socks5Login(t, c1, []byte{socks5_method_no_auth}, "", ""); method != socks5_method_no_auth {
+		t.Fatal("a route without users want no auth, got method", method)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+	reverse direction: the client listen a LAN port,
+	the connections are carried to SVR and SVR dial the target.
+*/
+
+package svr
+
+import (
+	"ctrl"
+	"fmt"
+	"libs/log"
+	"net"
+	"time"
+	"tunnel"
+)
+
+const (
+	reverse_dial_timeout = 10 * time.Second
+)
+
+// reverseAllowed only the targets in Config.ReverseTargets can be dialed by the clients.
+func (s *Server) reverseAllowed(target string) bool {
+	for _, t := range s.conf.ReverseTargets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptReverse the client opened a stream by Msg_New_Connection with the Reverse flag.
+func (c *wsClient) acceptReverse(index int64, content string) error {
+	info, err := ctrl.ParseConnectInfo(content)
+	if err != nil {
+		c.tellError(index, err)
+		return err
+	}
+	if !info.Reverse || index%2 != 1 {
+		err = fmt.Errorf("stream[%d] is not a reverse connection.", index)
+		c.tellError(index, err)
+		return err
+	}
+	if !c.svr.reverseAllowed(info.Target) {
+		err = fmt.Errorf("reverse target[%s] is not allowed.", info.Target)
+		log.Warn("Client[%s] route[%s] %s", c, info.Route, err.Error())
+		c.tellError(index, err)
+		return err
+	}
+
+	stream, err := c.session.Accept(uint32(index), content)
+	if err != nil {
+		log.Error("[%s] accept stream[%d] err=%s", c, index, err.Error())
+		return err
+	}
+	log.Info("[%s] reverse route[%s] connect to[%s]", stream, info.Route, info.Target)
+	go reverseForward(stream, info.Target)
+	return nil
+}
+
+func reverseForward(stream *tunnel.Stream, target string) {
+	conn, err := net.DialTimeout("tcp", target, reverse_dial_timeout)
+	if err != nil {
+		log.Error("[%s] reverse connect to[%s] err=%s", stream, target, err.Error())
+		stream.Reset(err)
+		return
+	}
+	tunnel.Join(stream, conn)
+}
+
+func (c *wsClient) tellError(index int64, err error) error {
+	frame := ctrl.WebSocketControlFrame{
+		Type:    ctrl.Msg_Sys_Err,
+		Index:   index,
+		Content: err.Error(),
+	}
+	return c.session.WriteControl(&frame)
+}
@@ -0,0 +1,99 @@
+package svr
+
+import (
+	"ctrl"
+	"encoding/json"
+	"libs/websocket"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"tunnel"
+)
+
+// newPipeClient a wsClient on net.Pipe, the other end is the websocket of the agent.
+func newPipeClient(t *testing.T, s *Server) (*wsClient, *websocket.Conn) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	client := &wsClient{
+		svr:     s,
+		session: tunnel.NewSession(websocket.NewConn(c1, true), true),
+		req:     httptest.NewRequest("GET", "/", nil),
+		site:    ctrl.DEFAULT_SITE,
+		rw:      new(sync.RWMutex),
+	}
+	return client, websocket.NewConn(c2, false)
+}
+
+func TestAcceptReverse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	target := l.Addr().String()
+	_, port, _ := net.SplitHostPort(target)
+
+	s, err := NewServer(&Config{ReverseTargets: []string{target}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := []struct {
+		name  string
+		index int64
+		info  ctrl.ConnectInfo
+	}{
+		{"no reverse flag", 1, ctrl.ConnectInfo{Target: target}},
+		{"even index, opened by the server side", 2, ctrl.ConnectInfo{Target: target, Reverse: true}},
+		{"target not allowed", 3, ctrl.ConnectInfo{Target: "127.0.0.1:1", Reverse: true}},
+		{"the same target by other name", 5, ctrl.ConnectInfo{Target: "localhost:" + port, Reverse: true}},
+	}
+	for _, c := range rejected {
+		client, agent := newPipeClient(t, s)
+		done := make(chan error, 1)
+		go func() { done <- client.acceptReverse(c.index, c.info.String()) }()
+
+		_, msg, err := agent.Read()
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		frame := ctrl.WebSocketControlFrame{}
+		if err := json.Unmarshal(msg, &frame); err != nil || frame.Type != ctrl.Msg_Sys_Err || frame.Index != c.index {
+			t.Fatal(c.name, "want Msg_Sys_Err of the stream, got", string(msg))
+		}
+		if err := <-done; err == nil {
+			t.Fatal(c.name, "want error")
+		}
+		if client.session.NumStreams() != 0 {
+			t.Fatal(c.name, "stream accepted")
+		}
+	}
+
+	// allowed, the server dial the target
+	client, _ := newPipeClient(t, s)
+	info := ctrl.ConnectInfo{Route: "nas", Target: target, Reverse: true}
+	if err := client.acceptReverse(7, info.String()); err != nil {
+		t.Fatal(err)
+	}
+	if client.session.Stream(7) == nil {
+		t.Fatal("stream not accepted")
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not connect the target")
+	}
+}
@@ -0,0 +1,320 @@
+/*
+	route table: every route listen a public port on SVR,
+	and forward the connections to a target in the client's local network.
+*/
+
+package svr
+
+import (
+	"ctrl"
+	"fmt"
+	"libs/log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	Default_Route_Name = "default"
+
+	// the route listen SOCKS5 and HTTP CONNECT, the target is asked by the proxy client.
+	Route_Proto_Proxy = "proxy"
+	// the route listen HTTP and HTTPS, the target is chosen by the Host header or the TLS SNI.
+	Route_Proto_VHost = "vhost"
+	// the route is a HTTP reverse proxy, the requests are checked by the route's users and logged.
+	Route_Proto_HTTP = "http"
+)
+
+type Route struct {
+	Name   string `json:"Name"`
+	Listen string `json:"Listen"` // public ip:port on SVR
+	Target string `json:"Target"` // host:port in the client side, empty is client's LocalHostServ
+	Site   string `json:"Site"`   // which site's client serve the route, empty is ctrl.DEFAULT_SITE
+	Proto  string `json:"Proto"`  // ctrl.PROTO_TCP, ctrl.PROTO_UDP, Route_Proto_Proxy, Route_Proto_VHost or Route_Proto_HTTP, empty is tcp
+
+	VHosts []*VHost `json:"VHosts,omitempty"` // hostnames of the vhost route
+
+	// users "username:password" of the http and the proxy route, empty is no auth
+	Auth     []string `json:"Auth,omitempty"`
+	AuthMode string   `json:"AuthMode,omitempty"` // Route_Auth_Basic or Route_Auth_Cookie, empty is basic
+
+	vrw sync.RWMutex // VHosts
+}
+
+// ParseRoute parse "name,listen,target,site", the target and site can be omit.
+func ParseRoute(s string) (*Route, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) < 2 || len(fields) > 4 {
+		return nil, fmt.Errorf("route[%s] format must be name,listen[,target[,site]]", s)
+	}
+	route := &Route{
+		Name:   strings.TrimSpace(fields[0]),
+		Listen: strings.TrimSpace(fields[1]),
+	}
+	if len(fields) >= 3 {
+		route.Target = strings.TrimSpace(fields[2])
+	}
+	if len(fields) == 4 {
+		route.Site = strings.TrimSpace(fields[3])
+	}
+	return route, nil
+}
+
+func (r *Route) String() string {
+	target := r.Target
+	if target == "" {
+		target = "<client-default>"
+	}
+	return fmt.Sprintf("%s[%s->%s@%s]", r.Name, r.listenAddr(), target, r.site())
+}
+
+// listenAddr is Listen with "udp://", "proxy://", "vhost://" or "http://".
+func (r *Route) listenAddr() string {
+	switch r.Proto {
+	case ctrl.PROTO_UDP, Route_Proto_Proxy, Route_Proto_VHost, Route_Proto_HTTP:
+		return r.Proto + "://" + r.Listen
+	}
+	return r.Listen
+}
+
+func (r *Route) isUDP() bool {
+	return r.Proto == ctrl.PROTO_UDP
+}
+
+func (r *Route) isProxy() bool {
+	return r.Proto == Route_Proto_Proxy
+}
+
+func (r *Route) isVHost() bool {
+	return r.Proto == Route_Proto_VHost
+}
+
+func (r *Route) isHTTP() bool {
+	return r.Proto == Route_Proto_HTTP
+}
+
+func (r *Route) site() string {
+	if r.Site == "" {
+		return ctrl.DEFAULT_SITE
+	}
+	return r.Site
+}
+
+func (r *Route) connectInfo() string {
+	info := ctrl.ConnectInfo{Route: r.Name, Target: r.Target}
+	return info.String()
+}
+
+// routeState an added route, the route is the server's own copy of the caller's.
+type routeState struct {
+	route    *Route
+	listener net.Listener // nil for the UDP route
+	udp      *udpRoute
+	http     *httpRoute
+}
+
+type routeTable struct {
+	routes map[string]*routeState // key is Route.Name
+	rw     *sync.RWMutex
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		routes: make(map[string]*routeState),
+		rw:     new(sync.RWMutex),
+	}
+}
+
+// AddRoute listen the route's public port and start forward,
+// listen "udp://ip:port" is a UDP route, "proxy://ip:port" is a SOCKS5/HTTP CONNECT route,
+// "vhost://ip:port" is a virtual host route, "http://ip:port" is a HTTP reverse proxy route.
+// The server keep a copy of route, route is not changed.
+func (s *Server) AddRoute(route *Route) error {
+	route = route.clone()
+	for _, proto := range []string{ctrl.PROTO_UDP, Route_Proto_Proxy, Route_Proto_VHost, Route_Proto_HTTP} {
+		if strings.HasPrefix(route.Listen, proto+"://") {
+			route.Listen = strings.TrimPrefix(route.Listen, proto+"://")
+			route.Proto = proto
+		}
+	}
+	if route.Name == "" || route.Listen == "" {
+		return fmt.Errorf("route name and listen can not be empty.")
+	}
+	for i, v := range route.VHosts {
+		vhost := *v
+		vhost.Host = strings.ToLower(strings.TrimSpace(vhost.Host))
+		route.VHosts[i] = &vhost
+	}
+
+	s.routes.rw.Lock()
+	defer s.routes.rw.Unlock()
+
+	if r, find := s.routes.routes[route.Name]; find {
+		return fmt.Errorf("route[%s] already exists.", r.route)
+	}
+
+	if route.isProxy() {
+		// the users are checked by every proxy connection, only the format here
+		if _, err := newBasicAuth(route.Auth...); err != nil {
+			return err
+		}
+	}
+
+	state := &routeState{route: route}
+	switch route.Proto {
+	case "", ctrl.PROTO_TCP, Route_Proto_Proxy, Route_Proto_VHost:
+		l, err := net.Listen("tcp", route.Listen)
+		if err != nil {
+			return err
+		}
+		state.listener = l
+		go s.serveRoute(route, l)
+	case Route_Proto_HTTP:
+		h, err := newHTTPRoute(s, route)
+		if err != nil {
+			return err
+		}
+		l, err := net.Listen("tcp", route.Listen)
+		if err != nil {
+			return err
+		}
+		state.listener, state.http = l, h
+		go h.serve(l)
+	case ctrl.PROTO_UDP:
+		pc, err := net.ListenPacket("udp", route.Listen)
+		if err != nil {
+			return err
+		}
+		state.udp = newUDPRoute(s, route, pc)
+		go state.udp.serve()
+	default:
+		return fmt.Errorf("route[%s] unknown proto[%s].", route.Name, route.Proto)
+	}
+	s.routes.routes[route.Name] = state
+
+	log.Info("route[%s] added.", route)
+	return nil
+}
+
+// RemoveRoute stop listen, the TCP connections which are forwarding will not be closed,
+// the UDP sessions and the HTTP connections are closed.
+func (s *Server) RemoveRoute(name string) error {
+	s.routes.rw.Lock()
+	state, find := s.routes.routes[name]
+	delete(s.routes.routes, name)
+	s.routes.rw.Unlock()
+
+	if !find {
+		return fmt.Errorf("route[%s] not found.", name)
+	}
+	log.Info("route[%s] removed.", state.route)
+	switch {
+	case state.udp != nil:
+		return state.udp.close()
+	case state.http != nil:
+		// the idle keep-alive connections are closed too
+		return state.http.close()
+	}
+	return state.listener.Close()
+}
+
+// UpdateRoute replace the route of the same name, the old one is restored if the new one can not listen.
+func (s *Server) UpdateRoute(route *Route) error {
+	old := s.findRoute(route.Name)
+	if old == nil {
+		return fmt.Errorf("route[%s] not found.", route.Name)
+	}
+	// the new route may listen the same port, stop the old one first
+	if err := s.RemoveRoute(route.Name); err != nil {
+		return err
+	}
+	if err := s.AddRoute(route); err != nil {
+		if rerr := s.AddRoute(old.clone()); rerr != nil {
+			log.Error("route[%s] restore err=%s", old, rerr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// clone the config of the route.
+func (r *Route) clone() *Route {
+	r.vrw.RLock()
+	defer r.vrw.RUnlock()
+	return &Route{
+		Name:     r.Name,
+		Listen:   r.Listen,
+		Target:   r.Target,
+		Site:     r.Site,
+		Proto:    r.Proto,
+		VHosts:   append([]*VHost(nil), r.VHosts...),
+		Auth:     append([]string(nil), r.Auth...),
+		AuthMode: r.AuthMode,
+	}
+}
+
+// Routes return the copies of all routes order by name.
+func (s *Server) Routes() []*Route {
+	s.routes.rw.RLock()
+	defer s.routes.rw.RUnlock()
+
+	routes := make([]*Route, 0, len(s.routes.routes))
+	for _, state := range s.routes.routes {
+		routes = append(routes, state.route.clone())
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Name < routes[j].Name })
+	return routes
+}
+
+// RouteAddr the public address the route listened, nil if the route is not added,
+// the real port when Listen is ":0".
+func (s *Server) RouteAddr(name string) net.Addr {
+	s.routes.rw.RLock()
+	defer s.routes.rw.RUnlock()
+
+	state, find := s.routes.routes[name]
+	switch {
+	case !find:
+		return nil
+	case state.udp != nil:
+		return state.udp.pc.LocalAddr()
+	}
+	return state.listener.Addr()
+}
+
+// findRoute return the server's own route, nil if not found.
+func (s *Server) findRoute(name string) *Route {
+	s.routes.rw.RLock()
+	defer s.routes.rw.RUnlock()
+	if state, find := s.routes.routes[name]; find {
+		return state.route
+	}
+	return nil
+}
+
+func (s *Server) isRouteRemoved(route *Route) bool {
+	s.routes.rw.RLock()
+	defer s.routes.rw.RUnlock()
+	state, find := s.routes.routes[route.Name]
+	return !find || state.route != route
+}
+
+func (s *Server) serveRoute(route *Route, l net.Listener) {
+	log.Debug("IP Forward Listening TCP[%s] for route[%s]", route.Listen, route.Name)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isRouteRemoved(route) {
+				break
+			}
+			log.Error("IP-Forward route[%s] Accept err=%s", route.Name, err.Error())
+			continue
+		}
+		// handle socket data recv and send
+		go s.ipforward(conn, route)
+	}
+
+	log.Info("route[%s] stop listen.", route)
+}
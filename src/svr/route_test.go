@@ -0,0 +1,47 @@
+package svr
+
+import (
+	"testing"
+)
+
+// TestRouteSharedConfig two servers of the same config listen their own ports,
+// and the caller's routes are not changed.
+func TestRouteSharedConfig(t *testing.T) {
+	routes := []*Route{
+		{Name: "tcp", Listen: "127.0.0.1:0", Target: "192.168.1.10:80"},
+		{Name: "dns", Listen: "udp://127.0.0.1:0", Target: "192.168.1.1:53"},
+		{Name: "web", Listen: "vhost://127.0.0.1:0", VHosts: []*VHost{{Host: " Cam.Example.com", Target: "192.168.1.20:80"}}},
+	}
+	addrs := map[string]string{}
+	for i := 0; i < 2; i++ {
+		s := newTestServer(t)
+		for _, route := range routes {
+			if err := s.AddRoute(route); err != nil {
+				t.Fatal(err)
+			}
+			defer s.RemoveRoute(route.Name)
+
+			addr := s.RouteAddr(route.Name)
+			if addr == nil {
+				t.Fatal("route not listened", route.Name)
+			}
+			if addrs[route.Name] == addr.String() {
+				t.Fatal("the servers share a listener", route.Name, addr)
+			}
+			addrs[route.Name] = addr.String()
+		}
+		if route := s.findRoute("dns"); route == nil || route.Proto != "udp" || route.Listen != "127.0.0.1:0" {
+			t.Fatal("udp route not normalized", route)
+		}
+	}
+
+	if routes[1].Listen != "udp://127.0.0.1:0" || routes[1].Proto != "" {
+		t.Fatal("the caller's route was changed", routes[1])
+	}
+	if routes[2].VHosts[0].Host != " Cam.Example.com" {
+		t.Fatal("the caller's vhost was changed", routes[2].VHosts[0])
+	}
+	if s := newTestServer(t); s.RouteAddr("tcp") != nil {
+		t.Fatal("want nil for a route not added")
+	}
+}
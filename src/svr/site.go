@@ -0,0 +1,95 @@
+/*
+	site: one home's client, many websocket of the same site ID may online.
+*/
+
+package svr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type tunnelStatus struct {
+	Addr    string        // websocket remote addr
+	Streams int           // count of forwarding connections
+	RTT     time.Duration // of the last heartbeat, 0 is not measured yet
+}
+
+func (t *tunnelStatus) String() string {
+	return fmt.Sprintf("%s(streams:%d rtt:%s)", t.Addr, t.Streams, t.RTT)
+}
+
+type siteStatus struct {
+	Site          string
+	Tunnels       int             // count of online websocket
+	Streams       int             // count of forwarding connections
+	LocalHostServ string          // client's local network server, reported by Msg_Get_Config
+	Clients       []*tunnelStatus // online websocket
+	Routes        []string        // name of the routes bound to the site
+}
+
+func (site *siteStatus) clientsString() string {
+	s := make([]string, len(site.Clients))
+	for i, c := range site.Clients {
+		s[i] = c.String()
+	}
+	return strings.Join(s, " ")
+}
+
+// sitesStatus return the status of every site which has online client or route, order by site ID.
+func (s *Server) sitesStatus() []*siteStatus {
+	sites := make(map[string]*siteStatus)
+	get := func(site string) *siteStatus {
+		status, find := sites[site]
+		if !find {
+			status = &siteStatus{Site: site}
+			sites[site] = status
+		}
+		return status
+	}
+
+	for _, cli := range s.onlineClients() {
+		status := get(cli.site)
+		tunnel := &tunnelStatus{
+			Addr:    cli.req.RemoteAddr,
+			Streams: cli.session.NumStreams(),
+			RTT:     cli.session.RTT(),
+		}
+		status.Tunnels++
+		status.Streams += tunnel.Streams
+		status.Clients = append(status.Clients, tunnel)
+		if host := cli.getLocalHostServ(); host != "" {
+			status.LocalHostServ = host
+		}
+	}
+
+	for _, route := range s.Routes() {
+		status := get(route.site())
+		status.Routes = append(status.Routes, route.Name)
+	}
+
+	result := make([]*siteStatus, 0, len(sites))
+	for _, status := range sites {
+		clients := status.Clients
+		sort.Slice(clients, func(i, j int) bool { return clients[i].Addr < clients[j].Addr })
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Site < result[j].Site })
+	return result
+}
+
+// setSiteConfig tell all clients of the site to forward to the new local network server.
+func (s *Server) setSiteConfig(site, svr string) error {
+	clients := s.clientsOfSite(site)
+	if len(clients) == 0 {
+		return fmt.Errorf("no websocket connect online of site[%s].", site)
+	}
+	for _, cli := range clients {
+		if err := cli.tellClientSetConfig(svr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package svr
+
+import (
+	"cli"
+	"context"
+	"ctrl"
+	"testing"
+)
+
+// startSiteAgents connect the agents, one for every site ID, to s.
+func startSiteAgents(t *testing.T, s *Server, sites ...string) {
+	for _, site := range sites {
+		agent, err := cli.NewAgent(&cli.Config{ForwardServ: s.Addr().String(), SiteID: site})
+		if err != nil {
+			t.Fatal(err)
+		}
+		agent.Start()
+		t.Cleanup(func() { agent.Shutdown(context.Background()) })
+	}
+	waitTunnels(t, s, len(sites))
+}
+
+func drain(t *testing.T, client *wsClient) {
+	frame := ctrl.WebSocketControlFrame{Type: ctrl.Msg_Client_Drain}
+	if err := client.handlerControlMessage(frame.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSiteHeader(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	// empty SiteID is the default site
+	startSiteAgents(t, s, "home1", "home1", "")
+
+	for site, want := range map[string]int{"home1": 2, ctrl.DEFAULT_SITE: 1, "home2": 0} {
+		clients := s.clientsOfSite(site)
+		if len(clients) != want {
+			t.Fatal("site", site, "want clients", want, "got", len(clients))
+		}
+		for _, c := range clients {
+			if c.site != site {
+				t.Fatal("client", c, "in site", site)
+			}
+		}
+	}
+
+	status := s.sitesStatus()
+	if len(status) != 2 || status[0].Site != ctrl.DEFAULT_SITE || status[1].Site != "home1" || status[1].Tunnels != 2 {
+		t.Fatal("bad sites status", status)
+	}
+}
+
+// TestGetFreeClient a stream is never handed to the client of another site or a draining one.
+func TestGetFreeClient(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	startSiteAgents(t, s, "home1", "home1", "home2")
+
+	if _, err := s.getFreeClient("home3"); err == nil {
+		t.Fatal("want error of a site without client")
+	}
+	if c, err := s.getFreeClient("home2"); err != nil || c.site != "home2" {
+		t.Fatal("home2 got", c, err)
+	}
+
+	home1 := s.clientsOfSite("home1")
+	drain(t, home1[0])
+	for i := 0; i < 10; i++ {
+		c, err := s.getFreeClient("home1")
+		if err != nil || c != home1[1] {
+			t.Fatal("want the not draining client", home1[1], "got", c, err)
+		}
+	}
+
+	// all of home1 draining, home2 is still online but not for home1
+	drain(t, home1[1])
+	if c, err := s.getFreeClient("home1"); err == nil {
+		t.Fatal("want error of all clients draining, got", c)
+	}
+	if c, err := s.getFreeClient("home2"); err != nil || c.site != "home2" {
+		t.Fatal("home2 got", c, err)
+	}
+}
@@ -1,9 +1,9 @@
 package svr
 
 import (
+	"context"
+	"crypto/tls"
 	"ctrl"
-	"encoding/base64"
-	"fmt"
 	"libs/log"
 	"net"
 	"net/http"
@@ -15,102 +15,234 @@ const (
 )
 
 type Config struct {
-	Auth                     string // username:password, used in the http-header()
-	Stop                     bool   // TODO
-	client_conf_forward_host string // client's local network servier ip:host which data forward
+	ForwardListen   string   `json:"ForwardListen"`   // public listen of the default route, empty is no default route
+	WebsocketListen string   `json:"WebsocketListen"` // websocket, admin and api listen
+	Auth            string   `json:"Auth"`            // admin username:password, also the tunnel's when no CredentialFile
+	AdminUsers      []string `json:"AdminUsers"`      // more admin username:password
+	CredentialFile  string   `json:"CredentialFile"`  // per-client token of the tunnel, empty is disabled
+	LogLevel        string   `json:"LogLevel"`
+	LogFile         string   `json:"LogFile"` // empty is stdout
+	Routes          []*Route `json:"Routes"`  // routes listen at start, besides the default one
+	Stop            bool     `json:"-"`       // TODO
+
+	MaxAuthFailures int    `json:"MaxAuthFailures"` // lock the IP out after continuous failures, default 5, the admin and the routes are counted apart
+	AuthLockout     int    `json:"AuthLockout"`     // seconds, default 300
+	AuditLogFile    string `json:"AuditLogFile"`    // who authenticated, empty is the std log
+
+	PingInterval   int `json:"PingInterval"`   // seconds between heartbeat pings, default 30
+	MaxMissedPongs int `json:"MaxMissedPongs"` // close the tunnel after these pings not answered, default 3
+
+	UDPIdleTimeout int `json:"UDPIdleTimeout"` // seconds, close the UDP session of a peer which is idle, default 60
+
+	ReverseTargets []string `json:"ReverseTargets"` // host:port the clients' reverse routes can connect, empty is disabled
+
+	// wss:// for the websocket listen, a self-signed cert is generated if TLSCertFile not exists.
+	TLS         bool     `json:"TLS"`
+	TLSCertFile string   `json:"TLSCertFile"` // default svr_cert.pem
+	TLSKeyFile  string   `json:"TLSKeyFile"`  // default svr_key.pem
+	TLSHosts    []string `json:"TLSHosts"`    // DNS names or IPs of the self-signed cert
 }
 
-var pConfig *Config
+// Server is one relay: the routes, the online tunnels, the credentials and the admin endpoints,
+// more than one can run in a process.
+type Server struct {
+	lastTunnelID uint64 // atomic, first for the 64-bit alignment on 32-bit platforms
 
-func authOK(req *http.Request) bool {
-	if pConfig == nil && pConfig.Auth == "" {
-		log.Info("did not need auth.")
-		return true
+	conf    *Config
+	started time.Time
+
+	mux      *http.ServeMux
+	http     *http.Server
+	listener net.Listener  // websocket, admin and api
+	done     chan struct{} // closed when the http server stopped
+
+	routes  *routeTable
+	onlines *online
+	creds   *credentialStore
+
+	adminAuth    Authenticator
+	limiter      *authLimiter // the admin and the tunnels
+	routeLimiter *authLimiter // the logins of the http and proxy routes, they can not lock out the admin
+	auditLog     *log.Logger  // nil is the std log
+
+	logs *log.RingHandler // the log viewer, nil is disabled
+}
+
+// NewServer check the config, load the credentials and build the http handlers, nothing is listened.
+func NewServer(conf *Config) (*Server, error) {
+	if conf == nil {
+		panic("config is nil.")
+	}
+	s := &Server{
+		conf:    conf,
+		started: time.Now(),
+		mux:     http.NewServeMux(),
+		done:    make(chan struct{}),
+		routes:  newRouteTable(),
+		onlines: newOnline(),
+		creds:   newCredentialStore(),
+	}
+	if err := s.initAuth(); err != nil {
+		return nil, err
+	}
+	if conf.CredentialFile != "" {
+		if err := s.creds.load(conf.CredentialFile); err != nil {
+			return nil, err
+		}
 	}
 
-	var auth = req.Header.Get("Authorization")
-	log.Debug("reuquest Auth->[%s]", auth)
+	s.mux.HandleFunc(ctrl.WEBSOCKET_CONNECT_URI, s.WebsocketHandler)
+	s.mux.HandleFunc(WEBSOCKET_CONTORL_URI, s.httpAdminHandler)
+	s.mux.HandleFunc("/api/", s.httpApiHandler)
+	s.mux.HandleFunc(API_V1_URI, s.httpApiV1Handler)
 
-	return auth == pConfig.Auth
+	s.http = &http.Server{
+		Handler:        s.mux,
+		ReadTimeout:    0 * time.Second,
+		WriteTimeout:   0 * time.Second,
+		MaxHeaderBytes: 1 << 20, // 1M
+	}
+	return s, nil
 }
 
-func setSTDheader(w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, pre-check=0, post-check=0, max-age=0")
-	w.Header().Set("Expires", "Mon, 3 Jan 2000 12:34:56 GMT")
+// ServeMux the handlers of the websocket, /admin/ and /api/, more can be added before Start.
+func (s *Server) ServeMux() *http.ServeMux {
+	return s.mux
 }
 
-func noAuthResponse(w http.ResponseWriter) {
-	setSTDheader(w)
-	w.Header().Set("WWW-Authenticate", "Basic realm=\"TCP-Forward-Serv\"")
-	w.WriteHeader(401)
-	w.Write([]byte(`401: Not Authenticated!username and password do not match to configuration`))
+// SetLogViewer show the lines kept by h in the dashboard and /api/v1/logs, call it before Start.
+func (s *Server) SetLogViewer(h *log.RingHandler) {
+	s.logs = h
 }
 
-func ipforward(c net.Conn) {
-	//只支持 TCP 协议的 Forward，如http,ssh
-	log.Debug("new connect [%s]", c.RemoteAddr())
-	defer c.Close()
-	err := bindConnection(c)
+// Config return the config of the server, it must not be changed.
+func (s *Server) Config() *Config {
+	return s.conf
+}
 
-	if err != nil {
-		c.Write([]byte(err.Error())) //c maybe closed.
-		log.Error("Forward PutConnection err=%s", err.Error())
+// Start listen the routes and the websocket, then return, the connections are served in goroutines.
+func (s *Server) Start() error {
+	if s.conf.ForwardListen != "" {
+		err := s.AddRoute(&Route{Name: Default_Route_Name, Listen: s.conf.ForwardListen})
+		if err != nil {
+			log.Error("listen default route[%s] err=%s", s.conf.ForwardListen, err.Error())
+		}
+	}
+	for _, route := range s.conf.Routes {
+		if err := s.AddRoute(route); err != nil {
+			log.Error("listen route[%s] err=%s", route, err.Error())
+		}
 	}
-}
 
-func ListenIPForwardAndWebsocketServ(forwardHostAndPort, websocketHostAndPort string, conf *Config) {
-	if conf == nil {
-		panic("config is nil.")
+	l, err := net.Listen("tcp", s.conf.WebsocketListen)
+	if err != nil {
+		return err
 	}
-	pConfig = conf
-	if pConfig.Auth != "" {
-		pConfig.Auth = fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(pConfig.Auth)))
+	if s.conf.TLS {
+		tlsConf, err := loadTLSConfig(s.conf)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		l = tls.NewListener(l, tlsConf)
 	}
+	s.listener = l
+	log.Info("Websocket Listen in TCP[%s] TLS[%v]", l.Addr(), s.conf.TLS)
 
-	go listenWebsocketServ(websocketHostAndPort, ctrl.WEBSOCKET_CONNECT_URI, WEBSOCKET_CONTORL_URI)
+	go func() {
+		defer close(s.done)
+		if err := s.http.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("ListenAndServe[%v], err=[%v]", l.Addr(), err.Error())
+		}
+		log.Info("ListenWebsocketServ exit.")
+	}()
+	return nil
+}
 
-	l, err := net.Listen("tcp", forwardHostAndPort)
-	if err != nil {
-		log.Error(err.Error())
+// Addr of the websocket listen, nil before Start.
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
 	}
-	defer l.Close()
+	return s.listener.Addr()
+}
 
-	log.Debug("IP Forward Listening TCP[%s]", forwardHostAndPort)
+// Wait until the websocket listen stopped.
+func (s *Server) Wait() {
+	<-s.done
+}
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Error("IP-Forward Accept err=%s", err.Error())
-			continue
+// Shutdown stop all routes, tell the clients by Close_Server_Shutdown and stop the http server,
+// the tunnels still not closed when ctx is done are closed at once.
+func (s *Server) Shutdown(ctx context.Context) error {
+	for _, route := range s.Routes() {
+		s.RemoveRoute(route.Name)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.CloseTunnels(ctrl.Close_Server_Shutdown, "server shutdown")
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		for _, cli := range s.onlineClients() {
+			cli.session.Close()
 		}
-		// handle socket data recv and send
-		go ipforward(conn)
 	}
 
-	log.Info("ListenAndIPForwardServ exit.")
+	if s.listener == nil {
+		return nil
+	}
+	return s.http.Shutdown(ctx)
 }
 
-func listenWebsocketServ(hostAndPort string, websocketURI, contorlURI string) {
-	// TODO：连接认证
-	http.HandleFunc(websocketURI, WebsocketHandler)
+func setSTDheader(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, pre-check=0, post-check=0, max-age=0")
+	w.Header().Set("Expires", "Mon, 3 Jan 2000 12:34:56 GMT")
+}
 
-	http.HandleFunc(contorlURI, httpAdminHandler)
-	http.HandleFunc("/api/", httpApiHandler)
+func noAuthResponse(w http.ResponseWriter) {
+	setSTDheader(w)
+	w.Header().Set("WWW-Authenticate", "Basic realm=\"TCP-Forward-Serv\"")
+	w.WriteHeader(401)
+	w.Write([]byte(`401: Not Authenticated!username and password do not match to configuration`))
+}
 
-	log.Info("Websocket Listen in TCP[%s]", hostAndPort)
-	svr := &http.Server{
-		Addr:           hostAndPort,
-		Handler:        nil,
-		ReadTimeout:    0 * time.Second,
-		WriteTimeout:   0 * time.Second,
-		MaxHeaderBytes: 1 << 20, // 1M
+func (s *Server) ipforward(c net.Conn, route *Route) {
+	// TCP 协议的 Forward，如http,ssh; UDP 见 udp_route.go
+	log.Debug("new connect [%s] of route[%s]", c.RemoteAddr(), route.Name)
+	defer c.Close()
+	if route.isProxy() {
+		s.serveProxy(c, route)
+		return
 	}
+	if route.isVHost() {
+		s.serveVHost(c, route)
+		return
+	}
+	err := s.bindConnection(c, route)
 
-	err := svr.ListenAndServe()
+	if err != nil {
+		c.Write([]byte(err.Error())) //c maybe closed.
+		log.Error("Forward PutConnection err=%s", err.Error())
+	}
+}
 
+// ListenIPForwardAndWebsocketServ run a Server until its websocket listen stopped.
+func ListenIPForwardAndWebsocketServ(conf *Config) {
+	s, err := NewServer(conf)
 	if err != nil {
-		log.Error("ListenAndServe[%v], err=[%v]", hostAndPort, err.Error())
+		log.Error("init server err=%s", err.Error())
+		return
+	}
+	if err := s.Start(); err != nil {
+		log.Error("ListenAndServe[%v], err=[%v]", conf.WebsocketListen, err.Error())
+		return
 	}
-	log.Info("ListenWebsocketServ exit.")
+	s.Wait()
+
+	log.Info("ListenAndIPForwardServ exit.")
 }
@@ -0,0 +1,121 @@
+package svr
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"ctrl"
+	"encoding/pem"
+	"fmt"
+	"libs/log"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	Default_TLS_Cert_File = "svr_cert.pem"
+	Default_TLS_Key_File  = "svr_key.pem"
+
+	self_signed_cert_valid = 10 * 365 * 24 * time.Hour
+)
+
+// loadTLSConfig load the cert and key, generate a self-signed one at first start if the files not exist.
+func loadTLSConfig(conf *Config) (*tls.Config, error) {
+	certFile, keyFile := conf.TLSCertFile, conf.TLSKeyFile
+	if certFile == "" {
+		certFile = Default_TLS_Cert_File
+	}
+	if keyFile == "" {
+		keyFile = Default_TLS_Key_File
+	}
+
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	switch {
+	case os.IsNotExist(certErr) && os.IsNotExist(keyErr):
+		log.Warn("TLS cert[%s] not exists, generate a self-signed one.", certFile)
+		if err := generateSelfSignedCert(certFile, keyFile, conf.TLSHosts); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(certErr) || os.IsNotExist(keyErr):
+		// never overwrite a key or a cert which the user may need
+		return nil, fmt.Errorf("TLS cert[%s] and key[%s] must both exist, or neither to generate a self-signed one.", certFile, keyFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	// client can pin the cert by this fingerprint
+	log.Warn("TLS cert[%s] SHA-256 fingerprint[%s]", certFile, ctrl.CertFingerprint(cert.Certificate[0]))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"}, // websocket need Hijack, no h2
+	}, nil
+}
+
+// generateSelfSignedCert the cert is also a CA, so the client can pin it by TLSCAFile.
+func generateSelfSignedCert(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "fuck-ADSL relay", Organization: []string{"fuck-ADSL"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(self_signed_cert_valid),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	// copy, do not write into the backing array of the config's hosts
+	hosts = append(append([]string{}, hosts...), "localhost", "127.0.0.1")
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePem(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	return writePem(keyFile, "EC PRIVATE KEY", keyDer, 0600)
+}
+
+func writePem(fileName, typ string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
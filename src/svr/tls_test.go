@@ -0,0 +1,83 @@
+package svr
+
+import (
+	"bytes"
+	"crypto/x509"
+	"ctrl"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tlsTestConfig(t *testing.T) *Config {
+	dir, err := ioutil.TempDir("", "tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &Config{
+		TLSCertFile: filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:  filepath.Join(dir, "key.pem"),
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	conf := tlsTestConfig(t)
+	// extra capacity, the generated hosts must not be written into it
+	hosts := make([]string, 2, 8)
+	hosts[0], hosts[1] = "relay.example.com", "10.1.2.3"
+	conf.TLSHosts = hosts
+
+	tlsConf, err := loadTLSConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra := hosts[:4]; extra[2] != "" || extra[3] != "" {
+		t.Fatal("the config's hosts was changed", extra)
+	}
+
+	cert, err := x509.ParseCertificate(tlsConf.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"relay.example.com", "10.1.2.3", "localhost", "127.0.0.1"} {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Error(err)
+		}
+	}
+	if !cert.IsCA {
+		t.Fatal("the self-signed cert must be a CA, the client pin it by TLSCAFile")
+	}
+	info, err := os.Stat(conf.TLSKeyFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("the key must be readable only by the owner", info.Mode(), err)
+	}
+
+	// the second start load the same cert
+	again, err := loadTLSConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctrl.CertFingerprint(again.Certificates[0].Certificate[0]) != ctrl.CertFingerprint(cert.Raw) {
+		t.Fatal("the cert was generated again")
+	}
+}
+
+// TestTLSKeyNotOverwritten only one of the files exists, nothing is generated.
+func TestTLSKeyNotOverwritten(t *testing.T) {
+	conf := tlsTestConfig(t)
+	key := []byte("the user's key")
+	if err := ioutil.WriteFile(conf.TLSKeyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTLSConfig(conf); err == nil {
+		t.Fatal("want error if only the key exists")
+	}
+	if got, _ := ioutil.ReadFile(conf.TLSKeyFile); !bytes.Equal(got, key) {
+		t.Fatal("the key file was overwritten")
+	}
+	if _, err := os.Stat(conf.TLSCertFile); !os.IsNotExist(err) {
+		t.Fatal("the cert was generated", err)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+	UDP route: every public peer of the route is a UDP session,
+	the datagrams of the session are carried by one stream.
+*/
+
+package svr
+
+import (
+	"ctrl"
+	"errors"
+	"libs/log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tunnel"
+)
+
+var ErrRouteClosed = errors.New("route was closed")
+
+// datagrams of a peer waiting for its stream's window, more are dropped like a full socket buffer.
+const udp_peer_queue = 64
+
+type udpPeer struct {
+	// atomic, first for the 64-bit alignment on 32-bit platforms
+	active  int64 // UnixNano of the last datagram
+	dropped int64 // datagrams dropped because the queue was full
+
+	addr      net.Addr
+	stream    *tunnel.Stream
+	queue     chan []byte
+	done      chan struct{} // closed by close
+	closeOnce sync.Once
+}
+
+func newUDPPeer(addr net.Addr, stream *tunnel.Stream) *udpPeer {
+	peer := &udpPeer{
+		addr:   addr,
+		stream: stream,
+		queue:  make(chan []byte, udp_peer_queue),
+		done:   make(chan struct{}),
+	}
+	peer.touch()
+	return peer
+}
+
+func (p *udpPeer) touch() {
+	atomic.StoreInt64(&p.active, time.Now().UnixNano())
+}
+
+func (p *udpPeer) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&p.active))
+}
+
+// push queue the datagram without blocking, false if it was dropped.
+func (p *udpPeer) push(data []byte) bool {
+	select {
+	case p.queue <- append([]byte(nil), data...):
+		return true
+	default:
+		atomic.AddInt64(&p.dropped, 1)
+		return false
+	}
+}
+
+func (p *udpPeer) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.stream.Close()
+	})
+}
+
+type udpRoute struct {
+	svr   *Server
+	route *Route
+	pc    net.PacketConn
+
+	rw    *sync.Mutex
+	peers map[string]*udpPeer // key is peer addr
+	done  chan struct{}
+}
+
+func newUDPRoute(s *Server, route *Route, pc net.PacketConn) *udpRoute {
+	return &udpRoute{
+		svr:   s,
+		route: route,
+		pc:    pc,
+		rw:    new(sync.Mutex),
+		peers: make(map[string]*udpPeer),
+		done:  make(chan struct{}),
+	}
+}
+
+func (s *Server) udpIdleTimeout() time.Duration {
+	if s.conf.UDPIdleTimeout <= 0 {
+		return tunnel.Default_UDP_Idle_Timeout
+	}
+	return time.Duration(s.conf.UDPIdleTimeout) * time.Second
+}
+
+func (u *udpRoute) serve() {
+	log.Debug("IP Forward Listening UDP[%s] for route[%s]", u.route.Listen, u.route.Name)
+	go u.expire()
+
+	buf := make([]byte, tunnel.Max_Datagram_Size)
+	for {
+		n, addr, err := u.pc.ReadFrom(buf)
+		if err != nil {
+			if u.svr.isRouteRemoved(u.route) {
+				break
+			}
+			log.Error("IP-Forward route[%s] ReadFrom err=%s", u.route.Name, err.Error())
+			continue
+		}
+
+		peer, err := u.getPeer(addr)
+		if err != nil {
+			log.Error("route[%s] peer[%s] err=%s", u.route.Name, addr, err.Error())
+			continue
+		}
+		peer.touch()
+		// a slow peer must not stall the others of the route
+		if !peer.push(buf[:n]) {
+			log.Debug("[%s] queue of UDP peer[%s] is full, drop datagram size=%d", peer.stream, addr, n)
+		}
+	}
+	log.Info("route[%s] stop listen.", u.route)
+}
+
+// getPeer return the session of addr, open a stream for the new peer.
+func (u *udpRoute) getPeer(addr net.Addr) (*udpPeer, error) {
+	u.rw.Lock()
+	peer, find := u.peers[addr.String()]
+	u.rw.Unlock()
+	if find {
+		return peer, nil
+	}
+
+	// Open write to the websocket, the lock is not held meanwhile
+	client, err := u.svr.getFreeClient(u.route.site())
+	if err != nil {
+		return nil, err
+	}
+	info := ctrl.ConnectInfo{Route: u.route.Name, Target: u.route.Target, Proto: ctrl.PROTO_UDP, Peer: addr.String()}
+	stream, err := client.session.Open(info.String())
+	if err != nil {
+		return nil, err
+	}
+	return u.addPeer(addr, stream)
+}
+
+// addPeer start the session of addr on stream.
+func (u *udpRoute) addPeer(addr net.Addr, stream *tunnel.Stream) (*udpPeer, error) {
+	u.rw.Lock()
+	select {
+	case <-u.done:
+		u.rw.Unlock()
+		stream.Close()
+		return nil, ErrRouteClosed
+	default:
+	}
+	if peer, find := u.peers[addr.String()]; find {
+		u.rw.Unlock()
+		stream.Close()
+		return peer, nil
+	}
+	peer := newUDPPeer(addr, stream)
+	u.peers[addr.String()] = peer
+	u.rw.Unlock()
+	log.Info("route[%s] new UDP peer[%s] on stream[%s].", u.route.Name, addr, stream)
+
+	go u.send(peer)
+	go u.reply(peer)
+	return peer, nil
+}
+
+// send write the queued datagrams of the peer to its stream, it may wait for the window.
+func (u *udpRoute) send(peer *udpPeer) {
+	for {
+		select {
+		case <-peer.done:
+			return
+		case data := <-peer.queue:
+			if err := tunnel.WriteDatagram(peer.stream, data); err != nil {
+				log.Warn("[%s] send datagram of peer[%s] err=%s", peer.stream, peer.addr, err.Error())
+				u.closePeer(peer)
+				return
+			}
+		}
+	}
+}
+
+// reply send the datagrams from the client back to the peer.
+func (u *udpRoute) reply(peer *udpPeer) {
+	defer u.closePeer(peer)
+
+	buf := make([]byte, tunnel.Max_Datagram_Size)
+	for {
+		n, err := tunnel.ReadDatagram(peer.stream, buf)
+		if err != nil {
+			log.Debug("[%s] UDP peer[%s] end, err=%v", peer.stream, peer.addr, err)
+			return
+		}
+		peer.touch()
+		if _, err := u.pc.WriteTo(buf[:n], peer.addr); err != nil {
+			log.Warn("route[%s] WriteTo peer[%s] err=%s", u.route.Name, peer.addr, err.Error())
+		}
+	}
+}
+
+func (u *udpRoute) closePeer(peer *udpPeer) {
+	u.rw.Lock()
+	if u.peers[peer.addr.String()] == peer {
+		delete(u.peers, peer.addr.String())
+	}
+	u.rw.Unlock()
+	if n := atomic.LoadInt64(&peer.dropped); n > 0 {
+		log.Warn("route[%s] UDP peer[%s] end, [%d] datagrams dropped by the full queue.", u.route.Name, peer.addr, n)
+	}
+	peer.close()
+}
+
+// expire close the peers which are idle longer than udpIdleTimeout.
+func (u *udpRoute) expire() {
+	timeout := u.svr.udpIdleTimeout()
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+		}
+
+		u.rw.Lock()
+		var idle []*udpPeer
+		for _, peer := range u.peers {
+			if peer.idle() > timeout {
+				idle = append(idle, peer)
+			}
+		}
+		u.rw.Unlock()
+
+		for _, peer := range idle {
+			log.Info("route[%s] UDP peer[%s] idle, close it.", u.route.Name, peer.addr)
+			u.closePeer(peer)
+		}
+	}
+}
+
+func (u *udpRoute) close() error {
+	close(u.done)
+	err := u.pc.Close()
+
+	u.rw.Lock()
+	peers := u.peers
+	u.peers = make(map[string]*udpPeer)
+	u.rw.Unlock()
+
+	for _, peer := range peers {
+		peer.close()
+	}
+	return err
+}
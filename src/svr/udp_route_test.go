@@ -0,0 +1,81 @@
+package svr
+
+import (
+	"encoding/binary"
+	"libs/websocket"
+	"net"
+	"testing"
+	"time"
+	"tunnel"
+)
+
+// TestUDPSlowPeer a peer whose stream has no window must not stall the other peers of the route.
+func TestUDPSlowPeer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := tunnel.NewSession(websocket.NewConn(c1, true), true)
+	defer session.Close()
+
+	// the client read everything but never grant the window
+	fast := make(chan struct{}, 1)
+	var fastID uint32
+	peer := websocket.NewConn(c2, false)
+	go func() {
+		for {
+			mt, msg, err := peer.ReadMessage()
+			if err != nil {
+				return
+			}
+			if mt == websocket.BinaryMessage && binary.BigEndian.Uint32(msg) == fastID {
+				select {
+				case fast <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	slowStream, err := session.Open("slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// use up the window of the slow stream
+	if _, err := slowStream.Write(make([]byte, tunnel.Default_Stream_Window)); err != nil {
+		t.Fatal(err)
+	}
+	fastStream, err := session.Open("fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastID = fastStream.ID()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUDPRoute(newTestServer(t), &Route{Name: "udp", Proto: "udp"}, pc)
+	defer u.close()
+
+	slowConn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer slowConn.Close()
+	fastConn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer fastConn.Close()
+	if _, err := u.addPeer(slowConn.LocalAddr(), slowStream); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.addPeer(fastConn.LocalAddr(), fastStream); err != nil {
+		t.Fatal(err)
+	}
+	go u.serve()
+
+	for i := 0; i < udp_peer_queue*2; i++ {
+		slowConn.WriteTo([]byte("slow"), pc.LocalAddr())
+	}
+	time.Sleep(50 * time.Millisecond)
+	fastConn.WriteTo([]byte("fast"), pc.LocalAddr())
+
+	select {
+	case <-fast:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the fast peer was stalled by the slow one")
+	}
+}
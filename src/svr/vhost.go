@@ -0,0 +1,286 @@
+/*
+	virtual host route: many hostnames on one public port,
+	the connection is routed by the HTTP Host header or the TLS SNI.
+*/
+
+package svr
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"ctrl"
+	"errors"
+	"fmt"
+	"io"
+	"libs/log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"tunnel"
+)
+
+const (
+	// max size of the HTTP request header or the TLS ClientHello which is read to find the host.
+	vhost_peek_size = 16 * 1024
+	vhost_timeout   = 10 * time.Second
+
+	tls_record_header_size = 5
+	tls_record_handshake   = 0x16
+)
+
+var (
+	ErrNoHost     = errors.New("no Host header or TLS SNI")
+	errSNIFound   = errors.New("sni found")
+	errReadOnly   = errors.New("read only conn")
+	ErrHeaderSize = errors.New("request header too large")
+)
+
+type VHost struct {
+	Host   string `json:"Host"`   // cam1.example.com, *.example.com, or * for the others
+	Target string `json:"Target"` // host:port in the client side, empty is client's LocalHostServ
+	Site   string `json:"Site"`   // empty is the site of the route
+}
+
+// ParseVHost parse "route,host[,target[,site]]", return the route name and the vhost.
+func ParseVHost(s string) (string, *VHost, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) < 2 || len(fields) > 4 {
+		return "", nil, fmt.Errorf("vhost[%s] format must be route,host[,target[,site]]", s)
+	}
+	vhost := &VHost{Host: strings.ToLower(strings.TrimSpace(fields[1]))}
+	if len(fields) >= 3 {
+		vhost.Target = strings.TrimSpace(fields[2])
+	}
+	if len(fields) == 4 {
+		vhost.Site = strings.TrimSpace(fields[3])
+	}
+	return strings.TrimSpace(fields[0]), vhost, nil
+}
+
+func (v *VHost) String() string {
+	target := v.Target
+	if target == "" {
+		target = "<client-default>"
+	}
+	site := v.Site
+	if site == "" {
+		site = "<route-site>"
+	}
+	return fmt.Sprintf("%s->%s@%s", v.Host, target, site)
+}
+
+// site the vhost of no site is served by the site of its route.
+func (v *VHost) site(route *Route) string {
+	if v.Site == "" {
+		return route.site()
+	}
+	return v.Site
+}
+
+func (v *VHost) match(host string) bool {
+	switch {
+	case v.Host == "*":
+		return true
+	case strings.HasPrefix(v.Host, "*."):
+		return strings.HasSuffix(host, v.Host[1:])
+	}
+	return v.Host == host
+}
+
+// findVHost the exact host first, then *.domain, then *.
+func (r *Route) findVHost(host string) *VHost {
+	r.vrw.RLock()
+	defer r.vrw.RUnlock()
+
+	var wildcard, any *VHost
+	for _, v := range r.VHosts {
+		switch {
+		case v.Host == host:
+			return v
+		case v.Host == "*":
+			any = v
+		case wildcard == nil && v.match(host):
+			wildcard = v
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return any
+}
+
+// AddVHost add a hostname to the vhost route.
+func (s *Server) AddVHost(routeName string, vhost *VHost) error {
+	vhost.Host = strings.ToLower(strings.TrimSpace(vhost.Host))
+	if vhost.Host == "" {
+		return fmt.Errorf("vhost host can not be empty.")
+	}
+
+	route := s.findRoute(routeName)
+	if route == nil || !route.isVHost() {
+		return fmt.Errorf("vhost route[%s] not found.", routeName)
+	}
+	route.vrw.Lock()
+	defer route.vrw.Unlock()
+	for _, v := range route.VHosts {
+		if v.Host == vhost.Host {
+			return fmt.Errorf("vhost[%s] already exists in route[%s].", v, routeName)
+		}
+	}
+	route.VHosts = append(route.VHosts, vhost)
+	log.Info("route[%s] vhost[%s] added.", routeName, vhost)
+	return nil
+}
+
+// RemoveVHost remove the hostname from the vhost route.
+func (s *Server) RemoveVHost(routeName, host string) error {
+	host = strings.ToLower(strings.TrimSpace(host))
+
+	route := s.findRoute(routeName)
+	if route == nil || !route.isVHost() {
+		return fmt.Errorf("vhost route[%s] not found.", routeName)
+	}
+	route.vrw.Lock()
+	defer route.vrw.Unlock()
+	for i, v := range route.VHosts {
+		if v.Host == host {
+			route.VHosts = append(route.VHosts[:i:i], route.VHosts[i+1:]...)
+			log.Info("route[%s] vhost[%s] removed.", routeName, v)
+			return nil
+		}
+	}
+	return fmt.Errorf("vhost[%s] not found in route[%s].", host, routeName)
+}
+
+func (s *Server) serveVHost(conn net.Conn, route *Route) {
+	conn.SetReadDeadline(time.Now().Add(vhost_timeout))
+	r := bufio.NewReaderSize(conn, vhost_peek_size)
+	host, err := peekHost(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Warn("vhost route[%s] conn[%s] err=%s", route.Name, conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	vhost := route.findVHost(host)
+	if vhost == nil {
+		log.Warn("vhost route[%s] conn[%s] host[%s] not found.", route.Name, conn.RemoteAddr(), host)
+		return
+	}
+
+	client, err := s.getFreeClient(vhost.site(route))
+	if err != nil {
+		log.Error("vhost route[%s] host[%s] err=%s", route.Name, host, err.Error())
+		return
+	}
+	info := ctrl.ConnectInfo{Route: route.Name, Target: vhost.Target}
+	stream, err := client.session.Open(info.String())
+	if err != nil {
+		log.Error("vhost route[%s] open stream err=%s", route.Name, err.Error())
+		return
+	}
+	log.Info("vhost conn[%s] route[%s] host[%s] to stream[%s].", conn.RemoteAddr(), route.Name, host, stream)
+
+	// the peeked data is still in r, it is sent first.
+	tunnel.Join(stream, &bufferedConn{Conn: conn, r: r})
+}
+
+// peekHost find the host without consuming the data of r.
+func peekHost(r *bufio.Reader) (string, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	var host string
+	if first[0] == tls_record_handshake {
+		host, err = peekSNI(r)
+	} else {
+		host, err = peekHTTPHost(r)
+	}
+	if err != nil {
+		return "", err
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return "", ErrNoHost
+	}
+	return host, nil
+}
+
+func peekHTTPHost(r *bufio.Reader) (string, error) {
+	for {
+		data, _ := r.Peek(r.Buffered())
+		if end := bytes.Index(data, []byte("\r\n\r\n")); end >= 0 {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data[:end+4])))
+			if err != nil {
+				return "", err
+			}
+			return req.Host, nil
+		}
+		if len(data) >= r.Size() {
+			return "", ErrHeaderSize
+		}
+		// wait for more data of the header
+		if _, err := r.Peek(len(data) + 1); err != nil {
+			return "", err
+		}
+	}
+}
+
+// vhostsString the hostnames of the vhost route.
+func (r *Route) vhostsString() string {
+	r.vrw.RLock()
+	defer r.vrw.RUnlock()
+	var hosts []string
+	for _, v := range r.VHosts {
+		hosts = append(hosts, v.String())
+	}
+	return strings.Join(hosts, " ")
+}
+
+func peekSNI(r *bufio.Reader) (string, error) {
+	header, err := r.Peek(tls_record_header_size)
+	if err != nil {
+		return "", err
+	}
+	size := tls_record_header_size + int(header[3])<<8 + int(header[4])
+	if size > r.Size() {
+		return "", ErrHeaderSize
+	}
+	hello, err := r.Peek(size)
+	if err != nil {
+		return "", err
+	}
+
+	// crypto/tls parse the ClientHello, the handshake stop at GetConfigForClient.
+	var sni string
+	tls.Server(readOnlyConn{bytes.NewReader(hello)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = h.ServerName
+			return nil, errSNIFound
+		},
+	}).Handshake()
+	if sni == "" {
+		return "", ErrNoHost
+	}
+	return sni, nil
+}
+
+// readOnlyConn feed the peeked ClientHello to crypto/tls.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, errReadOnly }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
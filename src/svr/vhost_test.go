@@ -0,0 +1,78 @@
+package svr
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"ctrl"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestPeekHost(t *testing.T) {
+	request := "GET /video HTTP/1.1\r\nHost: Cam1.Example.com:8080\r\nUser-Agent: test\r\n\r\nbody"
+	r := bufio.NewReaderSize(bytes.NewReader([]byte(request)), vhost_peek_size)
+	host, err := peekHost(r)
+	if err != nil || host != "cam1.example.com" {
+		t.Fatal("bad http host", host, err)
+	}
+	// the peeked data must still be read.
+	if data, _ := io.ReadAll(r); string(data) != request {
+		t.Fatal("peeked data was consumed", string(data))
+	}
+
+	// capture a ClientHello
+	c1, c2 := net.Pipe()
+	go tls.Client(c1, &tls.Config{ServerName: "nas.example.com"}).Handshake()
+	r = bufio.NewReaderSize(c2, vhost_peek_size)
+	host, err = peekHost(r)
+	c1.Close()
+	if err != nil || host != "nas.example.com" {
+		t.Fatal("bad sni", host, err)
+	}
+
+	r = bufio.NewReaderSize(bytes.NewReader([]byte("GET / HTTP/1.0\r\n\r\n")), vhost_peek_size)
+	if _, err := peekHost(r); err != ErrNoHost {
+		t.Fatal("want ErrNoHost, got", err)
+	}
+}
+
+func TestFindVHost(t *testing.T) {
+	route := &Route{Name: "web", Proto: Route_Proto_VHost, VHosts: []*VHost{
+		{Host: "*", Target: "any"},
+		{Host: "*.example.com", Target: "wildcard"},
+		{Host: "cam1.example.com", Target: "cam1"},
+	}}
+	for host, target := range map[string]string{
+		"cam1.example.com": "cam1",
+		"nas.example.com":  "wildcard",
+		"example.org":      "any",
+	} {
+		if v := route.findVHost(host); v == nil || v.Target != target {
+			t.Error("host", host, "want", target, "got", v)
+		}
+	}
+
+	route.VHosts = route.VHosts[1:]
+	if v := route.findVHost("example.org"); v != nil {
+		t.Error("want no vhost, got", v)
+	}
+}
+
+func TestVHostSite(t *testing.T) {
+	route := &Route{Name: "web", Proto: Route_Proto_VHost, Site: "office", VHosts: []*VHost{
+		{Host: "cam1.example.com"},
+		{Host: "nas.example.com", Site: "home1"},
+	}}
+	for host, site := range map[string]string{"cam1.example.com": "office", "nas.example.com": "home1"} {
+		if v := route.findVHost(host); v == nil || v.site(route) != site {
+			t.Error("host", host, "want site", site, "got", v)
+		}
+	}
+
+	route.Site = ""
+	if v := route.findVHost("cam1.example.com"); v.site(route) != ctrl.DEFAULT_SITE {
+		t.Error("want the default site, got", v.site(route))
+	}
+}
@@ -15,24 +15,45 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
+	"tunnel"
 )
 
 var frameTypStr = websocket.MsgTypeS
 
+const (
+	auth_timeout = 10 * time.Second
+)
+
 type wsClient struct {
-	websocket *websocket.Conn
+	svr       *Server
+	id        uint64 // unique in the server, the admin API kick the tunnel by it
+	connected time.Time
+	session   *tunnel.Session
 	req       *http.Request // websoket 对应的 Request
+	site      string        // site ID registered in the handshake, or of the credential
+	cred      string        // credential name, empty is not token auth
 
-	rw *sync.RWMutex
+	rw            *sync.RWMutex
+	localHostServ string // client's local network servier ip:host which data forward
+	draining      bool   // client is shutting down, no new connection
+}
 
-	working       bool           //是否有绑定ip-forward连接
-	finish        chan int       // 绑定连接的是否完成
-	writerForward io.WriteCloser // ip-forward 绑定的连接
+func (c *wsClient) isDraining() bool {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return c.draining
 }
 
 func (client *wsClient) String() string {
-	return client.req.RemoteAddr
+	return client.site + "@" + client.req.RemoteAddr
+}
+
+func (c *wsClient) getLocalHostServ() string {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return c.localHostServ
 }
 
 func (c *wsClient) handlerControlMessage(bFrame []byte) error {
@@ -40,49 +61,49 @@ func (c *wsClient) handlerControlMessage(bFrame []byte) error {
 
 	if err := json.Unmarshal(bFrame, &msg); err != nil {
 		log.Warn("Recve a Text-Frame not JSON format. err=%v, frame=%v", err.Error(), string(bFrame))
+		// 读循环要继续读对方回复的 close frame, 不能在这里等待
+		go c.session.CloseWithCode(ctrl.Close_Protocol_Error, "control frame not JSON")
 		return err
 	}
 	log.Debug("TCP[%v] Get Frame T[%v], Content=%v, index=%v, ", c, msg.TypeStr(), msg.Content, msg.Index)
 
 	switch msg.Type {
+	case ctrl.Msg_New_Connection:
+		return c.acceptReverse(msg.Index, msg.Content)
+	case ctrl.Msg_Sys_Ok:
+		c.session.HandleConnected(uint32(msg.Index))
+	case ctrl.Msg_Close_Write:
+		c.session.HandleCloseWrite(uint32(msg.Index))
 	case ctrl.Msg_Request_Finish:
-		c.closeWriter()
+		c.session.HandleFinish(uint32(msg.Index))
 	case ctrl.Msg_Client_Busy:
-		c.writerForward.Write([]byte("current client was busy, pls try anthor."))
-		c.closeWriter()
+		c.session.HandleError(uint32(msg.Index), "current client was busy, pls try anthor.")
 	case ctrl.Msg_Sys_Err:
-		c.writerForward.Write([]byte(msg.Content))
-		c.closeWriter()
+		if msg.Index == 0 {
+			log.Warn("TCP[%v] client error: %s", c, msg.Content)
+			break
+		}
+		c.session.HandleError(uint32(msg.Index), msg.Content)
+	case ctrl.Msg_Window_Update:
+		return c.session.HandleWindowUpdate(uint32(msg.Index), msg.Content)
+	case ctrl.Msg_Client_Drain:
+		log.Info("Client[%s] is shutting down, no new connection.", c)
+		c.rw.Lock()
+		c.draining = true
+		c.rw.Unlock()
 	case ctrl.Msg_Get_Config:
-		log.Info("Get the Client- side local network server config[%s]", msg.Content)
-		pConfig.client_conf_forward_host = msg.Content
+		log.Info("Get the Client[%s] local network server config[%s]", c, msg.Content)
+		c.rw.Lock()
+		c.localHostServ = msg.Content
+		c.rw.Unlock()
 	default:
 		log.Warn("no handler Msg T[%s]", msg.TypeStr())
 	}
 	return nil
 }
 
-func (c *wsClient) closeWriter() {
-	if c.writerForward == nil {
-		log.Warn("whan to close an nil client.writerForward.")
-		return
-	}
-	c.rw.Lock()
-	defer c.rw.Unlock()
-	c.writerForward.Close()
-	c.working = false
-}
-
-func (c *wsClient) tellClientRequestFinish() {
-	c.websocket.WriteString(ctrl.RquestFinishFrame)
-}
-
-func (c *wsClient) tellClientNewConnection() {
-	c.websocket.WriteString(ctrl.NewConnecttion)
-}
-
 func (c *wsClient) tellClientNeedConfig() error {
-	return c.websocket.WriteString(ctrl.GetCilentConfig)
+	return c.session.WriteMessage(websocket.TextMessage, ctrl.GetCilentConfig)
 }
 
 func (c *wsClient) tellClientSetConfig(svr string) error {
@@ -91,23 +112,27 @@ func (c *wsClient) tellClientSetConfig(svr string) error {
 		Index:   0,
 		Content: svr,
 	}
-	return c.websocket.WriteString(frame.Bytes())
+	return c.session.WriteControl(&frame)
 }
 
 func (client *wsClient) waitForFrameLoop() {
+	defer client.session.CloseAll()
+
 	for {
-		frameType, bFrame, err := client.websocket.Read()
+		frameType, bFrame, err := client.session.WebSocket().Read()
 
 		log.Debug("TCP[%s] recv WebSocket Frame typ=[%v] size=[%d], crc32=[%d]",
 			client, frameTypStr(frameType), len(bFrame), crc32.ChecksumIEEE(bFrame))
 
 		if err != nil {
-			if err != io.ErrUnexpectedEOF {
+			if code := websocket.CloseCodeOf(err); code != 0 {
+				log.Warn("TCP[%s] protocol error, close code[%d] err=%v", client, code, err.Error())
+				client.session.Fail(err)
+			} else if err != io.ErrUnexpectedEOF {
 				log.Error("TCP[%s] close Unexpected err=%v", client, err.Error())
 			} else {
 				log.Debug("TCP[%s] close the socket. EOF.", client)
 			}
-			client.closeWriter()
 			return
 		}
 
@@ -115,76 +140,61 @@ func (client *wsClient) waitForFrameLoop() {
 		case websocket.TextMessage:
 			client.handlerControlMessage(bFrame)
 		case websocket.CloseMessage:
-			log.Info("TCP[%s] close Frame revced. end wait Frame loop", client)
-			client.closeWriter()
+			closeErr := websocket.ParseCloseMessage(bFrame)
+			log.Info("TCP[%s] close Frame revced code[%d] reason[%s]. end wait Frame loop", client, closeErr.Code, closeErr.Text)
+			client.session.CloseWithCode(closeErr.Code, closeErr.Text)
 			return
 		case websocket.BinaryMessage:
-			log.Info("TCP[%s] resv-binary: %v", client, len(bFrame))
-			if client.writerForward == nil {
-				log.Warn("client.writerForward is nil.")
-				continue
-			}
-
-			_, err := client.writerForward.Write(bFrame)
-			if err != nil {
-				if err != io.EOF {
-					log.Error(err.Error())
-				}
-				client.tellClientRequestFinish()
-				client.closeWriter()
+			if err := client.session.HandleBinary(bFrame); err != nil {
+				log.Warn("TCP[%s] handle binary frame err=%v", client, err)
 			}
-
-		case websocket.PingMessage, websocket.PongMessage: // IE-11 会无端端发一个pong上来
-			client.websocket.Pong(bFrame)
+		case websocket.PingMessage:
+			client.session.Pong(bFrame)
+		case websocket.PongMessage:
+			client.session.HandlePong(bFrame)
 		default:
 			log.Warn("TODO: revce frame-type=%v. can not handler. content=%v", frameTypStr(frameType), string(bFrame))
 		}
 	}
 }
 
-func getFreeClient() (*wsClient, error) {
+// getFreeClient return the online websocket of the site which carries the fewest streams.
+func (s *Server) getFreeClient(site string) (*wsClient, error) {
+	s.onlines.rw.RLock()
+	defer s.onlines.rw.RUnlock()
+
 	var client *wsClient
-	for _, cli := range _OnlineClient.onlines {
-		cli.rw.Lock()
-		if !cli.working {
-			client = cli
-			cli.working = true
-			cli.rw.Unlock()
-			break
+	var min int
+	for _, cli := range s.onlines.onlines {
+		if cli.site != site || cli.isDraining() {
+			continue
+		}
+		n := cli.session.NumStreams()
+		if client == nil || n < min {
+			client, min = cli, n
 		}
-		cli.rw.Unlock()
 	}
 
 	if client == nil {
-		return nil, fmt.Errorf("no free-websocket connect found.")
+		return nil, fmt.Errorf("no websocket connect online of site[%s].", site)
 	}
 	return client, nil
 }
 
-func bindConnection(conn net.Conn) error {
-	// 与一个websocket 绑定一个连接
-	client, err := getFreeClient()
+func (s *Server) bindConnection(conn net.Conn, route *Route) error {
+	// 在一个websocket 上打开一个stream, 与连接绑定
+	client, err := s.getFreeClient(route.site())
 	if err != nil {
 		return err
 	}
 
-	client.writerForward = conn.(io.WriteCloser)
-	client.tellClientNewConnection()
-
-	reader := conn.(io.Reader)
-	p := make([]byte, 4096)
-
-	for {
-		n, err := reader.Read(p)
-		if err != nil {
-			if err != io.EOF {
-				log.Error("Reading data from[%s] err=%s", conn.RemoteAddr(), err.Error())
-			}
-			client.closeWriter()
-			break
-		}
-		client.websocket.Write(p[:n], true)
+	stream, err := client.session.Open(route.connectInfo())
+	if err != nil {
+		return err
 	}
+	log.Info("BindConnection[%s] route[%s] to stream[%s].", conn.RemoteAddr(), route.Name, stream)
+
+	tunnel.Join(stream, conn)
 
 	log.Info("BindConnection Request finish.")
 
@@ -196,69 +206,203 @@ type online struct {
 	rw      *sync.RWMutex
 }
 
-// all online websocket connection.
-var _OnlineClient = &online{
-	onlines: make(map[string]*wsClient),
-	rw:      new(sync.RWMutex),
+func newOnline() *online {
+	return &online{
+		onlines: make(map[string]*wsClient),
+		rw:      new(sync.RWMutex),
+	}
+}
+
+// onlineClients return all online websocket.
+func (s *Server) onlineClients() []*wsClient {
+	s.onlines.rw.RLock()
+	defer s.onlines.rw.RUnlock()
+
+	clients := make([]*wsClient, 0, len(s.onlines.onlines))
+	for _, cli := range s.onlines.onlines {
+		clients = append(clients, cli)
+	}
+	return clients
+}
+
+// NumTunnels count of the online websocket of all sites.
+func (s *Server) NumTunnels() int {
+	s.onlines.rw.RLock()
+	defer s.onlines.rw.RUnlock()
+	return len(s.onlines.onlines)
 }
 
-func newWebsocketClient(conn *websocket.Conn, r *http.Request) *wsClient {
+// CloseTunnels close all online websocket by the close handshake, code tell the clients why.
+func (s *Server) CloseTunnels(code int, reason string) {
+	clients := s.onlineClients()
+
+	var wg sync.WaitGroup
+	for _, cli := range clients {
+		wg.Add(1)
+		go func(cli *wsClient) {
+			defer wg.Done()
+			cli.session.CloseWithCode(code, reason)
+		}(cli)
+	}
+	wg.Wait()
+	log.Info("[%d] tunnels closed, code[%d] reason[%s].", len(clients), code, reason)
+}
+
+// clientsOfSite return all online websocket of the site.
+func (s *Server) clientsOfSite(site string) []*wsClient {
+	s.onlines.rw.RLock()
+	defer s.onlines.rw.RUnlock()
+
+	var clients []*wsClient
+	for _, cli := range s.onlines.onlines {
+		if cli.site == site {
+			clients = append(clients, cli)
+		}
+	}
+	return clients
+}
+
+// clientsOfCredential return all online websocket authenticated by the credential.
+func (s *Server) clientsOfCredential(name string) []*wsClient {
+	s.onlines.rw.RLock()
+	defer s.onlines.rw.RUnlock()
+
+	var clients []*wsClient
+	for _, cli := range s.onlines.onlines {
+		if cli.cred == name {
+			clients = append(clients, cli)
+		}
+	}
+	return clients
+}
+
+func (s *Server) newWebsocketClient(conn *websocket.Conn, r *http.Request, site, cred string) *wsClient {
 	var client = &wsClient{
-		websocket: conn,
-		working:   false,
-		rw:        new(sync.RWMutex),
+		svr:       s,
+		id:        atomic.AddUint64(&s.lastTunnelID, 1),
+		connected: time.Now(),
+		session:   tunnel.NewSession(conn, true),
 		req:       r,
-		finish:    make(chan int, 1),
+		site:      site,
+		cred:      cred,
+		rw:        new(sync.RWMutex),
 	}
 
-	_OnlineClient.rw.Lock()
-	defer _OnlineClient.rw.Unlock()
+	s.onlines.rw.Lock()
+	defer s.onlines.rw.Unlock()
 
-	if cli, find := _OnlineClient.onlines[r.RemoteAddr]; find {
-		log.Warn("client[%s] is working[%s].", cli.req.RemoteAddr, cli.working)
-		panic("some closed client did not remove from _OnlineClient ?")
+	if cli, find := s.onlines.onlines[r.RemoteAddr]; find {
+		log.Warn("client[%s] carries [%d] streams.", cli.req.RemoteAddr, cli.session.NumStreams())
+		panic("some closed client did not remove from onlines ?")
 	}
 
-	_OnlineClient.onlines[r.RemoteAddr] = client
+	s.onlines.onlines[r.RemoteAddr] = client
 	return client
 }
 
-func websocketClose(r *http.Request) {
-	_OnlineClient.rw.RLock()
-	defer _OnlineClient.rw.RUnlock()
-	delete(_OnlineClient.onlines, r.RemoteAddr)
+func (s *Server) websocketClose(r *http.Request) {
+	s.onlines.rw.Lock()
+	defer s.onlines.rw.Unlock()
+	delete(s.onlines.onlines, r.RemoteAddr)
 }
 
-func WebsocketHandler(w http.ResponseWriter, r *http.Request) {
+// challengeClient send a random nonce, the client must answer HMAC(token, nonce) in auth_timeout.
+func (s *Server) challengeClient(conn *websocket.Conn) (*Credential, error) {
+	nonce, err := randomHex(nonce_bytes)
+	if err != nil {
+		return nil, err
+	}
+	challenge := ctrl.WebSocketControlFrame{Type: ctrl.Msg_Auth_Challenge, Content: nonce}
+	if err := conn.WriteString(challenge.Bytes()); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(auth_timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		frameType, bFrame, err := conn.Read()
+		if err != nil {
+			return nil, err
+		}
+		if frameType != websocket.TextMessage {
+			continue
+		}
+
+		msg := ctrl.WebSocketControlFrame{}
+		if err := json.Unmarshal(bFrame, &msg); err != nil {
+			return nil, err
+		}
+		if msg.Type != ctrl.Msg_Auth_Response {
+			return nil, fmt.Errorf("want Auth-Response, got[%s]", msg.TypeStr())
+		}
+		resp := ctrl.AuthResponse{}
+		if err := json.Unmarshal([]byte(msg.Content), &resp); err != nil {
+			return nil, err
+		}
+		return s.creds.verify(&resp, nonce)
+	}
+}
+
+// WebsocketHandler serve the tunnels of the clients.
+func (s *Server) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info("WebsocketHandler:%s %s %s", r.RemoteAddr, r.Method, r.URL.Path)
 
-	if !authOK(r) {
-		log.Warn("auth fail....")
-		noAuthResponse(w)
+	// token auth enabled, the admin's Basic auth is not for the tunnel.
+	tokenAuth := s.creds.enabled()
+	ip := remoteIP(r)
+	if tokenAuth {
+		if s.limiter.locked(ip) {
+			s.audit(false, "tunnel from[%s] rejected, locked out", ip)
+			lockedResponse(w, s.limiter)
+			return
+		}
+	} else if _, ok := s.authenticate(w, r, s.limiter, s.adminAuth, "tunnel"); !ok {
 		return
 	}
 
 	var conn *websocket.Conn
 	conn, err := websocket.Upgrade(w, r, http.Header{})
 	if err != nil {
-		log.Error(err.Error())
+		log.Error("websocket Upgrade[%s] err=%s", r.RemoteAddr, err.Error())
 		return
 	}
 	conn.SetReadDeadline(time.Time{})
 	conn.SetWriteDeadline(time.Time{})
 
-	var client = newWebsocketClient(conn, r)
-
-	if pConfig.client_conf_forward_host == "" {
-		log.Info("pConfig.client_conf_forward_host is empty. tell Client Need the Config.")
-		client.tellClientNeedConfig()
+	site := r.Header.Get(ctrl.WEBSOCKET_SITE_HEADER)
+	var credName string
+	if tokenAuth {
+		cred, err := s.challengeClient(conn)
+		if err != nil {
+			locked := s.limiter.fail(ip)
+			s.audit(false, "tunnel from[%s] token auth fail, err=%s locked[%v]", r.RemoteAddr, err.Error(), locked)
+			frame := ctrl.WebSocketControlFrame{Type: ctrl.Msg_Sys_Err, Content: "auth fail"}
+			conn.WriteString(frame.Bytes())
+			// no one read the reply here, do not wait for it
+			conn.WriteClose(ctrl.Close_Auth_Revoked, "auth fail")
+			conn.Close()
+			return
+		}
+		// the credential decide the site, a client can not serve other home's routes.
+		credName, site = cred.Name, cred.Site
+		s.limiter.success(ip)
+		s.audit(true, "tunnel from[%s] credential[%s] of site[%s] auth ok", r.RemoteAddr, cred.Name, cred.Site)
+	}
+	if site == "" {
+		site = ctrl.DEFAULT_SITE
 	}
 
-	log.Info("Put[%s] into the global Connect pool.", client)
+	var client = s.newWebsocketClient(conn, r, site, credName)
+	client.session.StartHeartbeat(time.Duration(s.conf.PingInterval)*time.Second, s.conf.MaxMissedPongs)
+
+	// 每个 site 的局域网服务器配置不同, 向新连接的客户端索取
+	client.tellClientNeedConfig()
+
+	log.Info("Put[%s] into the global Connect pool of site[%s].", client, client.site)
 
 	client.waitForFrameLoop()
 
-	websocketClose(r)
+	s.websocketClose(r)
 
 	log.Debug("WebsocketHandler:%s closed.", r.RemoteAddr)
 }
@@ -3,32 +3,259 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"libs/config"
 	"libs/log"
+	"os"
+	"os/signal"
+	"strings"
 	"svr"
+	"syscall"
+	"time"
+)
+
+const (
+	log_file_max_bytes    = 10 << 20
+	log_file_backup_count = 5
+	log_viewer_lines      = 1000
+
+	shutdown_timeout = 10 * time.Second
 )
 
 var _Websocketlisten string
 var _ForwardListtion string
 var _AuthUserPassword string
 var _LogLevel string
+var _LogFile string
+var _CredentialFile string
+var _AuditLogFile string
+var _Routes routeFlags
+
+var _TLS bool
+var _TLSCertFile string
+var _TLSKeyFile string
+
+var _PingInterval int
+var _MaxMissedPongs int
+
+var _ReverseTargets string
+var _VHosts vhostFlags
+
+var _ConfigFile string
+var _Dump bool
+
+// -route can be given many times
+type routeFlags []*svr.Route
+
+func (f *routeFlags) String() string {
+	var s []string
+	for _, r := range *f {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func (f *routeFlags) Set(value string) error {
+	route, err := svr.ParseRoute(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, route)
+	return nil
+}
+
+// -vhost can be given many times, route,host[,target[,site]]
+type vhostFlags []string
+
+func (f *vhostFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *vhostFlags) Set(value string) error {
+	if _, _, err := svr.ParseVHost(value); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// addVHosts add the -vhost to the routes of the config.
+func addVHosts(conf *svr.Config) error {
+	for _, s := range _VHosts {
+		name, vhost, _ := svr.ParseVHost(s)
+		var route *svr.Route
+		for _, r := range conf.Routes {
+			if r.Name == name {
+				route = r
+			}
+		}
+		if route == nil {
+			return fmt.Errorf("vhost[%s] route[%s] not found", s, name)
+		}
+		route.VHosts = append(route.VHosts, vhost)
+	}
+	return nil
+}
 
 func init() {
 	flag.StringVar(&_ForwardListtion, "tcp", "0.0.0.0:8080", "listen[0.0.0.0:8080] of tcp data forward.")
 	flag.StringVar(&_Websocketlisten, "ws", "0.0.0.0:8081", "websocket listen host[0.0.0.0:8081]")
-	flag.StringVar(&_AuthUserPassword, "auth", "", "websocket connect used auth string[username:passwrod], default is no auth.")
+	flag.StringVar(&_AuthUserPassword, "auth", "", "admin and websocket connect used auth string[username:passwrod], default is no auth.")
+	flag.StringVar(&_CredentialFile, "cred", "", "per-client token file of the websocket, the clients auth by token instead of -auth.")
 	flag.StringVar(&_LogLevel, "log", "warn", "log level [warn|error|debug|info], output the stdout.")
+	flag.StringVar(&_LogFile, "logfile", "", "log to the rotating file instead of stdout.")
+	flag.Var(&_Routes, "route", "more forward route[name,listen,target,site], e.g. ssh,0.0.0.0:2222,192.168.1.110:22")
+	flag.BoolVar(&_TLS, "tls", false, "websocket listen with TLS(wss://), a self-signed cert is generated if the cert file not exists.")
+	flag.StringVar(&_TLSCertFile, "cert", svr.Default_TLS_Cert_File, "TLS cert pem file.")
+	flag.StringVar(&_TLSKeyFile, "key", svr.Default_TLS_Key_File, "TLS key pem file.")
+	flag.StringVar(&_AuditLogFile, "audit", "", "audit log file of who authenticated, default is the std log.")
+	flag.IntVar(&_PingInterval, "ping", 30, "seconds between heartbeat pings of the websocket.")
+	flag.IntVar(&_MaxMissedPongs, "missed", 3, "close the websocket after these pings not answered.")
+	flag.Var(&_VHosts, "vhost", "hostname of the vhost route[route,host,target,site], e.g. -route web,vhost://0.0.0.0:80 -vhost web,cam1.example.com,192.168.1.20:8080")
+	flag.StringVar(&_ReverseTargets, "reverse", "", "host:port,host:port the clients' reverse routes can connect, default is none.")
+	flag.StringVar(&_ConfigFile, "config", "", "config file[.json|.toml], the flags given in command line override it.")
+	flag.BoolVar(&_Dump, "dump", false, "print the effective config and exit.")
+}
+
+// splitList "a, b" -> [a b], empty string is nil.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// loadConfig: flag default < config file < flag in command line
+func loadConfig() (*svr.Config, error) {
+	conf := &svr.Config{
+		ForwardListen:   _ForwardListtion,
+		WebsocketListen: _Websocketlisten,
+		Auth:            _AuthUserPassword,
+		CredentialFile:  _CredentialFile,
+		AuditLogFile:    _AuditLogFile,
+		LogLevel:        _LogLevel,
+		LogFile:         _LogFile,
+		Routes:          _Routes,
+
+		TLS:         _TLS,
+		TLSCertFile: _TLSCertFile,
+		TLSKeyFile:  _TLSKeyFile,
+
+		PingInterval:   _PingInterval,
+		MaxMissedPongs: _MaxMissedPongs,
+
+		ReverseTargets: splitList(_ReverseTargets),
+	}
+	if _ConfigFile != "" {
+		if err := config.Load(_ConfigFile, conf); err != nil {
+			return nil, err
+		}
+		overrideConfig(conf)
+	}
+	if err := addVHosts(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// overrideConfig by the flags given in command line.
+func overrideConfig(conf *svr.Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ping":
+			conf.PingInterval = _PingInterval
+		case "missed":
+			conf.MaxMissedPongs = _MaxMissedPongs
+		case "tcp":
+			conf.ForwardListen = _ForwardListtion
+		case "ws":
+			conf.WebsocketListen = _Websocketlisten
+		case "auth":
+			conf.Auth = _AuthUserPassword
+		case "audit":
+			conf.AuditLogFile = _AuditLogFile
+		case "cred":
+			conf.CredentialFile = _CredentialFile
+		case "log":
+			conf.LogLevel = _LogLevel
+		case "logfile":
+			conf.LogFile = _LogFile
+		case "route":
+			conf.Routes = _Routes
+		case "tls":
+			conf.TLS = _TLS
+		case "cert":
+			conf.TLSCertFile = _TLSCertFile
+		case "key":
+			conf.TLSKeyFile = _TLSKeyFile
+		case "reverse":
+			conf.ReverseTargets = splitList(_ReverseTargets)
+		}
+	})
 }
 
 func main() {
 	flag.Parse()
 
-	log.Info("app start forward[%s] websocket[%s] auth[%s] log-level[%s], ",
-		_ForwardListtion, _Websocketlisten, _AuthUserPassword, _LogLevel)
+	conf, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if _Dump {
+		fmt.Println(config.Dump(conf, "Auth", "AdminUsers"))
+		return
+	}
 
-	log.SetLevelByName(_LogLevel)
+	// the last lines are also kept for the log viewer of the dashboard
+	var h log.Handler
+	if conf.LogFile != "" {
+		h, err = log.NewRotatingFileHandler(conf.LogFile, log_file_max_bytes, log_file_backup_count)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	} else {
+		h, _ = log.NewStreamHandler(os.Stdout)
+	}
+	logs, _ := log.NewRingHandler(h, log_viewer_lines)
+	log.SetDefault(log.NewDefault(logs))
+	log.SetLevelByName(conf.LogLevel)
+
+	log.Info("app start forward[%s] websocket[%s] auth[%v] log-level[%s] routes[%d], ",
+		conf.ForwardListen, conf.WebsocketListen, conf.Auth != "" || len(conf.AdminUsers) > 0, conf.LogLevel, len(conf.Routes))
+
+	s, err := svr.NewServer(conf)
+	if err != nil {
+		log.Error("init server err=%s", err.Error())
+		os.Exit(1)
+	}
+	s.SetLogViewer(logs)
+	if err := s.Start(); err != nil {
+		log.Error("start server err=%s", err.Error())
+		os.Exit(1)
+	}
+	go onSignal(s)
+	s.Wait()
+	log.Info("app exit.")
+}
 
-	var conf = &svr.Config{Auth: _AuthUserPassword}
+// onSignal tell the clients the server is stopping, so they reconnect later instead of at once.
+func onSignal(s *svr.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
-	svr.ListenIPForwardAndWebsocketServ(_ForwardListtion, _Websocketlisten, conf)
+	sig := <-c
+	log.Warn("recv signal[%s], close all tunnels and exit.", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown_timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Error("shutdown err=%s", err.Error())
+		os.Exit(1)
+	}
 }
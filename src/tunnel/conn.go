@@ -0,0 +1,29 @@
+package tunnel
+
+import (
+	"net"
+	"time"
+)
+
+// streamAddr is the address of the stream, Network is "tunnel".
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tunnel" }
+func (a streamAddr) String() string  { return string(a) }
+
+// streamConn make the stream a net.Conn, e.g. the conn of http.Transport.
+// the deadlines are not supported, the stream is closed by the heartbeat when the tunnel is dead.
+type streamConn struct {
+	*Stream
+}
+
+// Conn return the stream as a net.Conn.
+func (s *Stream) Conn() net.Conn {
+	return streamConn{s}
+}
+
+func (c streamConn) LocalAddr() net.Addr                { return streamAddr(c.Stream.String()) }
+func (c streamConn) RemoteAddr() net.Addr               { return streamAddr(c.Stream.String()) }
+func (c streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c streamConn) SetWriteDeadline(t time.Time) error { return nil }
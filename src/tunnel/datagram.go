@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// UDP 数据报在 stream 中的格式: [2 bytes BigEndian length][payload]
+
+const (
+	Datagram_Header_Size = 2
+	Max_Datagram_Size    = 64*1024 - 1
+
+	Default_UDP_Idle_Timeout = 60 * time.Second
+)
+
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// WriteDatagram send one datagram in one Write, so it is not mixed with others.
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > Max_Datagram_Size {
+		return ErrDatagramTooLarge
+	}
+	buf := make([]byte, Datagram_Header_Size+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[Datagram_Header_Size:], p)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram read one datagram into buf, buf must be Max_Datagram_Size at least.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [Datagram_Header_Size]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buf) {
+		return 0, ErrDatagramTooLarge
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return n, nil
+}
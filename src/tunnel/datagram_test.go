@@ -0,0 +1,30 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDatagram(t *testing.T) {
+	var buf bytes.Buffer
+	datagrams := [][]byte{[]byte("dns query"), {}, bytes.Repeat([]byte{7}, Max_Datagram_Size)}
+	for _, d := range datagrams {
+		if err := WriteDatagram(&buf, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WriteDatagram(&buf, make([]byte, Max_Datagram_Size+1)); err != ErrDatagramTooLarge {
+		t.Fatal("want ErrDatagramTooLarge, got", err)
+	}
+
+	p := make([]byte, Max_Datagram_Size)
+	for _, d := range datagrams {
+		n, err := ReadDatagram(&buf, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p[:n], d) {
+			t.Fatal("datagram not match, size", len(d), n)
+		}
+	}
+}
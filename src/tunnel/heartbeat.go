@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"libs/log"
+	"libs/websocket"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	Default_Ping_Interval    = 30 * time.Second
+	Default_Max_Missed_Pongs = 3
+)
+
+// StartHeartbeat send a Ping every interval, the payload is the send time,
+// the session is closed when maxMissed Pings are not answered.
+func (s *Session) StartHeartbeat(interval time.Duration, maxMissed int) {
+	if interval <= 0 {
+		interval = Default_Ping_Interval
+	}
+	if maxMissed <= 0 {
+		maxMissed = Default_Max_Missed_Pongs
+	}
+	go s.heartbeat(interval, int32(maxMissed))
+}
+
+func (s *Session) heartbeat(interval time.Duration, maxMissed int32) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if missed := atomic.LoadInt32(&s.missedPongs); missed >= maxMissed {
+			log.Warn("[%s] missed [%d] pongs, the tunnel is dead, close it.", s, missed)
+			s.Close()
+			return
+		}
+
+		// a write blocked longer than the dead time fails, so a stuck tunnel is closed too.
+		now := time.Now()
+		s.ws.SetWriteDeadline(now.Add(interval * time.Duration(maxMissed)))
+
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+		atomic.AddInt32(&s.missedPongs, 1)
+		if err := s.WriteMessage(websocket.PingMessage, payload); err != nil {
+			log.Warn("[%s] send ping err=%s, close it.", s, err.Error())
+			s.Close()
+			return
+		}
+	}
+}
+
+// HandlePong the peer answered, measure the RTT by the payload of our Ping.
+func (s *Session) HandlePong(payload []byte) {
+	atomic.StoreInt32(&s.missedPongs, 0)
+	if len(payload) != 8 {
+		// not our ping, e.g. IE-11 会无端端发一个pong上来
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	rtt := time.Since(sent)
+	atomic.StoreInt64(&s.rtt, int64(rtt))
+	log.Debug("[%s] RTT[%s]", s, rtt)
+}
+
+// RTT of the last Ping-Pong, 0 is not measured yet.
+func (s *Session) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
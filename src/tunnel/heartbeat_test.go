@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"libs/websocket"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatRTT(t *testing.T) {
+	svr, cli := newSessionPair(t, echo)
+	defer svr.Close()
+	defer cli.Close()
+
+	cli.StartHeartbeat(20*time.Millisecond, 3)
+	time.Sleep(100 * time.Millisecond)
+
+	if cli.RTT() <= 0 {
+		t.Fatal("RTT not measured")
+	}
+	select {
+	case <-cli.done:
+		t.Fatal("alive session was closed")
+	default:
+	}
+}
+
+func TestHeartbeatDeadTunnel(t *testing.T) {
+	// the peer never read, so never answer the ping
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		// drain the pings, but no pong
+		buf := make([]byte, 1024)
+		for {
+			if _, err := c2.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	s := NewSession(websocket.NewConn(c1, false), false)
+	s.StartHeartbeat(10*time.Millisecond, 2)
+
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("dead tunnel was not closed")
+	}
+}
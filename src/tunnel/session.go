@@ -0,0 +1,312 @@
+/*
+	stream-multiplexing over one websocket connect.
+
+	Binary-Frame: [4 bytes BigEndian stream ID][payload]
+	Text-Frame:   ctrl.WebSocketControlFrame, Index is the stream ID.
+	Stream ID 0 is reserved for the messages which do not belong to any stream.
+*/
+
+package tunnel
+
+import (
+	"ctrl"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"libs/log"
+	"libs/websocket"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	Stream_Header_Size = 4
+	// max payload of one Binary-Frame, a larger Write will be split.
+	Max_Frame_Payload = 32 * 1024
+	// bytes one side can send before the peer grants more by Msg_Window_Update,
+	// it is also the max buffered data of one stream.
+	Default_Stream_Window = 256 * 1024
+	// max websocket message of the tunnel, a larger one is from a broken peer.
+	Max_Message_Size = 1 << 20
+)
+
+var (
+	ErrSessionClosed = errors.New("tunnel session was closed")
+	ErrStreamClosed  = errors.New("tunnel stream was closed")
+	ErrStreamExists  = errors.New("tunnel stream id already in use")
+	ErrFrameTooShort = errors.New("binary frame too short for stream header")
+
+	ErrWindowExceeded = errors.New("tunnel stream data exceeded the flow control window")
+	ErrBadWindow      = errors.New("bad window update")
+	ErrConnectTimeout = errors.New("tunnel stream target not connected in time")
+)
+
+type Session struct {
+	// atomic, first for the 64-bit alignment on 32-bit platforms
+	bytesIn  int64 // payload of the Binary-Frames recved
+	bytesOut int64 // payload of the Binary-Frames sent
+
+	ws       *websocket.Conn
+	isServer bool
+
+	rw      *sync.RWMutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	closed  bool
+	done    chan struct{} // closed by CloseAll
+
+	missedPongs int32 // atomic, Pings not answered
+	rtt         int64 // atomic, time.Duration of the last Ping-Pong
+}
+
+func NewSession(ws *websocket.Conn, isServer bool) *Session {
+	ws.SetReadLimit(Max_Message_Size)
+	s := &Session{
+		ws:       ws,
+		isServer: isServer,
+		rw:       new(sync.RWMutex),
+		streams:  make(map[uint32]*Stream),
+		done:     make(chan struct{}),
+	}
+	// 服务器端打开的 stream 为偶数, 客户端为奇数, 两端同时 Open 也不会冲突
+	if isServer {
+		s.nextID = 2
+	} else {
+		s.nextID = 1
+	}
+	return s
+}
+
+func (s *Session) String() string {
+	return s.ws.String()
+}
+
+func (s *Session) WebSocket() *websocket.Conn {
+	return s.ws
+}
+
+// count of the streams which are forwarding
+func (s *Session) NumStreams() int {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return len(s.streams)
+}
+
+// Streams return the streams which are forwarding, order by ID.
+func (s *Session) Streams() []*Stream {
+	s.rw.RLock()
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.rw.RUnlock()
+	sort.Slice(streams, func(i, j int) bool { return streams[i].id < streams[j].id })
+	return streams
+}
+
+// Stream return the stream of the ID, nil if it is not forwarding.
+func (s *Session) Stream(id uint32) *Stream {
+	return s.getStream(id)
+}
+
+// BytesIn payload of all streams recved from the peer.
+func (s *Session) BytesIn() int64 {
+	return atomic.LoadInt64(&s.bytesIn)
+}
+
+// BytesOut payload of all streams sent to the peer.
+func (s *Session) BytesOut() int64 {
+	return atomic.LoadInt64(&s.bytesOut)
+}
+
+// Open a new stream and tell the peer by Msg_New_Connection, content is sent as the frame's Content.
+func (s *Session) Open(content string) (*Stream, error) {
+	s.rw.Lock()
+	if s.closed {
+		s.rw.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(id, s, content)
+	s.streams[id] = stream
+	s.rw.Unlock()
+
+	err := s.WriteControl(&ctrl.WebSocketControlFrame{
+		Type:    ctrl.Msg_New_Connection,
+		Index:   int64(id),
+		Content: content,
+	})
+	if err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept the stream which the peer opened by Msg_New_Connection, content is the frame's Content.
+func (s *Session) Accept(id uint32, content string) (*Stream, error) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+	if _, find := s.streams[id]; find {
+		return nil, ErrStreamExists
+	}
+	stream := newStream(id, s, content)
+	s.streams[id] = stream
+	return stream, nil
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return s.streams[id]
+}
+
+func (s *Session) remove(id uint32) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) WriteControl(frame *ctrl.WebSocketControlFrame) error {
+	return s.WriteMessage(websocket.TextMessage, frame.Bytes())
+}
+
+// WriteMessage is safe for many goroutines, websocket.Conn serialize the writes.
+func (s *Session) WriteMessage(messageType byte, message []byte) error {
+	return s.ws.WriteMessage(messageType, message)
+}
+
+func (s *Session) Pong(message []byte) error {
+	return s.WriteMessage(websocket.PongMessage, message)
+}
+
+func (s *Session) writeData(id uint32, data []byte) error {
+	buf := make([]byte, Stream_Header_Size+len(data))
+	binary.BigEndian.PutUint32(buf, id)
+	copy(buf[Stream_Header_Size:], data)
+	if err := s.WriteMessage(websocket.BinaryMessage, buf); err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.bytesOut, int64(len(data)))
+	return nil
+}
+
+// HandleBinary put the data of Binary-Frame into its stream.
+func (s *Session) HandleBinary(bFrame []byte) error {
+	if len(bFrame) < Stream_Header_Size {
+		return ErrFrameTooShort
+	}
+	id := binary.BigEndian.Uint32(bFrame)
+	atomic.AddInt64(&s.bytesIn, int64(len(bFrame)-Stream_Header_Size))
+	stream := s.getStream(id)
+	if stream == nil {
+		// the stream was closed at this side, tell the peer stop sending.
+		log.Debug("[%s] recv data of unknown stream[%d], size=%d", s, id, len(bFrame))
+		return s.WriteControl(&ctrl.WebSocketControlFrame{Type: ctrl.Msg_Request_Finish, Index: int64(id)})
+	}
+	if err := stream.push(bFrame[Stream_Header_Size:]); err != nil {
+		log.Warn("[%s] reset, err=%s", stream, err.Error())
+		return stream.Reset(err)
+	}
+	return nil
+}
+
+func (s *Session) writeWindowUpdate(id uint32, n int) error {
+	return s.WriteControl(&ctrl.WebSocketControlFrame{
+		Type:    ctrl.Msg_Window_Update,
+		Index:   int64(id),
+		Content: strconv.Itoa(n),
+	})
+}
+
+// HandleWindowUpdate the peer has Read the data of the stream, content is the bytes.
+func (s *Session) HandleWindowUpdate(id uint32, content string) error {
+	n, err := strconv.Atoi(content)
+	if err != nil || n <= 0 {
+		return ErrBadWindow
+	}
+	if stream := s.getStream(id); stream != nil {
+		stream.grant(n)
+	}
+	return nil
+}
+
+// HandleFinish the peer has closed the stream.
+func (s *Session) HandleFinish(id uint32) {
+	stream := s.getStream(id)
+	if stream == nil {
+		return
+	}
+	s.remove(id)
+	stream.remoteClose(nil)
+}
+
+// HandleConnected the peer has connected the target of the stream, Msg_Sys_Ok.
+func (s *Session) HandleConnected(id uint32) {
+	if stream := s.getStream(id); stream != nil {
+		stream.remoteConnected()
+	}
+}
+
+// HandleCloseWrite the peer has closed its write of the stream.
+func (s *Session) HandleCloseWrite(id uint32) {
+	if stream := s.getStream(id); stream != nil {
+		stream.remoteCloseWrite()
+	}
+}
+
+// HandleError the peer can not serve the stream, Msg_Sys_Err or Msg_Client_Busy.
+func (s *Session) HandleError(id uint32, content string) {
+	stream := s.getStream(id)
+	if stream == nil {
+		return
+	}
+	s.remove(id)
+	stream.remoteClose(fmt.Errorf("%s", content))
+}
+
+// CloseAll the websocket was gone, all streams end with ErrSessionClosed.
+func (s *Session) CloseAll() {
+	s.rw.Lock()
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	s.rw.Unlock()
+
+	for _, stream := range streams {
+		stream.remoteClose(ErrSessionClosed)
+	}
+}
+
+func (s *Session) Close() error {
+	s.CloseAll()
+	return s.ws.Close()
+}
+
+// Fail the websocket after the peer broke the protocol, the close frame tell the code,
+// the reply is not waited, RFC6455 7.1.7.
+func (s *Session) Fail(err error) error {
+	s.CloseAll()
+	if code := websocket.CloseCodeOf(err); code != 0 {
+		s.ws.SetWriteDeadline(time.Now().Add(websocket.Default_Close_Timeout))
+		s.ws.WriteClose(code, err.Error())
+	}
+	return s.ws.Close()
+}
+
+// CloseWithCode end all streams and close the websocket by the close handshake,
+// it is also the reply when the peer's close frame was read.
+func (s *Session) CloseWithCode(code int, reason string) error {
+	s.CloseAll()
+	return s.ws.CloseWithCode(code, reason)
+}
@@ -0,0 +1,277 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"ctrl"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"libs/websocket"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serve is the minimal frame loop of svr/cli, accept is called on Msg_New_Connection.
+func serve(s *Session, accept func(*Stream)) {
+	defer s.CloseAll()
+	for {
+		frameType, bFrame, err := s.WebSocket().Read()
+		if err != nil {
+			return
+		}
+		switch frameType {
+		case websocket.CloseMessage:
+			e := websocket.ParseCloseMessage(bFrame)
+			s.CloseWithCode(e.Code, e.Text)
+			return
+		case websocket.PingMessage:
+			s.Pong(bFrame)
+		case websocket.PongMessage:
+			s.HandlePong(bFrame)
+		case websocket.BinaryMessage:
+			s.HandleBinary(bFrame)
+		case websocket.TextMessage:
+			msg := ctrl.WebSocketControlFrame{}
+			json.Unmarshal(bFrame, &msg)
+			switch msg.Type {
+			case ctrl.Msg_New_Connection:
+				stream, err := s.Accept(uint32(msg.Index), msg.Content)
+				if err == nil {
+					go accept(stream)
+				}
+			case ctrl.Msg_Close_Write:
+				s.HandleCloseWrite(uint32(msg.Index))
+			case ctrl.Msg_Request_Finish:
+				s.HandleFinish(uint32(msg.Index))
+			case ctrl.Msg_Sys_Err:
+				s.HandleError(uint32(msg.Index), msg.Content)
+			case ctrl.Msg_Window_Update:
+				s.HandleWindowUpdate(uint32(msg.Index), msg.Content)
+			}
+		}
+	}
+}
+
+func newSessionPair(t *testing.T, accept func(*Stream)) (*Session, *Session) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		ch <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svr := NewSession(websocket.NewConn(<-ch, true), true)
+	cli := NewSession(websocket.NewConn(c, false), false)
+	go serve(svr, accept)
+	go serve(cli, accept)
+	return svr, cli
+}
+
+func echo(stream *Stream) {
+	io.Copy(stream, stream)
+	stream.Close()
+}
+
+func TestMultiplexStreams(t *testing.T) {
+	svr, cli := newSessionPair(t, echo)
+	defer svr.Close()
+	defer cli.Close()
+
+	const count = 100
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := svr.Open("")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+
+			payload := make([]byte, Max_Frame_Payload*2+100)
+			rand.Read(payload)
+			go stream.Write(payload)
+
+			result := make([]byte, len(payload))
+			if _, err := io.ReadFull(stream, result); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(payload, result) {
+				t.Error("stream", stream, "data not match")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStreamReset(t *testing.T) {
+	svr, cli := newSessionPair(t, func(stream *Stream) {
+		stream.Reset(io.ErrClosedPipe)
+	})
+	defer svr.Close()
+	defer cli.Close()
+
+	stream, err := cli.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.ID()%2 != 1 {
+		t.Fatal("client stream id must be odd", stream.ID())
+	}
+
+	_, err = stream.Read(make([]byte, 1))
+	if err == nil || err.Error() != io.ErrClosedPipe.Error() {
+		t.Fatal("want reset err, got", err)
+	}
+	if cli.NumStreams() != 0 {
+		t.Fatal("reset stream was not removed")
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	accepted := make(chan *Stream, 1)
+	svr, cli := newSessionPair(t, func(stream *Stream) {
+		accepted <- stream
+	})
+	defer svr.Close()
+	defer cli.Close()
+
+	stream, err := svr.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+
+	payload := make([]byte, Default_Stream_Window*4)
+	rand.Read(payload)
+	var written int64
+	go func() {
+		for p := payload; len(p) > 0; p = p[1024:] {
+			if _, err := stream.Write(p[:1024]); err != nil {
+				t.Error(err)
+				return
+			}
+			atomic.AddInt64(&written, 1024)
+		}
+	}()
+
+	// the peer does not Read, the writer must stop at the window.
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt64(&written); n > Default_Stream_Window {
+		t.Fatal("writer not blocked by the window, written", n)
+	}
+
+	result := make([]byte, len(payload))
+	if _, err := io.ReadFull(peer, result); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, result) {
+		t.Fatal("data not match")
+	}
+}
+
+// TestHalfClose the service reply after read EOF, like `nc -q` or SSH exit.
+func TestHalfClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				data, _ := ioutil.ReadAll(c)
+				fmt.Fprintf(c, "got %d bytes", len(data))
+			}()
+		}
+	}()
+
+	svr, cli := newSessionPair(t, func(stream *Stream) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			stream.Reset(err)
+			return
+		}
+		Join(stream, c)
+	})
+	defer svr.Close()
+	defer cli.Close()
+
+	stream, err := svr.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("x")); err != ErrStreamClosed {
+		t.Fatal("write after CloseWrite, want ErrStreamClosed, got", err)
+	}
+
+	reply, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "got 1000 bytes" {
+		t.Fatal("bad reply", string(reply))
+	}
+	stream.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if svr.NumStreams() != 0 || cli.NumStreams() != 0 {
+		t.Fatal("half-closed stream was not removed", svr.NumStreams(), cli.NumStreams())
+	}
+}
+
+func TestCloseWithCode(t *testing.T) {
+	svr, cli := newSessionPair(t, echo)
+
+	stream, err := cli.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := svr.CloseWithCode(ctrl.Close_Server_Shutdown, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= websocket.Default_Close_Timeout {
+		t.Fatal("the peer's close frame was not waited, cost", d)
+	}
+
+	e := cli.WebSocket().CloseError()
+	if e == nil || e.Code != ctrl.Close_Server_Shutdown || e.Text != "bye" {
+		t.Fatal("bad close frame at the peer", e)
+	}
+	if e := svr.WebSocket().CloseError(); e == nil || e.Code != ctrl.Close_Server_Shutdown {
+		t.Fatal("the reply must echo the code", e)
+	}
+	if _, err := stream.Read(make([]byte, 1)); err != ErrSessionClosed {
+		t.Fatal("stream of the closed session, want ErrSessionClosed, got", err)
+	}
+}
@@ -0,0 +1,350 @@
+package tunnel
+
+import (
+	"bytes"
+	"ctrl"
+	"errors"
+	"fmt"
+	"io"
+	"libs/log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Stream is one forwarded connection inside a Session.
+type Stream struct {
+	// atomic, first for the 64-bit alignment on 32-bit platforms
+	bytesIn  int64 // payload recved from the peer
+	bytesOut int64 // payload sent to the peer
+
+	id      uint32
+	session *Session
+	info    string // Content of Msg_New_Connection, ctrl.ConnectInfo
+	created time.Time
+
+	mu   *sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer // data recved from the peer, wait for Read, at most Default_Stream_Window
+
+	sendWindow int // bytes can be sent before the peer's Msg_Window_Update
+	consumed   int // bytes Read but not granted to the peer yet
+
+	connected         bool   // peer sent Msg_Sys_Ok, the target was connected
+	remoteClosed      bool   // peer sent Msg_Request_Finish / Msg_Sys_Err
+	localClosed       bool   // Close or Reset was called
+	remoteWriteClosed bool   // peer sent Msg_Close_Write, Read get EOF after the buffer
+	writeClosed       bool   // CloseWrite was called
+	err               error  // why the peer closed, nil is EOF
+	peer              string // remote addr of the conn joined to the stream
+}
+
+func newStream(id uint32, session *Session, info string) *Stream {
+	s := &Stream{
+		id:         id,
+		session:    session,
+		info:       info,
+		created:    time.Now(),
+		mu:         new(sync.Mutex),
+		sendWindow: Default_Stream_Window,
+	}
+	s.cond = sync.NewCond(s.mu)
+	return s
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Info is the Content of Msg_New_Connection which opened the stream.
+func (s *Stream) Info() string {
+	return s.info
+}
+
+// Created when the stream was opened or accepted.
+func (s *Stream) Created() time.Time {
+	return s.created
+}
+
+// BytesIn payload recved from the peer.
+func (s *Stream) BytesIn() int64 {
+	return atomic.LoadInt64(&s.bytesIn)
+}
+
+// BytesOut payload sent to the peer.
+func (s *Stream) BytesOut() int64 {
+	return atomic.LoadInt64(&s.bytesOut)
+}
+
+// Peer the remote addr of the conn joined to the stream, empty before Join.
+func (s *Stream) Peer() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peer
+}
+
+func (s *Stream) String() string {
+	return fmt.Sprintf("%s#%d", s.session, s.id)
+}
+
+// push return ErrWindowExceeded if the peer sent more than the window granted.
+func (s *Stream) push(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localClosed {
+		return nil
+	}
+	if s.buf.Len()+len(data) > Default_Stream_Window {
+		return ErrWindowExceeded
+	}
+	s.buf.Write(data)
+	atomic.AddInt64(&s.bytesIn, int64(len(data)))
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *Stream) remoteClose(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remoteClosed = true
+	s.err = err
+	s.cond.Broadcast()
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 {
+		if s.localClosed {
+			s.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if s.remoteClosed {
+			s.mu.Unlock()
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, io.EOF
+		}
+		if s.remoteWriteClosed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		s.cond.Wait()
+	}
+	n, err := s.buf.Read(p)
+
+	// 读走一半窗口后才归还, 避免每次 Read 都发一个 Msg_Window_Update
+	var grant int
+	s.consumed += n
+	if s.consumed >= Default_Stream_Window/2 && !s.remoteClosed && !s.remoteWriteClosed {
+		grant = s.consumed
+		s.consumed = 0
+	}
+	s.mu.Unlock()
+
+	if grant > 0 {
+		s.session.writeWindowUpdate(s.id, grant)
+	}
+	return n, err
+}
+
+// grant the peer has Read n bytes, more can be sent.
+func (s *Stream) grant(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendWindow += n
+	s.cond.Broadcast()
+}
+
+// Write block when the peer's window is used up, so a slow reader slow down the writer.
+func (s *Stream) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.sendWindow <= 0 && !s.localClosed && !s.remoteClosed && !s.writeClosed {
+			s.cond.Wait()
+		}
+		if s.localClosed || s.remoteClosed || s.writeClosed {
+			s.mu.Unlock()
+			return n, ErrStreamClosed
+		}
+		size := len(p)
+		if size > Max_Frame_Payload {
+			size = Max_Frame_Payload
+		}
+		if size > s.sendWindow {
+			size = s.sendWindow
+		}
+		s.sendWindow -= size
+		s.mu.Unlock()
+
+		if err := s.session.writeData(s.id, p[:size]); err != nil {
+			return n, err
+		}
+		atomic.AddInt64(&s.bytesOut, int64(size))
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+func (s *Stream) remoteConnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = true
+	s.cond.Broadcast()
+}
+
+// SendConnected tell the peer by Msg_Sys_Ok that the target was connected.
+func (s *Stream) SendConnected() error {
+	return s.session.WriteControl(&ctrl.WebSocketControlFrame{Type: ctrl.Msg_Sys_Ok, Index: int64(s.id)})
+}
+
+// WaitConnected block until the peer tell the target was connected by SendConnected,
+// return the peer's error if it closed the stream, ErrConnectTimeout after timeout.
+func (s *Stream) WaitConnected(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.connected {
+		switch {
+		case s.localClosed:
+			return ErrStreamClosed
+		case s.remoteClosed && s.err != nil:
+			return s.err
+		case s.remoteClosed:
+			return io.EOF
+		case !time.Now().Before(deadline):
+			return ErrConnectTimeout
+		}
+		s.cond.Wait()
+	}
+	return nil
+}
+
+// remoteCloseWrite the peer will not send more data, like TCP FIN.
+func (s *Stream) remoteCloseWrite() {
+	s.mu.Lock()
+	s.remoteWriteClosed = true
+	done := s.writeClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.session.remove(s.id)
+	}
+}
+
+// CloseWrite tell the peer by Msg_Close_Write that no more data will be sent,
+// the stream can still Read until the peer close its write too.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.localClosed || s.remoteClosed || s.writeClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	done := s.remoteWriteClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	err := s.session.WriteControl(&ctrl.WebSocketControlFrame{Type: ctrl.Msg_Close_Write, Index: int64(s.id)})
+	// 两个方向都关闭了, stream 结束, 不必再发 Msg_Request_Finish
+	if done {
+		s.session.remove(s.id)
+	}
+	return err
+}
+
+// Close the stream and tell the peer by Msg_Request_Finish.
+func (s *Stream) Close() error {
+	return s.close(&ctrl.WebSocketControlFrame{Type: ctrl.Msg_Request_Finish, Index: int64(s.id)})
+}
+
+// Reset close the stream and tell the peer why by Msg_Sys_Err.
+func (s *Stream) Reset(err error) error {
+	return s.close(&ctrl.WebSocketControlFrame{Type: ctrl.Msg_Sys_Err, Index: int64(s.id), Content: err.Error()})
+}
+
+func (s *Stream) close(frame *ctrl.WebSocketControlFrame) error {
+	s.mu.Lock()
+	if s.localClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	finished := s.remoteClosed || (s.writeClosed && s.remoteWriteClosed)
+	s.buf.Reset()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.session.remove(s.id)
+	if finished {
+		return nil
+	}
+	return s.session.WriteControl(frame)
+}
+
+// isClosed the err is caused by closing the stream or the conn, no need to log.
+func isClosed(err error) bool {
+	return errors.Is(err, ErrStreamClosed) || errors.Is(err, ErrSessionClosed) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ENOTCONN)
+}
+
+// closeWrite shut down the writing side of conn, *net.TCPConn and *tls.Conn support it.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// Join forward data between the stream and conn until both direction finish, then close them.
+// EOF of one direction is forwarded as half-close, so the other direction keeps working.
+func Join(stream *Stream, conn net.Conn) {
+	stream.mu.Lock()
+	stream.peer = conn.RemoteAddr().String()
+	stream.mu.Unlock()
+
+	done := make(chan int, 1)
+	go func() {
+		_, err := io.Copy(conn, stream)
+		if err == nil {
+			err = closeWrite(conn)
+		}
+		if err != nil {
+			if !isClosed(err) {
+				log.Warn("[%s] forward to[%s] err=%v", stream, conn.RemoteAddr(), err)
+			}
+			// stop the other direction
+			conn.Close()
+		}
+		done <- 1
+	}()
+
+	_, err := io.Copy(stream, conn)
+	if err == nil {
+		err = stream.CloseWrite()
+	}
+	if err != nil {
+		if !isClosed(err) {
+			log.Debug("[%s] read from[%s] end, err=%v", stream, conn.RemoteAddr(), err)
+		}
+		stream.Close()
+	}
+	<-done
+	stream.Close()
+	conn.Close()
+	log.Info("[%s] forward[%s] finish.", stream, conn.RemoteAddr())
+}